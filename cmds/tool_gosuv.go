@@ -11,7 +11,9 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/urfave/cli"
@@ -22,6 +24,7 @@ import (
 var (
 	version string = "dev"
 	cfg gosuv.Configuration
+	apiToken string // 启用ldap之后, 命令行通过API Token访问Api
 )
 
 func catchExitSignal(suv *gosuv.Supervisor) {
@@ -76,11 +79,7 @@ func actionStartServer(c *cli.Context) error {
 	auth := cfg.Server.Ldap.Enabled
 	if auth {
 		// 添加Ldap认证
-		hdlr = gosuv.NewLdapAuth(hdlr, &cfg, true)
-	}
-
-	if len(cfg.Db.DbDsn) == 0 || len(cfg.Db.DbType) == 0 {
-		log.Panicf("Database should be configured")
+		hdlr = gosuv.NewLdapAuth(hdlr, &cfg, suv.DB, true)
 	}
 
 	apiPrefix := "/" + suv.Host + "/"
@@ -108,7 +107,8 @@ func actionStartServer(c *cli.Context) error {
 	// 直接在命令行指定运行模式, 或者后台运行模式都走这条路
 	//./gosuv start-server -f
 	// 直接运行 ListenAndServe
-	suv.AutoStartPrograms()
+	// 按照依赖顺序启动时需要等待，不要阻塞server
+	go suv.AutoStartPrograms()
 
 	log.Printf("server listen on %v", addr)
 	go func() {
@@ -164,11 +164,25 @@ func postForm(pathname string, data url.Values) (r gosuv.JSONResponse, err error
 	//
 	url := cfg.Client.ServerURL + pathname
 	log.Printf("Request Url: %s", url)
-	resp, err := http.PostForm(url, data)
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return r, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(apiToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return r, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if len(apiToken) == 0 {
+			return r, errors.New("Unauthorized: ldap is enabled, use --token or GOSUV_TOKEN to pass an API Token")
+		}
+		return r, errors.New("Unauthorized: the API Token is invalid, revoked or expired")
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return r, err
@@ -193,17 +207,140 @@ func actionRestart(c *cli.Context) error {
 
 }
 
+// 滚动重启某个Program的所有进程
+func actionRollingRestart(c *cli.Context) error {
+	name := c.Args().First()
+	if len(name) == 0 {
+		return errors.New("program name required")
+	}
+
+	data := url.Values{}
+	data.Set("batch_size", strconv.Itoa(c.Int("batch-size")))
+	data.Set("pause", strconv.Itoa(c.Int("pause")))
+	ret, err := postForm("/api/programs/"+name+"/rolling-restart", data)
+	if err != nil {
+		log.ErrorErrorf(err, "Rolling restart failed")
+		return err
+	}
+	if ret.Status != 0 {
+		return fmt.Errorf("%v", ret.Value)
+	}
+	log.Printf("Rolling restart: %v", ret.Value)
+	return nil
+}
+
+// 给某个Program的进程发送信号
+func actionSignal(c *cli.Context) error {
+	name := c.Args().Get(0)
+	sig := c.Args().Get(1)
+	if len(name) == 0 || len(sig) == 0 {
+		return errors.New("program name and signal required")
+	}
+
+	pathname := "/api/programs/" + name + "/signal"
+	if index := c.Int("index"); index >= 0 {
+		pathname = fmt.Sprintf("/api/processes/%s/%d/signal", name, index)
+	}
+	ret, err := postForm(pathname, url.Values{"signal": {sig}})
+	if err != nil {
+		log.ErrorErrorf(err, "Send signal failed")
+		return err
+	}
+	if ret.Status != 0 {
+		return fmt.Errorf("%v", ret.Value)
+	}
+	log.Printf("Signal: %v", ret.Value)
+	return nil
+}
+
+// 密码从标准输入读取, 避免出现在shell的历史记录中
+func actionSealSecret(c *cli.Context) error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if len(value) == 0 {
+		return errors.New("secret value required")
+	}
+
+	ret, err := postForm("/api/secrets/seal", url.Values{"value": {value}})
+	if err != nil {
+		log.ErrorErrorf(err, "Seal secret failed")
+		return err
+	}
+	if ret.Status != 0 {
+		return fmt.Errorf("%v", ret.Value)
+	}
+	fmt.Println(ret.Value)
+	return nil
+}
+
 // 所有的操作都通过api来实现
 func actionReload(c *cli.Context) error {
-	ret, err := postForm("/api/reload", nil)
+	var data url.Values
+	if c.Bool("dry-run") {
+		data = url.Values{"dry_run": {"1"}}
+	} else if hash := c.String("hash"); len(hash) > 0 {
+		data = url.Values{"hash": {hash}}
+	}
+
+	ret, err := postForm("/api/reload", data)
 	if err != nil {
 		log.ErrorErrorf(err, "reload failed")
 		return err
 	}
-	fmt.Println(ret.Value)
+	if ret.Status != 0 {
+		return fmt.Errorf("%v", ret.Value)
+	}
+	if data == nil {
+		fmt.Println(ret.Value)
+		return nil
+	}
+
+	// 计划: 和dry-run的输出一样
+	var plan gosuv.ReloadPlan
+	value, _ := json.Marshal(ret.Value)
+	if err := json.Unmarshal(value, &plan); err != nil {
+		return err
+	}
+	printReloadPlan(&plan)
+	if c.Bool("dry-run") && !plan.Empty() {
+		fmt.Printf("\napply: tool_gosuv reload --hash %s\n", plan.Hash)
+	}
 	return nil
 }
 
+// 例如:
+// + redis (process_num: 1)
+// - cron (process_num: 1)
+// ~ web (process_num: 1 -> 2)
+//     command: "./web" -> "./web -v"
+func printReloadPlan(plan *gosuv.ReloadPlan) {
+	if plan.Empty() {
+		fmt.Println("no changes")
+		return
+	}
+	for _, diff := range plan.Added {
+		fmt.Printf("+ %s (process_num: %d)\n", diff.Name, diff.NewProcessNum)
+	}
+	for _, diff := range plan.Removed {
+		fmt.Printf("- %s (process_num: %d)\n", diff.Name, diff.OldProcessNum)
+	}
+	for _, diff := range plan.Updated {
+		fmt.Printf("~ %s (process_num: %d -> %d)\n", diff.Name, diff.OldProcessNum, diff.NewProcessNum)
+		for _, field := range diff.Fields {
+			oldValue, _ := json.Marshal(field.Old)
+			newValue, _ := json.Marshal(field.New)
+			fmt.Printf("    %s: %s -> %s\n", field.Field, oldValue, newValue)
+		}
+	}
+	fmt.Printf("\nstart: %s\n", strings.Join(plan.Start, ", "))
+	fmt.Printf("stop: %s\n", strings.Join(plan.Stop, ", "))
+	fmt.Printf("restart required: %s\n", strings.Join(plan.Restart, ", "))
+	fmt.Printf("hash: %s\n", plan.Hash)
+}
+
 func actionConfigTest(c *cli.Context) error {
 	if _, _, err := gosuv.NewSupervisorHandler(&cfg, ""); err != nil {
 		log.ErrorErrorf(err, "config test failed")
@@ -237,6 +374,9 @@ func main() {
 			log.ErrorErrorf(err, "config read failed")
 			return err
 		}
+		// programs.yml默认和配置文件在同一个目录
+		gosuv.DefaultConfigDir = filepath.Dir(cfgPath)
+		apiToken = c.GlobalString("token")
 		return nil
 	}
 	// 当前app支持的Flags(主要是输入config)
@@ -246,6 +386,11 @@ func main() {
 			Usage: "config file",
 			Value: "",
 		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "API Token used when ldap is enabled, e.g. gsv_xxxx",
+			EnvVar: "GOSUV_TOKEN",
+		},
 	}
 
 	// 当前app支持的Commands
@@ -274,8 +419,22 @@ func main() {
 			Action:  actionStatus,
 		},
 		{
-			Name:   "reload",
-			Usage:  "Reload config file",
+			//
+			// 命令: tool_gosuv reload --dry-run
+			//      tool_gosuv reload --hash <dry-run输出的hash>
+			Name:  "reload",
+			Usage: "Reload config file",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show the reload plan without applying it",
+				},
+				cli.StringFlag{
+					Name:  "hash",
+					Usage: "apply the plan returned by --dry-run",
+					Value: "",
+				},
+			},
 			Action: actionReload,
 		},
 
@@ -287,6 +446,50 @@ func main() {
 			Usage:  "Restart programs",
 			Action: actionRestart,
 		},
+		{
+			//
+			// 命令: tool_gosuv rolling-restart -b 2 -p 5 program_name
+			Name:      "rolling-restart",
+			Usage:     "Restart processes of a program batch by batch",
+			ArgsUsage: "<program>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "batch-size, b",
+					Usage: "processes restarted per batch",
+					Value: 1,
+				},
+				cli.IntFlag{
+					Name:  "pause, p",
+					Usage: "seconds to wait between batches",
+					Value: 0,
+				},
+			},
+			Action: actionRollingRestart,
+		},
+		{
+			//
+			// 命令: tool_gosuv signal program_name HUP
+			//      tool_gosuv signal -i 0 program_name USR1
+			Name:      "signal",
+			Usage:     "Send signal to processes of a program",
+			ArgsUsage: "<program> <signal>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "index, i",
+					Usage: "process index, default all processes",
+					Value: -1,
+				},
+			},
+			Action: actionSignal,
+		},
+		{
+			//
+			// 命令: echo -n "password" | tool_gosuv seal-secret
+			// 输出: secret://sealed/xxx, 可以直接用在environ中, 例如: DB_PASS=secret://sealed/xxx
+			Name:   "seal-secret",
+			Usage:  "Encrypt a secret read from stdin with the supervisor key",
+			Action: actionSealSecret,
+		},
 		{
 			Name:    "conftest",
 			Aliases: []string{"t"},
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/jinzhu/gorm"
 	"github.com/wfxiang08/cyutils/utils/log"
 	"github.com/wfxiang08/gosuv/gosuv"
 )
@@ -33,8 +34,18 @@ func main() {
 		log.ErrorErrorf(err, "Config file read failed")
 		return
 	}
+	// 支持ApiToken时需要数据库
+	var db *gorm.DB
+	if cfg.HasDatabase() {
+		if db, err = gosuv.OpenDB(&cfg); err != nil {
+			log.ErrorErrorf(err, "Open database failed")
+			return
+		}
+	}
 	handler := &SimpleHandler{}
-	authHandler := gosuv.NewLdapAuth(handler, &cfg, false)
+	authHandler := gosuv.NewLdapAuth(handler, &cfg, func() *gorm.DB {
+		return db
+	}, false)
 	http.Handle("/", authHandler)
 	err = http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *port), nil)
 
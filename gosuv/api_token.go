@@ -0,0 +1,322 @@
+package gosuv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token的权限范围
+const (
+	TokenScopeRead    = "read"    // 只读, 等同于viewer
+	TokenScopeControl = "control" // 启停, 信号, 滚动重启等, 等同于operator
+	TokenScopeAdmin   = "admin"   // 等同于admin
+)
+
+var tokenScopeRoles = map[string]string{
+	TokenScopeRead:    RoleViewer,
+	TokenScopeControl: RoleOperator,
+	TokenScopeAdmin:   RoleAdmin,
+}
+
+// 使用Token认证时, LdapAuth写入的header(和ldap_uid一样, 不能由客户端指定)
+const (
+	TokenNameKey     = "api_token"
+	TokenScopeKey    = "api_token_scope"
+	TokenProgramsKey = "api_token_programs"
+)
+
+const tokenPrefix = "gsv_"
+
+//
+// 自动化脚本使用的Token, 代替ldap账号密码: Authorization: Bearer gsv_xxxx
+// 数据库中只保存sha256, 创建时返回的明文之后无法再查看
+//
+type ApiToken struct {
+	ID          uint       `json:"id" gorm:"primary_key"`
+	Host        string     `json:"host" gorm:"size:100;index:idx_host_owner"`
+	Name        string     `json:"name" gorm:"size:100"`         // 用途, 例如: deploy
+	Owner       string     `json:"owner" gorm:"size:40;index:idx_host_owner"`         // 创建者, 操作记录中作为操作者
+	OwnerGroups string     `json:"owner_groups" gorm:"size:500"` // 创建时创建者所在的ldap组(逗号分隔), 只用于查看, 使用时重新查询ldap
+	Scope       string     `json:"scope" gorm:"size:20"`
+	Programs    string     `json:"programs" gorm:"size:200"` // 可以操作的Program, glob格式, 例如: web-*
+	Prefix      string     `json:"prefix" gorm:"size:20"`    // 明文的前几位, 用于识别
+	TokenHash   string     `json:"-" gorm:"size:64;unique_index:idx_token_hash"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	RevokedAt   *time.Time `json:"revoked_at"` // 已撤销的Token不能再使用
+	ExpiresAt   *time.Time `json:"expires_at"` // 过期时间, null表示不过期
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 生成新的Token明文, 例如: gsv_0123...(64个hex)
+func newTokenValue() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(data), nil
+}
+
+// 检查scope和programs, programs默认为*
+func checkTokenScope(scope string, programs string) (string, error) {
+	if _, ok := tokenScopeRoles[scope]; !ok {
+		return "", fmt.Errorf("Invalid scope: %s, expected: read, control, admin", strconv.Quote(scope))
+	}
+	if len(programs) == 0 {
+		programs = "*"
+	}
+	if _, err := path.Match(programs, ""); err != nil {
+		return "", fmt.Errorf("Invalid programs: %s, %v", strconv.Quote(programs), err)
+	}
+	return programs, nil
+}
+
+// 过期时间, 格式和操作记录的查询一样, 例如: 2006-01-02; 空字符串表示不过期
+func parseTokenExpiresAt(value string) (*time.Time, error) {
+	expiresAt, err := parseAuditTime(value)
+	if err != nil || expiresAt.IsZero() {
+		return nil, err
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("Token expires_at %s is in the past", value)
+	}
+	return &expiresAt, nil
+}
+
+// Token是否可以操作name对应的Program
+func tokenMatchProgram(programs string, name string) bool {
+	matched, err := path.Match(programs, name)
+	return err == nil && matched
+}
+
+//
+// 根据Authorization: Bearer中的Token查找没有撤销, 没有过期的ApiToken, 并记录最近使用的时间
+//
+func LookupApiToken(db *gorm.DB, host string, token string) (*ApiToken, error) {
+	// 没有配置数据库, 或者数据库不可用(降级模式)时为nil
+	if db == nil {
+		return nil, errDatabaseUnavailable
+	}
+
+	now := time.Now()
+	apiToken := &ApiToken{}
+	err := db.Where("host = ? AND token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)",
+		host, hashToken(token), now).First(apiToken).Error
+	if err != nil {
+		return nil, err
+	}
+
+	db.Model(apiToken).UpdateColumn("last_used_at", now)
+	apiToken.LastUsedAt = &now
+	return apiToken, nil
+}
+
+// groups: 创建者当前所在的ldap组
+func (t *ApiToken) UpdateHeaders(h http.Header, groups []string) {
+	h.Set(LdapUserKey, t.Owner)
+	h.Set(LdapUserGroupsKey, strings.Join(groups, ","))
+	h.Set(TokenNameKey, fmt.Sprintf("%s(%s)", t.Name, t.Prefix))
+	h.Set(TokenScopeKey, t.Scope)
+	h.Set(TokenProgramsKey, t.Programs)
+}
+
+func (s *Supervisor) dbListTokens(owner string) ([]ApiToken, error) {
+	db, err := s.requireDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Where("host = ?", s.Host)
+	if len(owner) > 0 {
+		query = query.Where("owner = ?", owner)
+	}
+	tokens := []ApiToken{}
+	err = query.Order("id desc").Find(&tokens).Error
+	return tokens, err
+}
+
+//
+// Token的列表: 管理员可以查看所有的Token, 其他用户只能查看自己的
+//
+func (s *Supervisor) hGetTokens(w http.ResponseWriter, r *http.Request) {
+	user := s.requestUser(r)
+	owner := user.Name
+	if user.Role == RoleAdmin {
+		owner = r.FormValue("owner")
+	}
+
+	tokens, err := s.dbListTokens(owner)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  tokens,
+	})
+}
+
+//
+// 创建Token, 参数: name, scope(read, control, admin), programs(glob, 默认为*), expires_at(可选)
+// scope不能超过当前用户的角色; 返回的明文只出现一次
+//
+func (s *Supervisor) hCreateToken(w http.ResponseWriter, r *http.Request) {
+	user := s.requestUser(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	scope := r.FormValue("scope")
+
+	auditRecord := &AuditRecord{
+		Action: AuditCreateToken,
+		Params: auditParams("name", name, "scope", scope, "programs", r.FormValue("programs"), "expires_at", r.FormValue("expires_at")),
+	}
+	programs, err := checkTokenScope(scope, strings.TrimSpace(r.FormValue("programs")))
+	var expiresAt *time.Time
+	if err == nil {
+		expiresAt, err = parseTokenExpiresAt(strings.TrimSpace(r.FormValue("expires_at")))
+	}
+	if err == nil && len(name) == 0 {
+		err = fmt.Errorf("Token name empty")
+	}
+	if err == nil && len(user.Name) == 0 {
+		// Token代表创建者, 只有ldap用户才能创建
+		err = fmt.Errorf("Token requires a ldap user")
+	}
+	if err == nil && roleLevels[tokenScopeRoles[scope]] > roleLevels[user.Role] {
+		err = fmt.Errorf("Scope %s exceeds role %s", scope, user.Role)
+	}
+	if err != nil {
+		s.audit(r, auditRecord, err)
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	value, err := newTokenValue()
+	var db *gorm.DB
+	if err == nil {
+		db, err = s.requireDB()
+	}
+	if err != nil {
+		s.audit(r, auditRecord, err)
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	apiToken := &ApiToken{
+		Host:        s.Host,
+		Name:        name,
+		Owner:       user.Name,
+		OwnerGroups: strings.Join(user.Groups, ","),
+		Scope:       scope,
+		Programs:    programs,
+		Prefix:      value[:len(tokenPrefix)+8],
+		TokenHash:   hashToken(value),
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	}
+
+	err = db.Create(apiToken).Error
+	s.audit(r, auditRecord, err)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	log.Printf("操作: %s create token: %s, scope: %s, programs: %s", user.Name, apiToken.Prefix, scope, programs)
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value: map[string]interface{}{
+			"token":     value,
+			"api_token": apiToken,
+		},
+	})
+}
+
+//
+// 撤销Token: 创建者或者管理员
+//
+func (s *Supervisor) hRevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := s.requestUser(r)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	auditRecord := &AuditRecord{Action: AuditRevokeToken, Params: auditParams("id", strconv.Itoa(id))}
+
+	db, err := s.requireDB()
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	apiToken := &ApiToken{}
+	if err := db.Where("host = ? AND id = ?", s.Host, id).First(apiToken).Error; err != nil {
+		err = fmt.Errorf("Token %d not exists", id)
+		s.audit(r, auditRecord, err)
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	if apiToken.Owner != user.Name && user.Role != RoleAdmin {
+		err := fmt.Errorf("Permission denied: %s is not owner of the token", user.Name)
+		s.audit(r, auditRecord, err)
+		writeForbidden(w, err)
+		return
+	}
+
+	if apiToken.RevokedAt == nil {
+		now := time.Now()
+		err = db.Model(apiToken).UpdateColumn("revoked_at", now).Error
+	}
+	auditRecord.Params = auditParams("id", strconv.Itoa(id), "name", apiToken.Name, "prefix", apiToken.Prefix)
+	s.audit(r, auditRecord, err)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	log.Printf("操作: %s revoke token: %s, owner: %s", user.Name, apiToken.Prefix, apiToken.Owner)
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  fmt.Sprintf("Token %s revoked", apiToken.Prefix),
+	})
+}
+
+//
+// Token管理页面
+//
+func (s *Supervisor) hTokens(w http.ResponseWriter, r *http.Request) {
+	s.renderHTML(w, r, "token/token.html", pongo2.Context{
+		"Host": s.Host,
+	})
+}
@@ -0,0 +1,159 @@
+package gosuv
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestTokenScope"
+func TestTokenScope(t *testing.T) {
+	if programs, err := checkTokenScope(TokenScopeControl, ""); err != nil || programs != "*" {
+		t.Errorf("unexpected programs: %s, %v", programs, err)
+	}
+	for _, c := range [][2]string{{"write", "*"}, {TokenScopeRead, "web-["}} {
+		if _, err := checkTokenScope(c[0], c[1]); err == nil {
+			t.Errorf("%v: expected error", c)
+		}
+	}
+
+	if !tokenMatchProgram("web-*", "web-api") || tokenMatchProgram("web-*", "redis") {
+		t.Errorf("unexpected glob match")
+	}
+
+	value, err := newTokenValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, tokenPrefix) || len(value) != len(tokenPrefix)+64 {
+		t.Errorf("unexpected token: %s", value)
+	}
+	if hashToken(value) == value || len(hashToken(value)) != 64 {
+		t.Errorf("unexpected token hash")
+	}
+}
+
+// go test gosuv -v -run "TestTokenAuthorize"
+func TestTokenAuthorize(t *testing.T) {
+	cfg := &Configuration{}
+	cfg.Server.Ldap.Enabled = true
+	cfg.Rbac.DefaultRole = RoleOperator
+	s := &Supervisor{
+		cfg: cfg,
+		name2Program: map[string]*ProgramEx{
+			"web-api": {Program: &Program{Name: "web-api", Author: "alice"}},
+			"redis":   {Program: &Program{Name: "redis", Author: "alice"}},
+		},
+	}
+
+	token := &ApiToken{Name: "deploy", Owner: "alice", Scope: TokenScopeControl, Programs: "web-*", Prefix: "gsv_12345678"}
+	r := httptest.NewRequest("POST", "/api/programs/web-api/stop", nil)
+	token.UpdateHeaders(r.Header, nil)
+	user := s.requestUser(r)
+	if user.Role != RoleOperator || user.Token != "deploy(gsv_12345678)" {
+		t.Fatalf("unexpected token user: %+v", user)
+	}
+	if err := user.authorize(PermManage, "web-api", true, true); err != nil {
+		t.Errorf("expected web-api allowed: %v", err)
+	}
+	if err := user.authorize(PermManage, "redis", true, true); err == nil {
+		t.Errorf("expected redis denied by glob")
+	}
+	if err := user.authorize(PermCreate, "", false, false); err == nil {
+		t.Errorf("expected create denied for limited token")
+	}
+	if err := user.authorize(PermTokens, "", false, false); err == nil {
+		t.Errorf("expected token management denied")
+	}
+
+	// scope限制角色: admin的read Token只能查看
+	cfg.Admins = []string{"alice"}
+	token.Scope, token.Programs = TokenScopeRead, "*"
+	r = httptest.NewRequest("GET", "/api/programs", nil)
+	token.UpdateHeaders(r.Header, nil)
+	if user := s.requestUser(r); user.Role != RoleViewer {
+		t.Errorf("expected viewer, got %s", user.Role)
+	}
+
+	// 角色按照创建者当前的ldap组计算
+	cfg.Admins = nil
+	cfg.Rbac.Groups = map[string]string{"ops": RoleAdmin}
+	token.Scope = TokenScopeAdmin
+	r = httptest.NewRequest("POST", "/api/reload", nil)
+	token.UpdateHeaders(r.Header, []string{"ops"})
+	if user := s.requestUser(r); user.Role != RoleAdmin {
+		t.Errorf("expected admin, got %s", user.Role)
+	}
+	token.OwnerGroups = "ops"
+	token.UpdateHeaders(r.Header, nil)
+	if user := s.requestUser(r); user.Role != RoleOperator {
+		t.Errorf("expected operator after leaving ops, got %s", user.Role)
+	}
+}
+
+// go test gosuv -v -run "TestTokenOwnerGroups"
+func TestTokenOwnerGroups(t *testing.T) {
+	lookups := 0
+	oldLookup := lookupUserGroups
+	lookupUserGroups = func(username string, cfg *Configuration) ([]string, error) {
+		lookups++
+		if username == "bob" {
+			return nil, errors.New("user bob does not exist")
+		}
+		return []string{"dev"}, nil
+	}
+	defer func() { lookupUserGroups = oldLookup }()
+
+	cfg := &Configuration{}
+	cfg.Server.Ldap.Enabled = true
+	auth := NewLdapAuth(nil, cfg, nil, true)
+	for i := 0; i < 2; i++ {
+		groups, err := auth.tokenOwnerGroups("alice_groups_test")
+		if err != nil || len(groups) != 1 || groups[0] != "dev" {
+			t.Errorf("unexpected groups: %v, %v", groups, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected groups cached, lookups: %d", lookups)
+	}
+	if _, err := auth.tokenOwnerGroups("bob"); err == nil {
+		t.Errorf("expected error for removed owner")
+	}
+}
+
+// go test gosuv -v -run "TestParseTokenExpiresAt"
+func TestParseTokenExpiresAt(t *testing.T) {
+	if expiresAt, err := parseTokenExpiresAt(""); err != nil || expiresAt != nil {
+		t.Errorf("expected no expiration, got %v, %v", expiresAt, err)
+	}
+	tomorrow := time.Now().Add(24 * time.Hour).Format("2006-01-02 15:04:05")
+	if expiresAt, err := parseTokenExpiresAt(tomorrow); err != nil || expiresAt == nil {
+		t.Errorf("expected expiration, got %v, %v", expiresAt, err)
+	}
+	for _, value := range []string{"2000-01-01", "tomorrow"} {
+		if _, err := parseTokenExpiresAt(value); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestLdapAuthClearHeaders"
+func TestLdapAuthClearHeaders(t *testing.T) {
+	var headers http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	})
+	auth := NewLdapAuth(handler, &Configuration{}, nil, true)
+
+	// 伪造用户和Token
+	r := httptest.NewRequest("POST", "/api/restart", nil)
+	r.Header.Set(LdapUserKey, "root")
+	r.Header.Set(TokenScopeKey, TokenScopeAdmin)
+	auth.ServeHTTP(httptest.NewRecorder(), r)
+	if headers == nil || headers.Get(LdapUserKey) != "" || headers.Get(TokenScopeKey) != "" {
+		t.Errorf("expected spoofed headers cleared, got %v", headers)
+	}
+}
@@ -0,0 +1,231 @@
+package gosuv
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flosch/pongo2"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 审计的操作
+const (
+	AuditReload         = "reload"
+	AuditRestartAll     = "restart-all"
+	AuditAddProgram     = "add-program"
+	AuditUpdateProgram  = "update-program"
+	AuditDeleteProgram  = "delete-program"
+	AuditStartProgram   = "start-program"
+	AuditStopProgram    = "stop-program"
+	AuditRollingRestart = "rolling-restart"
+	AuditSignal         = "signal"
+	AuditStartProcess   = "start-process"
+	AuditStopProcess    = "stop-process"
+	AuditSealSecret     = "seal-secret"
+	AuditCreateToken    = "create-token"
+	AuditRevokeToken    = "revoke-token"
+)
+
+// 操作的结果
+const (
+	AuditSuccess = "success"
+	AuditFailed  = "failed"
+)
+
+// 查询审计记录时默认(最多)返回的条数
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+//
+// 操作记录: 所有修改状态的Api都会记录, 取代之前从日志中grep "操作: "
+//
+type AuditRecord struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	Host      string    `json:"host" gorm:"size:100;index:idx_host_created_at,idx_host_program,idx_host_user"`
+	User      string    `json:"user" gorm:"size:40;index:idx_host_user"`   // ldap用户, 使用Token时为Token的创建者
+	Token     string    `json:"token" gorm:"size:120"` // 使用的Token, 例如: deploy(gsv_1234abcd)
+	Action    string    `json:"action" gorm:"size:40"`
+	Program   string    `json:"program" gorm:"size:100;index:idx_host_program"`
+	Process   string    `json:"process" gorm:"size:20"`    // 进程序号, 针对整个Program的操作时为空
+	Params    string    `json:"params" gorm:"size:1000"`   // 其他参数(JSON), 例如: signal, batch_size
+	Before    string    `json:"before" gorm:"type:text"`   // 修改之前的Program(JSON, 隐藏密码)
+	After     string    `json:"after" gorm:"type:text"`    // 修改之后的Program
+	Result    string    `json:"result" gorm:"size:20"`     // success, failed
+	Error     string    `json:"error" gorm:"size:500"`
+	CreatedAt time.Time `json:"created_at" gorm:"index:idx_host_created_at"`
+}
+
+// 审计记录的查询条件, 空值表示不限制
+type AuditFilter struct {
+	User    string
+	Program string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+	Offset  int
+}
+
+// 操作的参数, 例如: auditParams("signal", "HUP")
+func auditParams(kvs ...string) string {
+	params := make(map[string]string, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		params[kvs[i]] = kvs[i+1]
+	}
+	data, _ := json.Marshal(params)
+	return string(data)
+}
+
+// 修改前后的Program, 通过json序列化(EnvironList会隐藏密码)
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+//
+// 记录一次操作: 填写操作者和结果之后写入数据库
+// 写入失败时只打印日志, 不影响操作本身
+//
+func (s *Supervisor) audit(r *http.Request, record *AuditRecord, err error) {
+	record.Host = s.Host
+	record.User = r.Header.Get(LdapUserKey)
+	record.Token = r.Header.Get(TokenNameKey)
+	record.Result = AuditSuccess
+	if err != nil {
+		record.Result = AuditFailed
+		record.Error = err.Error()
+	}
+	record.CreatedAt = time.Now()
+	db := s.DB()
+	if db == nil {
+		return
+	}
+
+	if err := db.Create(record).Error; err != nil {
+		log.ErrorErrorf(err, "Save audit record failed: %s %s %s", record.User, record.Action, record.Program)
+	}
+}
+
+func (s *Supervisor) dbQueryAudit(filter *AuditFilter) ([]AuditRecord, error) {
+	db, err := s.requireDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Where("host = ?", s.Host)
+	if filter.User != "" {
+		query = query.Where("user = ?", filter.User)
+	}
+	if filter.Program != "" {
+		query = query.Where("program = ?", filter.Program)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+
+	records := []AuditRecord{}
+	err = query.Order("created_at desc, id desc").Offset(filter.Offset).Limit(filter.Limit).Find(&records).Error
+	return records, err
+}
+
+// 解析时间参数: RFC3339, "2006-01-02 15:04:05" 或者 "2006-01-02"(本地时区)
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %s", value)
+}
+
+// 参数: user, program, action, since, until, limit, offset
+func parseAuditFilter(r *http.Request) (*AuditFilter, error) {
+	filter := &AuditFilter{
+		User:    r.FormValue("user"),
+		Program: r.FormValue("program"),
+		Action:  r.FormValue("action"),
+		Limit:   DefaultAuditLimit,
+	}
+
+	var err error
+	if filter.Since, err = parseAuditTime(r.FormValue("since")); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = parseAuditTime(r.FormValue("until")); err != nil {
+		return nil, err
+	}
+	if value := r.FormValue("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit: %s", value)
+		}
+		if filter.Limit > MaxAuditLimit {
+			filter.Limit = MaxAuditLimit
+		}
+	}
+	if value := r.FormValue("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return nil, fmt.Errorf("Invalid offset: %s", value)
+		}
+	}
+	return filter, nil
+}
+
+//
+// 查询操作记录, 最新的在前
+// 参数: user, program, action, since, until, limit(默认100, 最多1000), offset
+//
+func (s *Supervisor) hGetAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	records, err := s.dbQueryAudit(filter)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  records,
+	})
+}
+
+//
+// 操作记录页面
+//
+func (s *Supervisor) hAudit(w http.ResponseWriter, r *http.Request) {
+	s.renderHTML(w, r, "audit/audit.html", pongo2.Context{
+		"Host":    s.Host,
+		"Program": r.FormValue("program"),
+	})
+}
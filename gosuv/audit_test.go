@@ -0,0 +1,51 @@
+package gosuv
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestParseAuditFilter"
+func TestParseAuditFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/audit?user=alice&program=redis&since=2017-06-17&until=2017-06-18T08:00:00Z&limit=5000", nil)
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.User != "alice" || filter.Program != "redis" || filter.Limit != MaxAuditLimit {
+		t.Errorf("unexpected filter: %+v", filter)
+	}
+	if expected := time.Date(2017, 6, 17, 0, 0, 0, 0, time.Local); !filter.Since.Equal(expected) {
+		t.Errorf("expected since %v, got %v", expected, filter.Since)
+	}
+	if expected := time.Date(2017, 6, 18, 8, 0, 0, 0, time.UTC); !filter.Until.Equal(expected) {
+		t.Errorf("expected until %v, got %v", expected, filter.Until)
+	}
+
+	filter, err = parseAuditFilter(httptest.NewRequest("GET", "/api/audit", nil))
+	if err != nil || filter.Limit != DefaultAuditLimit || !filter.Since.IsZero() {
+		t.Errorf("unexpected default filter: %+v, %v", filter, err)
+	}
+
+	for _, query := range []string{"since=yesterday", "limit=0", "limit=abc", "offset=-1"} {
+		if _, err := parseAuditFilter(httptest.NewRequest("GET", "/api/audit?"+query, nil)); err == nil {
+			t.Errorf("%s: expected error", query)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestAuditJSON"
+func TestAuditJSON(t *testing.T) {
+	if params := auditParams("signal", "HUP"); params != `{"signal":"HUP"}` {
+		t.Errorf("unexpected params: %s", params)
+	}
+
+	// 修改前后的Program中不能有密码的明文
+	p := &Program{Name: "app", Environ: EnvironList{"DB_PASSWORD=123456", "DB_HOST=db1"}}
+	data := auditJSON(p)
+	if strings.Contains(data, "123456") || !strings.Contains(data, "DB_HOST=db1") {
+		t.Errorf("unexpected audit json: %s", data)
+	}
+}
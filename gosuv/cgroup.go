@@ -0,0 +1,226 @@
+package gosuv
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codeskyblue/kexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroup v2的根目录, 每个Program一个子目录, 每个Process再一个子目录:
+//   /sys/fs/cgroup/gosuv/<program>/<process>
+const DefaultCgroupRoot = "/sys/fs/cgroup/gosuv"
+
+// 可以通过配置文件中的 cgroup_root 修改
+var gCgroupRoot = DefaultCgroupRoot
+
+// cpu.max的周期(us)
+const cgroupCpuPeriod = 100000
+
+// 进程退出的原因
+const (
+	ExitReasonExit      = "exit"       // 进程自己退出
+	ExitReasonSignal    = "signal"     // 被信号杀死
+	ExitReasonOomKilled = "oom-killed" // 内存超过memory_max, 被cgroup的OOM killer杀死
+)
+
+//
+// 解析内存大小, 例如: 512M, 1G, 1048576; "max"表示不限制(返回-1)
+//
+func ParseMemorySize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ToLower(value) == "max" {
+		return -1, nil
+	}
+
+	number, unit := value, int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	case "T":
+		unit = 1 << 40
+	}
+	if unit > 1 {
+		number = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid memory size: %s", value)
+	}
+	return size * unit, nil
+}
+
+func (p *Program) checkResourceLimits() error {
+	if _, err := ParseMemorySize(p.MemoryMax); err != nil {
+		return err
+	}
+	if p.CpuQuota < 0 {
+		return fmt.Errorf("Invalid cpu quota: %d", p.CpuQuota)
+	}
+	if p.PidsMax < 0 {
+		return fmt.Errorf("Invalid pids max: %d", p.PidsMax)
+	}
+	return nil
+}
+
+// 是否配置了资源限制, 没有配置时不使用cgroup
+func (p *Program) HasResourceLimits() bool {
+	return len(p.cgroupLimits()) > 0
+}
+
+// 需要写入cgroup的配置: 文件名 --> 内容
+func (p *Program) cgroupLimits() map[string]string {
+	limits := map[string]string{}
+	if size, err := ParseMemorySize(p.MemoryMax); err == nil && size > 0 {
+		limits["memory.max"] = strconv.FormatInt(size, 10)
+	}
+	if p.CpuQuota > 0 {
+		// CpuQuota为单个CPU的百分比, 例如: 150表示1.5个CPU
+		limits["cpu.max"] = fmt.Sprintf("%d %d", p.CpuQuota*cgroupCpuPeriod/100, cgroupCpuPeriod)
+	}
+	if p.PidsMax > 0 {
+		limits["pids.max"] = strconv.Itoa(p.PidsMax)
+	}
+	return limits
+}
+
+// 需要启用的controllers, 例如: +memory +cpu
+func (p *Program) cgroupControllers() string {
+	var controllers []string
+	for name := range p.cgroupLimits() {
+		controllers = append(controllers, "+"+strings.Split(name, ".")[0])
+	}
+	return strings.Join(controllers, " ")
+}
+
+func (p *Program) cgroupDir() string {
+	return filepath.Join(gCgroupRoot, p.Name)
+}
+
+func (p *Process) cgroupDir() string {
+	return filepath.Join(p.Program.cgroupDir(), p.ProcessName)
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func writeCgroupLimits(dir string, limits map[string]string) error {
+	for name, value := range limits {
+		if err := writeCgroupFile(dir, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// 创建Process的cgroup, 并写入资源限制
+// 返回cgroup的目录, 没有配置资源限制时返回""
+//
+func (p *Process) setupCgroup() (string, error) {
+	limits := p.Program.cgroupLimits()
+	if len(limits) == 0 {
+		return "", nil
+	}
+	if !IsRoot() {
+		return "", fmt.Errorf("resource limits require root")
+	}
+
+	// cgroup v2: 只有父节点的cgroup.subtree_control中启用了controller, 子节点才能设置对应的限制
+	controllers := p.Program.cgroupControllers()
+	for _, dir := range []string{gCgroupRoot, p.Program.cgroupDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", controllers); err != nil {
+			return "", fmt.Errorf("enable cgroup controllers failed: %s, %v", dir, err)
+		}
+	}
+
+	dir := p.cgroupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := writeCgroupLimits(dir, limits); err != nil {
+		return "", fmt.Errorf("write cgroup limits failed: %s, %v", dir, err)
+	}
+	return dir, nil
+}
+
+//
+// 子进程在clone时直接创建在cgroup中(clone3 + CLONE_INTO_CGROUP, 需要Linux 5.7以上), 从第一条指令开始就受到限制
+// 子进程后续fork的进程会自动继承cgroup
+// 返回的文件需要在Start之后关闭
+//
+func useCgroupFD(cmd *kexec.KCommand, dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return f, nil
+}
+
+// 读取memory.events中的oom_kill计数
+func readOomKills(dir string) int {
+	f, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
+
+// 进程退出之后删除cgroup(如果还有残留的子进程, 删除会失败, 下次启动时继续使用)
+func (p *Process) releaseCgroup() {
+	if p.cgroupPath == "" {
+		return
+	}
+	os.Remove(p.cgroupPath)
+	p.cgroupPath = ""
+}
+
+// 修改Program之后, 更新运行中的进程的资源限制(去掉的限制恢复为max)
+func (p *ProgramEx) applyCgroupLimits() {
+	limits := map[string]string{"memory.max": "max", "cpu.max": "max", "pids.max": "max"}
+	for name, value := range p.cgroupLimits() {
+		limits[name] = value
+	}
+	for _, process := range p.allProcesses() {
+		if process != nil && process.cgroupPath != "" {
+			// 对应的controller可能没有启用, 忽略错误
+			for name, value := range limits {
+				writeCgroupFile(process.cgroupPath, name, value)
+			}
+		}
+	}
+}
+
+// 删除Program的cgroup
+func (p *Program) removeCgroup() {
+	os.Remove(p.cgroupDir())
+}
@@ -0,0 +1,122 @@
+package gosuv
+
+import (
+	"github.com/codeskyblue/kexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test gosuv -v -run "TestParseMemorySize"
+func TestParseMemorySize(t *testing.T) {
+	cases := map[string]int64{
+		"":        -1,
+		"max":     -1,
+		"1048576": 1048576,
+		"512M":    512 << 20,
+		"2g":      2 << 30,
+		"64k":     64 << 10,
+	}
+	for value, expected := range cases {
+		size, err := ParseMemorySize(value)
+		if err != nil || size != expected {
+			t.Errorf("%s: expected %d, got %d, %v", value, expected, size, err)
+		}
+	}
+
+	for _, value := range []string{"M", "-1G", "1.5G", "abc"} {
+		if _, err := ParseMemorySize(value); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestCgroupLimits"
+func TestCgroupLimits(t *testing.T) {
+	p := &Program{Name: "worker"}
+	if p.HasResourceLimits() {
+		t.Errorf("program without limits should not use cgroup")
+	}
+
+	p.MemoryMax = "1G"
+	p.CpuQuota = 150
+	p.PidsMax = 64
+	limits := p.cgroupLimits()
+	expected := map[string]string{
+		"memory.max": "1073741824",
+		"cpu.max":    "150000 100000",
+		"pids.max":   "64",
+	}
+	for name, value := range expected {
+		if limits[name] != value {
+			t.Errorf("%s: expected %s, got %s", name, value, limits[name])
+		}
+	}
+}
+
+// go test gosuv -v -run "TestSetupCgroup"
+func TestSetupCgroup(t *testing.T) {
+	if !IsRoot() {
+		t.Skip("resource limits require root")
+	}
+	root, err := ioutil.TempDir("", "gosuv_cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	oldRoot := gCgroupRoot
+	gCgroupRoot = root
+	defer func() { gCgroupRoot = oldRoot }()
+
+	pg := &ProgramEx{Program: &Program{Name: "worker", MemoryMax: "256M"}}
+	process := &Process{Program: pg, ProcessName: "worker_000"}
+	dir, err := process.setupCgroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(root, "worker", "worker_000") {
+		t.Errorf("unexpected cgroup dir: %s", dir)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(root, "worker", "cgroup.subtree_control"))
+	if string(data) != "+memory" {
+		t.Errorf("unexpected controllers: %s", data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "memory.max"))
+	if string(data) != "268435456" {
+		t.Errorf("unexpected memory.max: %s", data)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 2\n"), 0644)
+	if count := readOomKills(dir); count != 2 {
+		t.Errorf("expected 2 oom kills, got %d", count)
+	}
+}
+
+// go test gosuv -v -run "TestUseCgroupFD"
+func TestUseCgroupFD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := kexec.Command("true")
+	f, err := useCgroupFD(cmd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !cmd.SysProcAttr.UseCgroupFD || cmd.SysProcAttr.CgroupFD != int(f.Fd()) {
+		t.Errorf("expected child created in cgroup, got %+v", cmd.SysProcAttr)
+	}
+	// kexec的Setsid不能被覆盖
+	if !cmd.SysProcAttr.Setsid {
+		t.Errorf("expected setsid kept")
+	}
+
+	if _, err := useCgroupFD(kexec.Command("true"), filepath.Join(dir, "not_exists")); err == nil {
+		t.Errorf("expected error for missing cgroup")
+	}
+}
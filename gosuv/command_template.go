@@ -0,0 +1,90 @@
+package gosuv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+//
+// Command, Dir, Environ中可以使用的模板变量, 例如:
+//   php worker.php --id={{.Index}} --port={{.Port}}
+//
+type CommandVars struct {
+	Index       int    // 进程的序号, 从0开始
+	ProgramName string // Program的名字
+	ProcessName string // 进程的名字, 例如: worker_001
+	Host        string // 机器的hostname
+	Port        int    // BasePort + Index, 没有配置BasePort时为0
+}
+
+func (p *Process) commandVars() *CommandVars {
+	host, _ := os.Hostname()
+	vars := &CommandVars{
+		Index:       p.Index,
+		ProgramName: p.Program.Name,
+		ProcessName: p.ProcessName,
+		Host:        host,
+	}
+	if p.Program.BasePort > 0 {
+		vars.Port = p.Program.BasePort + p.Index
+	}
+	return vars
+}
+
+// 自动设置的环境变量
+func (v *CommandVars) Environ() []string {
+	environ := []string{
+		fmt.Sprintf("GOSUV_PROGRAM_NAME=%s", v.ProgramName),
+		fmt.Sprintf("GOSUV_PROCESS_NAME=%s", v.ProcessName),
+		fmt.Sprintf("GOSUV_PROCESS_INDEX=%d", v.Index),
+	}
+	if v.Port > 0 {
+		environ = append(environ, fmt.Sprintf("GOSUV_PORT=%d", v.Port))
+	}
+	return environ
+}
+
+func parseCommandTemplate(text string) (*template.Template, error) {
+	return template.New("command").Option("missingkey=error").Parse(text)
+}
+
+// 渲染模板; 不包含模板语法的字符串直接返回
+func RenderTemplate(text string, vars *CommandVars) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tpl, err := parseCommandTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+//
+// 兼容之前的行为: 没有使用模板变量的php命令自动添加 --id=<index>
+// 在命令中使用模板变量(例如: --id={{.Index}}), 或者设置了args之后不再添加
+//
+func (p *Program) legacyPhpId() bool {
+	return len(p.Args) == 0 && strings.Contains(p.Command, ".php") && !strings.Contains(p.Command, "{{")
+}
+
+// 验证Command, Args, Dir, Environ, EnvFiles, 健康检查的target中的模板语法
+func (p *Program) checkTemplates() error {
+	texts := []string{p.Command, p.Dir, p.HealthCheckTarget}
+	texts = append(texts, p.Args...)
+	texts = append(texts, p.Environ...)
+	texts = append(texts, p.EnvFiles...)
+	for _, text := range texts {
+		if _, err := RenderTemplate(text, &CommandVars{}); err != nil {
+			return fmt.Errorf("Invalid template: %s, %v", text, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package gosuv
+
+import (
+	"testing"
+)
+
+// go test gosuv -v -run "TestRenderTemplate"
+func TestRenderTemplate(t *testing.T) {
+	vars := &CommandVars{
+		Index:       2,
+		ProgramName: "worker",
+		ProcessName: "worker_002",
+		Port:        8082,
+	}
+
+	cases := map[string]string{
+		"php worker.php":                                  "php worker.php",
+		"php worker.php --id={{.Index}}":                  "php worker.php --id=2",
+		"./server -port {{.Port}} -name {{.ProcessName}}": "./server -port 8082 -name worker_002",
+	}
+	for text, expected := range cases {
+		result, err := RenderTemplate(text, vars)
+		if err != nil || result != expected {
+			t.Errorf("%s: expected %s, got %s, %v", text, expected, result, err)
+		}
+	}
+
+	if _, err := RenderTemplate("{{.NotExists}}", vars); err == nil {
+		t.Errorf("unknown variable should be rejected")
+	}
+
+	invalid := []*Program{
+		{Name: "test", Command: "ls {{.Index"},
+		{Name: "test", Command: "ls", Args: []string{"ls", "{{.NotExists}}"}},
+		{Name: "test", Command: "ls", EnvFiles: []string{"/etc/{{.Index"}},
+	}
+	for _, p := range invalid {
+		if p.Check() == nil {
+			t.Errorf("invalid template should be rejected: %v", p)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestLegacyPhpId"
+func TestLegacyPhpId(t *testing.T) {
+	cases := map[string]string{
+		"php worker.php":                         "php worker.php --id=2",
+		"php worker.php --id={{.Index}} --debug": "php worker.php --id=2 --debug",
+		"php worker.php --port={{.Port}}":        "php worker.php --port=0",
+		"./server -name {{.ProcessName}}":        "./server -name worker_002",
+		"ENV=prod php worker.php":                "php worker.php --id=2",
+	}
+	for command, expected := range cases {
+		program := &ProgramEx{Program: &Program{Name: "worker", Command: command}}
+		process := &Process{Program: program, Index: 2, ProcessName: "worker_002"}
+		cmd, _, err := process.newKCommand(process.commandVars())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := cmd.Args[len(cmd.Args)-1]; result != expected {
+			t.Errorf("%s: expected %s, got %s", command, expected, result)
+		}
+	}
+
+	// 设置了args之后不再添加
+	program := &ProgramEx{Program: &Program{Name: "worker", Args: []string{"php", "worker.php"}}}
+	process := &Process{Program: program, Index: 2}
+	cmd, _, err := process.newKCommand(process.commandVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd.Args) != 2 {
+		t.Errorf("expected no --id for args, got %v", cmd.Args)
+	}
+}
@@ -25,18 +25,43 @@ type Configuration struct {
 		ServerURL string `yaml:"server_url"`
 	} `yaml:"client"`
 	Db struct {
-		DbType string `yaml:"db_type"`
+		DbType string `yaml:"db_type"` // mysql, sqlite3
 		DbDsn  string `yaml:"db_dsn"`
 	} `yaml:"db"`
+	// Program的存储, 参考: store.go
+	Store struct {
+		Type string `yaml:"type"` // mysql, sqlite3, yaml; 默认: db.db_type, 没有配置数据库时为yaml
+		Path string `yaml:"path"` // yaml文件, 默认: 配置文件目录下的programs.yml
+
+		// 保存在数据库中时, 本地快照(数据库不可用时从快照启动), 默认: 配置文件目录下的programs.snapshot.yml
+		Snapshot string `yaml:"snapshot"`
+	} `yaml:"store"`
+	SecretKeyFile string   `yaml:"secret_key_file"` // 解密secret://sealed/的密钥, 64个字符的hex
+	SecretsDir    string   `yaml:"secrets_dir"`     // secret://file/只能读取这个目录下的文件, 例如: /etc/gosuv/secrets
+	SecretEnv     []string `yaml:"secret_env"`      // secret://env/只能读取这些gosuv的环境变量
+	CgroupRoot  string   `yaml:"cgroup_root"` // 资源限制使用的cgroup v2目录, 默认: /sys/fs/cgroup/gosuv
 	Host        string   `yaml:"host"`
 	DefaultUser string   `yaml:"default_user"`
 	Admins      []string `yaml:"admins"`
+
+	// 权限控制: ldap组 --> 角色(viewer, operator, admin), admins中的用户始终是admin
+	Rbac struct {
+		DefaultRole string            `yaml:"default_role"` // 没有匹配到任何组的用户的角色, 默认: operator
+		Groups      map[string]string `yaml:"groups"`
+	} `yaml:"rbac"`
+}
+
+// 操作记录, 运行历史, Token等保存在数据库中, 没有数据库时不可用
+func (c *Configuration) HasDatabase() bool {
+	return len(c.Db.DbType) > 0 && len(c.Db.DbDsn) > 0
 }
 
 func ReadConf(filename string) (c Configuration, err error) {
 	// 初始默认值
 	c.Server.Addr = ":11313"
 	c.Client.ServerURL = "http://localhost:11313"
+	c.CgroupRoot = DefaultCgroupRoot
+	c.Rbac.DefaultRole = RoleOperator
 
 	// 读取配置文件
 	data, err := ioutil.ReadFile(filename)
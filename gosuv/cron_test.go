@@ -0,0 +1,127 @@
+package gosuv
+
+import (
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestParseCron"
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/15 0-6 1,15 * MON-FRI", "5/10 * * JAN-MAR 7", "@daily", "@Hourly"} {
+		if _, err := ParseCron(expr); err != nil {
+			t.Errorf("%s: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "10-5 * * * *", "* * * FOO *", "@every"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestCronNext"
+func TestCronNext(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	cases := []struct {
+		expr     string
+		now      time.Time
+		expected time.Time
+	}{
+		{"*/15 * * * *", time.Date(2017, 6, 17, 10, 7, 30, 0, loc), time.Date(2017, 6, 17, 10, 15, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2017, 6, 17, 10, 15, 0, 0, loc), time.Date(2017, 6, 17, 10, 30, 0, 0, loc)},
+		{"@daily", time.Date(2017, 6, 17, 10, 7, 0, 0, loc), time.Date(2017, 6, 18, 0, 0, 0, 0, loc)},
+		{"0 3 * * MON-FRI", time.Date(2017, 6, 17, 10, 0, 0, 0, loc), time.Date(2017, 6, 19, 3, 0, 0, 0, loc)}, // 周六 --> 周一
+		{"0 0 1 * 7", time.Date(2017, 6, 17, 10, 0, 0, 0, loc), time.Date(2017, 6, 18, 0, 0, 0, 0, loc)},       // 日和周任意一个满足即可
+		{"0 0 29 2 *", time.Date(2017, 6, 17, 10, 0, 0, 0, loc), time.Date(2020, 2, 29, 0, 0, 0, 0, loc)},
+	}
+	for _, c := range cases {
+		schedule, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := schedule.Next(c.now); !next.Equal(c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.expr, c.expected, next)
+		}
+	}
+
+	schedule, _ := ParseCron("0 0 30 2 *")
+	if next := schedule.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected no next time, got %v", next)
+	}
+}
+
+// go test gosuv -v -run "TestNextScheduleTime"
+func TestNextScheduleTime(t *testing.T) {
+	p := &Program{Schedule: "0 9 * * *", ScheduleTimezone: "Asia/Shanghai"}
+	if err := p.checkSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	// UTC 2017-06-17 02:00 = 上海 10:00, 下一次是第二天上海 09:00 = UTC 01:00
+	next, err := p.NextScheduleTime(time.Date(2017, 6, 17, 2, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2017, 6, 18, 1, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, next)
+	}
+
+	for _, p := range []*Program{
+		{Schedule: "* * *"},
+		{Schedule: "* * * * *", ScheduleTimezone: "Mars/Olympus"},
+		{Schedule: "* * * * *", ScheduleJitter: -1},
+		{Schedule: "* * * * *", ConcurrencyPolicy: "parallel"},
+	} {
+		if err := p.checkSchedule(); err == nil {
+			t.Errorf("%+v: expected error", p)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestScheduledRuns"
+func TestScheduledRuns(t *testing.T) {
+	p := &ProgramEx{Program: &Program{Name: "job"}}
+	for i := 0; i < MaxScheduledRuns+5; i++ {
+		p.addRun(&ScheduledRun{ProcessName: "job", Status: RunSkipped, ExitCode: i})
+	}
+	p.addRun(&ScheduledRun{ProcessName: "job", StartedAt: time.Now(), Status: RunRunning})
+
+	p.finishRun(&Process{ProcessName: "job", ExitCode: 0})
+	runs := p.Runs()
+	if len(runs) != MaxScheduledRuns {
+		t.Fatalf("expected %d runs, got %d", MaxScheduledRuns, len(runs))
+	}
+	if runs[0].Status != RunSucceeded || runs[0].FinishedAt == nil {
+		t.Errorf("expected latest run succeeded, got %+v", runs[0])
+	}
+	if runs[1].ExitCode != MaxScheduledRuns+4 {
+		t.Errorf("expected runs newest first, got exit code %d", runs[1].ExitCode)
+	}
+}
+
+// go test gosuv -v -run "TestWaitProcessStopped"
+func TestWaitProcessStopped(t *testing.T) {
+	p := &ProgramEx{Program: &Program{Name: "job", ProcessNum: 1}}
+	process := p.newProcess(0, 0)
+
+	// 一直运行的进程: 超时
+	process.SetState(Running)
+	if waitProcessStopped(process, 300*time.Millisecond) {
+		t.Errorf("expected timeout for a running process")
+	}
+
+	// 等待重试的进程: 取消重试
+	process.SetState(RetryWait)
+	go func() {
+		<-process.stopC
+		process.stopCommand()
+	}()
+	if !waitProcessStopped(process, 5*time.Second) {
+		t.Fatalf("expected retry canceled, got %s", process.State())
+	}
+	if process.State() != Stopped {
+		t.Errorf("expected stopped, got %s", process.State())
+	}
+}
@@ -0,0 +1,99 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"strings"
+	"time"
+)
+
+// 数据库连接池
+const (
+	dbMaxOpenConns    = 10
+	dbMaxIdleConns    = 2
+	dbConnMaxLifetime = 10 * time.Minute // 避免使用被mysql(wait_timeout)关闭的连接
+)
+
+// 保存在数据库中的表, 启动时自动创建或者添加缺少的字段和索引
+var dbModels = []interface{}{
+	&Program{},
+	&ProcessRun{},
+	&AuditRecord{},
+	&ApiToken{},
+}
+
+//
+// 打开数据库并升级表结构; 返回的连接池在整个进程中共用, 不需要关闭
+// mysql需要先创建数据库: CREATE DATABASE gosuv_db character set utf8mb4;
+//
+func OpenDB(cfg *Configuration) (*gorm.DB, error) {
+	if err := checkDBDriver(cfg); err != nil {
+		return nil, err
+	}
+
+	dsn, err := dbDSN(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid db_dsn: %v", err)
+	}
+
+	// http://jinzhu.me/gorm/database.html#connecting-to-a-database
+	db, err := gorm.Open(cfg.Db.DbType, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect database: %v", err)
+	}
+	if cfg.Db.DbType == StoreSqlite {
+		// sqlite同时只能有一个写入者, 多个连接时容易出现: database is locked
+		db.DB().SetMaxOpenConns(1)
+	} else {
+		db.DB().SetMaxOpenConns(dbMaxOpenConns)
+		db.DB().SetMaxIdleConns(dbMaxIdleConns)
+		db.DB().SetConnMaxLifetime(dbConnMaxLifetime)
+	}
+
+	if err := migrateDB(db, cfg.Db.DbType); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to migrate database: %v", err)
+	}
+	return db, nil
+}
+
+// 配置错误, 不需要重试
+func checkDBDriver(cfg *Configuration) error {
+	if !cfg.HasDatabase() {
+		return errDatabaseNotConfigured
+	}
+	if !sqlDriverRegistered(cfg.Db.DbType) {
+		return fmt.Errorf("Database driver %s not compiled in, build with: go build -tags sqlite", cfg.Db.DbType)
+	}
+	return nil
+}
+
+// mysql: 时间字段(created_at, updated_at等)需要parseTime, 没有指定loc时使用本地时区
+func dbDSN(cfg *Configuration) (string, error) {
+	if cfg.Db.DbType != StoreMysql {
+		return cfg.Db.DbDsn, nil
+	}
+	mysqlCfg, err := mysql.ParseDSN(cfg.Db.DbDsn)
+	if err != nil {
+		return "", err
+	}
+	mysqlCfg.ParseTime = true
+	if !strings.Contains(cfg.Db.DbDsn, "loc=") {
+		mysqlCfg.Loc = time.Local
+	}
+	return mysqlCfg.FormatDSN(), nil
+}
+
+// 只会创建表, 添加字段和索引, 不会删除或者修改已有的字段
+func migrateDB(db *gorm.DB, dbType string) error {
+	if dbType == StoreMysql {
+		db = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	}
+	if err := db.AutoMigrate(dbModels...).Error; err != nil {
+		return err
+	}
+	log.Printf("Database migrated: %s", dbType)
+	return nil
+}
@@ -0,0 +1,125 @@
+package gosuv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 等待依赖的Program启动的最长时间
+const DependencyWaitTimeout = 60 * time.Second
+
+func (p *Program) checkDependsOn() error {
+	visited := map[string]bool{}
+	for _, name := range p.DependsOn {
+		if name == p.Name {
+			return fmt.Errorf("Program %s depends on itself", p.Name)
+		}
+		if visited[name] {
+			return fmt.Errorf("Duplicated dependency: %s", name)
+		}
+		visited[name] = true
+	}
+	return nil
+}
+
+//
+// 按照依赖关系和优先级对Programs排序: 被依赖的Program在前, 同一层级按照Priority(小的在前)和Name排序
+// 不存在的依赖直接忽略; 如果有循环依赖则返回错误
+//
+func SortProgramsByDependency(programs []*Program) ([]*Program, error) {
+	name2Program := make(map[string]*Program, len(programs))
+	for _, pg := range programs {
+		name2Program[pg.Name] = pg
+	}
+
+	// 每个Program还没有启动的依赖数
+	pending := make(map[string]int, len(programs))
+	for _, pg := range programs {
+		for _, dep := range pg.DependsOn {
+			if _, ok := name2Program[dep]; ok {
+				pending[pg.Name]++
+			}
+		}
+	}
+
+	sorted := make([]*Program, 0, len(programs))
+	done := make(map[string]bool, len(programs))
+	for len(sorted) < len(programs) {
+		// 选择一个依赖都已经满足, 并且优先级最高的Program
+		var next *Program
+		for _, pg := range programs {
+			if done[pg.Name] || pending[pg.Name] > 0 {
+				continue
+			}
+			if next == nil || pg.Priority < next.Priority ||
+				(pg.Priority == next.Priority && pg.Name < next.Name) {
+				next = pg
+			}
+		}
+
+		if next == nil {
+			// 剩下的Program都在循环依赖中
+			var names []string
+			for _, pg := range programs {
+				if !done[pg.Name] {
+					names = append(names, pg.Name)
+				}
+			}
+			return nil, fmt.Errorf("Dependency cycle detected: %s", strings.Join(names, ", "))
+		}
+
+		done[next.Name] = true
+		sorted = append(sorted, next)
+		for _, pg := range programs {
+			for _, dep := range pg.DependsOn {
+				if dep == next.Name {
+					pending[pg.Name]--
+				}
+			}
+		}
+	}
+	return sorted, nil
+}
+
+// 进程是否已经准备好: 运行中, 如果配置了健康检查则需要通过检查
+func (p *Process) IsReady() bool {
+	if p.State() != Running {
+		return false
+	}
+	return p.Program.HealthCheck == HealthCheckNone || p.Health == HealthHealthy
+}
+
+// 进程是否已经完全停止
+func (p *Process) IsStopped() bool {
+	return !p.IsRunning() && p.State() != Stopping
+}
+
+// 等待所有的进程满足条件, 超时返回false
+func (p *ProgramEx) waitProcesses(cond func(*Process) bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok := true
+		for _, process := range p.processList() {
+			if process != nil && !cond(process) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (p *ProgramEx) WaitReady(timeout time.Duration) bool {
+	return p.waitProcesses((*Process).IsReady, timeout)
+}
+
+func (p *ProgramEx) WaitStopped(timeout time.Duration) bool {
+	return p.waitProcesses((*Process).IsStopped, timeout)
+}
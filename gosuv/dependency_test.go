@@ -0,0 +1,37 @@
+package gosuv
+
+import (
+	"testing"
+)
+
+// go test gosuv -v -run "TestSortProgramsByDependency"
+func TestSortProgramsByDependency(t *testing.T) {
+	programs := []*Program{
+		{Name: "web", DependsOn: []string{"db", "cache"}},
+		{Name: "cache", Priority: 2},
+		{Name: "db", Priority: 1},
+		{Name: "cron", Priority: 3, DependsOn: []string{"not_exists"}},
+	}
+	sorted, err := SortProgramsByDependency(programs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"db", "cache", "web", "cron"}
+	for i, pg := range sorted {
+		if pg.Name != expected[i] {
+			t.Errorf("index %d: expected %s, got %s", i, expected[i], pg.Name)
+		}
+	}
+
+	// 循环依赖
+	programs[1].DependsOn = []string{"web"}
+	if _, err := SortProgramsByDependency(programs); err == nil {
+		t.Errorf("dependency cycle should be detected")
+	}
+
+	self := &Program{Name: "self", Command: "ls", DependsOn: []string{"self"}}
+	if self.Check() == nil {
+		t.Errorf("self dependency should be rejected")
+	}
+}
@@ -0,0 +1,314 @@
+package gosuv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// clean_env时, 没有配置pass_env的默认透传的环境变量
+var DefaultPassEnv = []string{"PATH", "LANG", "LC_ALL", "TZ"}
+
+// 看起来像密码的环境变量, 在API中需要隐藏
+var secretEnvPattern = regexp.MustCompile(`(?i)(PASS(WORD|WD|_|$)|SECRET|TOKEN|CREDENTIAL|PRIVATE|API_?KEY|ACCESS_?KEY|DSN)`)
+
+const maskedEnvValue = "******"
+
+// 环境变量的一个赋值
+type envEntry struct {
+	Key    string
+	Value  string
+	Expand bool // 是否需要展开变量, 单引号中的值不展开
+}
+
+//
+// 解析dotenv格式的文件:
+//   KEY=VALUE
+//   export KEY="VALUE with spaces\n"
+//   KEY='$NOT_EXPANDED'
+//   # 注释
+//
+func ParseEnvFile(data string) ([]envEntry, error) {
+	var entries []envEntry
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		entry, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func parseEnvLine(line string) (envEntry, error) {
+	line = strings.TrimPrefix(line, "export ")
+	if !envAssignPattern.MatchString(line) {
+		// 不包含行的内容, 错误会输出到日志中
+		return envEntry{}, errors.New("invalid assignment")
+	}
+	i := strings.IndexByte(line, '=')
+	entry := envEntry{Key: line[:i], Expand: true}
+	value := strings.TrimSpace(line[i+1:])
+
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return envEntry{}, ErrUnterminatedQuote
+		}
+		entry.Value = value[1 : end+1]
+		entry.Expand = false
+	case strings.HasPrefix(value, "\""):
+		var buf []byte
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+				switch value[i] {
+				case 'n':
+					buf = append(buf, '\n')
+				case 't':
+					buf = append(buf, '\t')
+				default:
+					buf = append(buf, value[i])
+				}
+				continue
+			}
+			buf = append(buf, value[i])
+		}
+		if i >= len(value) {
+			return envEntry{}, ErrUnterminatedQuote
+		}
+		entry.Value = string(buf)
+	default:
+		// 没有引号时, " #"之后是注释
+		if j := strings.Index(value, " #"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		entry.Value = value
+	}
+	return entry, nil
+}
+
+// 按照顺序构建环境变量, 同名的变量后面的覆盖前面的
+type envBuilder struct {
+	keys   []string
+	values map[string]string
+}
+
+func newEnvBuilder() *envBuilder {
+	return &envBuilder{values: map[string]string{}}
+}
+
+func (b *envBuilder) Set(key string, value string) {
+	if _, ok := b.values[key]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.values[key] = value
+}
+
+func (b *envBuilder) Get(key string) string {
+	return b.values[key]
+}
+
+// 添加 KEY=VALUE 格式的环境变量; expand: 是否使用前面已经定义的变量展开$VAR, ${VAR}
+func (b *envBuilder) Add(env string, expand bool) {
+	kv := strings.SplitN(env, "=", 2)
+	if len(kv) != 2 {
+		return
+	}
+	b.addEntry(envEntry{Key: kv[0], Value: kv[1], Expand: expand})
+}
+
+func (b *envBuilder) addEntry(entry envEntry) {
+	value := entry.Value
+	if entry.Expand {
+		value = expandEnv(value, b.Get)
+	}
+	b.Set(entry.Key, value)
+}
+
+func isEnvNameChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func isEnvName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// 展开$VAR, ${VAR}; 和os.Expand不同, 其他的$保持不变:
+//   $$: 表示$, 例如: PRICE=$$5
+//   $5, $-, 结尾的$: 不是变量, 保持不变
+//
+func expandEnv(value string, mapping func(string) string) string {
+	buf := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) {
+			buf = append(buf, value[i])
+			continue
+		}
+		switch c := value[i+1]; {
+		case c == '$':
+			buf = append(buf, '$')
+			i++
+		case c == '{':
+			end := strings.IndexByte(value[i+2:], '}')
+			if end < 0 || !isEnvName(value[i+2:i+2+end]) {
+				buf = append(buf, '$')
+				continue
+			}
+			buf = append(buf, mapping(value[i+2:i+2+end])...)
+			i += 2 + end
+		case isEnvNameChar(c, true):
+			j := i + 2
+			for j < len(value) && isEnvNameChar(value[j], false) {
+				j++
+			}
+			buf = append(buf, mapping(value[i+1:j])...)
+			i = j - 1
+		default:
+			buf = append(buf, '$')
+		}
+	}
+	return string(buf)
+}
+
+func (b *envBuilder) Environ() []string {
+	env := make([]string, 0, len(b.keys))
+	for _, key := range b.keys {
+		env = append(env, key+"="+b.values[key])
+	}
+	return env
+}
+
+// 读取env_files, "-"开头的文件不存在时忽略; 相对路径相对于工作目录
+// 设置了运行用户时, 只能读取运行用户可以读取的文件(例如: 不能通过错误信息读取/etc/shadow)
+func readEnvFile(path string, dir string, cred *syscall.Credential) ([]envEntry, error) {
+	optional := strings.HasPrefix(path, "-")
+	path = strings.TrimPrefix(path, "-")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := readFileAs(path, cred)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries, err := ParseEnvFile(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+//
+// 构建进程的环境变量, 按照以下顺序, 后面的覆盖前面的:
+//   1. gosuv自己的环境变量(clean_env时只透传pass_env中的变量)
+//   2. GOSUV_*变量, 切换用户之后的HOME, USER等
+//   3. 命令行开头的环境变量赋值
+//   4. env_files
+//   5. environ
+// 3-5中可以引用前面已经定义的变量, 例如: PATH=/opt/bin:$PATH
+//
+func (p *Process) buildEnviron(vars *CommandVars, cred *userCredential, tmpEnvs []string, dir string) ([]string, error) {
+	builder := newEnvBuilder()
+	if p.Program.CleanEnv {
+		passEnv := p.Program.PassEnv
+		if len(passEnv) == 0 {
+			passEnv = DefaultPassEnv
+		}
+		for _, key := range passEnv {
+			if value, ok := os.LookupEnv(key); ok {
+				builder.Set(key, value)
+			}
+		}
+	} else {
+		for _, env := range os.Environ() {
+			builder.Add(env, false)
+		}
+	}
+	for _, env := range vars.Environ() {
+		builder.Add(env, false)
+	}
+	var credential *syscall.Credential
+	if cred != nil {
+		credential = cred.Credential
+		for _, env := range cred.Env {
+			builder.Add(env, false)
+		}
+	}
+	for _, env := range tmpEnvs {
+		builder.Add(env, true)
+	}
+
+	for _, path := range p.Program.EnvFiles {
+		path, err := RenderTemplate(path, vars)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := readEnvFile(path, dir, credential)
+		if err != nil {
+			return nil, fmt.Errorf("read env file failed: %v", err)
+		}
+		for _, entry := range entries {
+			builder.addEntry(entry)
+		}
+	}
+
+	for _, env := range p.Program.Environ {
+		env, err := RenderTemplate(env, vars)
+		if err != nil {
+			return nil, err
+		}
+		builder.Add(env, true)
+	}
+	return builder.Environ(), nil
+}
+
+// 最近一次启动时实际使用的环境变量(隐藏密码), 没有启动过时返回nil
+func (p *Process) EffectiveEnviron() []string {
+	if p.environ == nil {
+		return nil
+	}
+	return MaskEnviron(p.environ)
+}
+
+// 是否是看起来像密码的环境变量
+func IsSecretEnvKey(key string) bool {
+	return secretEnvPattern.MatchString(key)
+}
+
+// 隐藏密码之类的环境变量的值
+func MaskEnviron(env []string) []string {
+	masked := make([]string, 0, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 && IsSecretEnvKey(kv[:i]) {
+			kv = kv[:i+1] + maskedEnvValue
+		}
+		masked = append(masked, kv)
+	}
+	return masked
+}
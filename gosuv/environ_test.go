@@ -0,0 +1,129 @@
+package gosuv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// go test gosuv -v -run "TestParseEnvFile"
+func TestParseEnvFile(t *testing.T) {
+	data := `
+# 注释
+export APP_ENV=prod
+APP_NAME="my app\n"
+APP_RAW='$HOME'
+APP_URL=http://localhost:8080 # 注释
+`
+	entries, err := ParseEnvFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []envEntry{
+		{Key: "APP_ENV", Value: "prod", Expand: true},
+		{Key: "APP_NAME", Value: "my app\n", Expand: true},
+		{Key: "APP_RAW", Value: "$HOME", Expand: false},
+		{Key: "APP_URL", Value: "http://localhost:8080", Expand: true},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+
+	for _, data := range []string{"APP_ENV", "1APP=prod", `APP="abc`} {
+		if _, err := ParseEnvFile(data); err == nil {
+			t.Errorf("%q should be rejected", data)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestBuildEnviron"
+func TestBuildEnviron(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.env"), []byte("APP_HOME=/opt/app\nAPP_BIN=$APP_HOME/bin\nAPP_RAW='$APP_HOME'\n"), 0644)
+
+	os.Setenv("GOSUV_TEST_DSN", "root:pass@tcp(localhost)/db")
+	defer os.Unsetenv("GOSUV_TEST_DSN")
+
+	p := &Process{
+		Program: &ProgramEx{Program: &Program{
+			Name:     "worker",
+			CleanEnv: true,
+			PassEnv:  []string{"GOSUV_TEST_DSN"},
+			EnvFiles: []string{"app.env", "-missing.env"},
+			Environ:  []string{"PATH=$APP_BIN:/usr/bin", "APP_ID={{.Index}}", "APP_PRICE=$$5 $5 ${APP_ID}$"},
+		}},
+		Index:       1,
+		ProcessName: "worker_001",
+	}
+	env, err := p.buildEnviron(p.commandVars(), &userCredential{Env: []string{"HOME=/home/worker"}}, []string{"APP_MODE=$HOME"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{}
+	for _, kv := range env {
+		builder := newEnvBuilder()
+		builder.Add(kv, false)
+		for k, v := range builder.values {
+			values[k] = v
+		}
+	}
+	expected := map[string]string{
+		"GOSUV_TEST_DSN":      "root:pass@tcp(localhost)/db",
+		"GOSUV_PROCESS_INDEX": "1",
+		"HOME":                "/home/worker",
+		"APP_MODE":            "/home/worker",
+		"APP_BIN":             "/opt/app/bin",
+		"APP_RAW":             "$APP_HOME",
+		"PATH":                "/opt/app/bin:/usr/bin",
+		"APP_ID":              "1",
+		"APP_PRICE":           "$5 $5 1$",
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("%s: expected %s, got %s", k, v, values[k])
+		}
+	}
+	if _, ok := values["GOPATH"]; ok {
+		t.Errorf("clean_env should not inherit GOPATH")
+	}
+
+	masked := MaskEnviron([]string{"GOSUV_TEST_DSN=abc", "DB_PASSWORD=abc", "DB_PASS=abc", "MYSQL_PASS=abc", "APP_ENV=prod", "PASSENGER_ID=1"})
+	if !reflect.DeepEqual(masked, []string{"GOSUV_TEST_DSN=******", "DB_PASSWORD=******", "DB_PASS=******", "MYSQL_PASS=******", "APP_ENV=prod", "PASSENGER_ID=1"}) {
+		t.Errorf("unexpected masked env: %v", masked)
+	}
+
+	p.Program.EnvFiles = []string{"missing.env"}
+	if _, err := p.buildEnviron(p.commandVars(), nil, nil, dir); err == nil {
+		t.Errorf("missing env file should be rejected")
+	}
+}
+
+// go test gosuv -v -run "TestExpandEnv"
+func TestExpandEnv(t *testing.T) {
+	mapping := func(key string) string {
+		return map[string]string{"HOME": "/home/worker", "APP_1": "app"}[key]
+	}
+	cases := map[string]string{
+		"$HOME/bin":        "/home/worker/bin",
+		"${HOME}_x":        "/home/worker_x",
+		"$APP_1:$MISSING.": "app:.",
+		"pa$$word":         "pa$word",
+		"$$HOME":           "$HOME",
+		"cost: $5":         "cost: $5",
+		"$-x, $, ${}, ${a": "$-x, $, ${}, ${a",
+		"${A-B}":           "${A-B}",
+		"end$":             "end$",
+	}
+	for value, expected := range cases {
+		if result := expandEnv(value, mapping); result != expected {
+			t.Errorf("%s: expected %s, got %s", value, expected, result)
+		}
+	}
+}
@@ -79,6 +79,8 @@ var (
 	Fatal = FSMState("fatal")
 	RetryWait = FSMState("retry wait")
 	Stopping = FSMState("stopping")
+	Exited = FSMState("exited") // 进程以预期的exit code退出(一次性任务)
+	Unhealthy = FSMState("unhealthy") // 健康检查连续失败, 等待重启
 
 	StartEvent = FSMEvent("start")
 	StopEvent = FSMEvent("stop")
@@ -0,0 +1,222 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/codeskyblue/kexec"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// 健康检查的类型
+const (
+	HealthCheckNone = ""
+	HealthCheckHttp = "http" // HTTP GET, 返回2xx/3xx表示健康
+	HealthCheckTcp  = "tcp"  // TCP connect成功表示健康
+	HealthCheckExec = "exec" // 命令exit code为0表示健康
+)
+
+// 健康状态
+const (
+	HealthUnknown   = ""
+	HealthStarting  = "starting" // 进程刚启动，还没有通过第一次检查
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// 健康检查的默认值
+const (
+	DefaultHealthCheckInterval  = 10
+	DefaultHealthCheckTimeout   = 3
+	DefaultHealthCheckThreshold = 3
+)
+
+func (p *Program) checkHealthCheck() error {
+	switch p.HealthCheck {
+	case HealthCheckNone:
+		return nil
+	case HealthCheckHttp, HealthCheckTcp, HealthCheckExec:
+	default:
+		return fmt.Errorf("Invalid health check type: %s", p.HealthCheck)
+	}
+	if p.HealthCheckTarget == "" {
+		return fmt.Errorf("Health check target empty")
+	}
+	if p.HealthCheckInterval < 0 || p.HealthCheckTimeout < 0 || p.HealthCheckThreshold < 0 {
+		return fmt.Errorf("Health check parameters should not be negative")
+	}
+	return nil
+}
+
+// 设置健康检查的默认参数
+func (p *Program) initHealthCheck() {
+	if p.HealthCheckInterval <= 0 {
+		p.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if p.HealthCheckTimeout <= 0 {
+		p.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+	if p.HealthCheckThreshold <= 0 {
+		p.HealthCheckThreshold = DefaultHealthCheckThreshold
+	}
+}
+
+// exec健康检查的运行环境, 和进程一样(参考: buildCommand), 不能以gosuv的用户(root)运行
+type execAttrs struct {
+	Dir        string
+	Env        []string // 包含密码引用, 运行之前才解析
+	Credential *syscall.Credential
+}
+
+// 执行一次健康检查, 返回nil表示健康
+// target和Command一样可以使用模板变量, 例如: http://127.0.0.1:{{.Port}}/health
+// attrs: 进程启动时的用户, 工作目录和环境变量, exec健康检查使用
+func (p *Program) RunHealthCheck(vars *CommandVars, attrs *execAttrs) error {
+	target, err := RenderTemplate(p.HealthCheckTarget, vars)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(p.HealthCheckTimeout) * time.Second
+	switch p.HealthCheck {
+	case HealthCheckHttp:
+		return checkHttp(target, timeout)
+	case HealthCheckTcp:
+		return checkTcp(target, timeout)
+	case HealthCheckExec:
+		cmd, err := execHealthCommand(target, attrs)
+		if err != nil {
+			return err
+		}
+		return checkExec(cmd, timeout)
+	}
+	return nil
+}
+
+func checkHttp(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("http status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func checkTcp(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func execHealthCommand(command string, attrs *execAttrs) (*kexec.KCommand, error) {
+	if attrs == nil {
+		return nil, fmt.Errorf("process not started")
+	}
+	env, err := ResolveSecrets(attrs.Env)
+	if err != nil {
+		return nil, err
+	}
+	cmd := kexec.CommandString(command)
+	cmd.Dir = attrs.Dir
+	cmd.Env = env
+	if attrs.Credential != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = attrs.Credential
+	}
+	return cmd, nil
+}
+
+func checkExec(cmd *kexec.KCommand, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	select {
+	case err := <-GoFunc(cmd.Wait):
+		return err
+	case <-time.After(timeout):
+		cmd.Terminate(syscall.SIGKILL)
+		cmd.Wait()
+		return fmt.Errorf("health check timeout: %v", timeout)
+	}
+}
+
+// 设置健康状态, 状态变化时通知client
+func (p *Process) setHealth(health string, message string) {
+	oldHealth := p.Health
+	p.Health = health
+	p.HealthMessage = message
+	if oldHealth != health {
+		gEventPub.PostEvent(fmt.Sprintf("Health change[%s] %s -> %s", p.ProcessName, oldHealth, health))
+	}
+}
+
+// 进程退出之后，结束健康检查
+func (p *Process) stopHealthCheck(done chan struct{}) {
+	close(done)
+	p.HealthFailures = 0
+	p.setHealth(HealthUnknown, "")
+}
+
+// 进程运行期间定期做健康检查，连续失败HealthCheckThreshold次之后，标记为Unhealthy并重启
+// done: 进程退出之后关闭
+func (p *Process) runHealthCheck(done chan struct{}) {
+	if p.Program.HealthCheck == HealthCheckNone {
+		return
+	}
+	p.HealthFailures = 0
+	p.setHealth(HealthStarting, "")
+
+	// 每个进程检查自己的target(例如: 不同的端口)
+	vars := p.commandVars()
+
+	// 等待进程启动完毕再开始检查
+	delay := time.Duration(p.Program.StartSeconds) * time.Second
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+		delay = time.Duration(p.Program.HealthCheckInterval) * time.Second
+
+		if p.State() != Running {
+			continue
+		}
+
+		err := p.Program.RunHealthCheck(vars, p.execAttrs)
+		select {
+		case <-done:
+			// 检查期间进程已经退出
+			return
+		default:
+		}
+		if err == nil {
+			p.HealthFailures = 0
+			p.setHealth(HealthHealthy, "")
+			continue
+		}
+
+		p.HealthFailures++
+		log.Printf("Health check failed: %s, failures: %d, %v", p.ProcessName, p.HealthFailures, err)
+		if p.HealthFailures < p.Program.HealthCheckThreshold {
+			continue
+		}
+
+		// 连续失败，重启进程
+		p.setHealth(HealthUnhealthy, err.Error())
+		p.Program.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Health check failed %d times: %s, %v, restarting\n",
+			p.HealthFailures, p.ProcessName, err))
+		p.SetState(Unhealthy)
+		p.OperateBy(RestartEvent, TriggerGosuv, "unhealthy: "+err.Error())
+		return
+	}
+}
@@ -0,0 +1,71 @@
+package gosuv
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestHealthCheck"
+func TestHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	timeout := time.Second
+	if err := checkHttp(server.URL+"/health", timeout); err != nil {
+		t.Errorf("http check should pass: %v", err)
+	}
+	if err := checkHttp(server.URL+"/other", timeout); err == nil {
+		t.Errorf("http check should fail on 503")
+	}
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	if err := checkTcp(addr, timeout); err != nil {
+		t.Errorf("tcp check should pass: %v", err)
+	}
+
+	attrs := &execAttrs{Dir: "/"}
+	checkExecCommand := func(command string, timeout time.Duration) error {
+		cmd, err := execHealthCommand(command, attrs)
+		if err != nil {
+			return err
+		}
+		return checkExec(cmd, timeout)
+	}
+	if err := checkExecCommand("exit 0", timeout); err != nil {
+		t.Errorf("exec check should pass: %v", err)
+	}
+	if err := checkExecCommand("exit 1", timeout); err == nil {
+		t.Errorf("exec check should fail")
+	}
+	if err := checkExecCommand("sleep 5", 100*time.Millisecond); err == nil {
+		t.Errorf("exec check should timeout")
+	}
+	if _, err := execHealthCommand("exit 0", nil); err == nil {
+		t.Errorf("exec check should fail before the process started")
+	}
+
+	// 每个进程使用自己的端口
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	p := &Program{
+		Name:               "web",
+		BasePort:           port - 1,
+		HealthCheck:        HealthCheckHttp,
+		HealthCheckTarget:  "http://127.0.0.1:{{.Port}}/health",
+		HealthCheckTimeout: 1,
+	}
+	program := &ProgramEx{Program: p}
+	if err := p.RunHealthCheck((&Process{Program: program, Index: 1}).commandVars(), nil); err != nil {
+		t.Errorf("health check of process 1 should pass: %v", err)
+	}
+	if err := p.RunHealthCheck((&Process{Program: program, Index: 0}).commandVars(), nil); err == nil {
+		t.Errorf("health check of process 0 should use another port")
+	}
+}
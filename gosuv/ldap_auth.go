@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"github.com/jtblin/go-ldap-client"
 	"github.com/wfxiang08/cyutils/utils/log"
+	ldapv2 "gopkg.in/ldap.v2"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 const LdapUserKey = "ldap_uid"
@@ -26,6 +29,16 @@ func (u *LdapUserInfo) UpdateHeaders(h http.Header) {
 	h.Set(LdapUserMail, u.Mail)
 	h.Set(LdapUserGroupsKey, u.Groups)
 }
+// 没有经过认证的请求, 不能伪造ldap用户或者Token
+func clearUserHeaders(h http.Header) {
+	h.Del(LdapUserKey)
+	h.Del(LdapUserMail)
+	h.Del(LdapUserGroupsKey)
+	h.Del(TokenNameKey)
+	h.Del(TokenScopeKey)
+	h.Del(TokenProgramsKey)
+}
+
 func (u *LdapUserInfo) String() string {
 	return fmt.Sprintf("%s:%s(%s)", u.UserId, u.Mail, u.Groups)
 }
@@ -33,6 +46,20 @@ func (u *LdapUserInfo) String() string {
 var auth2UserInfo map[string]*LdapUserInfo
 var rwLock sync.RWMutex
 
+// Token的创建者所在的ldap组的缓存时间
+const tokenGroupsTTL = 5 * time.Minute
+
+type cachedGroups struct {
+	groups    []string
+	expiresAt time.Time
+}
+
+var tokenGroupsCache = map[string]*cachedGroups{}
+var tokenGroupsMu sync.Mutex
+
+// 查询用户所在的ldap组, 测试时可以替换
+var lookupUserGroups = LookupUserGroups
+
 
 func init() {
 	auth2UserInfo = make(map[string]*LdapUserInfo)
@@ -53,25 +80,62 @@ func GetUserInfo(r *http.Request) *LdapUserInfo {
 type LdapAuth struct {
 	f        http.Handler
 	cfg      *Configuration
+	db       func() *gorm.DB // 查找ApiToken, 例如: Supervisor.DB(启动之后才连接上数据库)
 	checkUrl bool
 }
 
-func NewLdapAuth(f http.Handler, cfg *Configuration, checkUrl bool) *LdapAuth {
+func NewLdapAuth(f http.Handler, cfg *Configuration, db func() *gorm.DB, checkUrl bool) *LdapAuth {
 	return &LdapAuth{
 		f:        f,
 		cfg:      cfg,
+		db:       db,
 		checkUrl: checkUrl,
 	}
 }
+func (l *LdapAuth) tokenDB() *gorm.DB {
+	if l.db == nil {
+		return nil
+	}
+	return l.db()
+}
+
 func (l *LdapAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// 静态资源直接返回
-	if l.checkUrl {
-		if strings.HasPrefix(r.URL.Path, "/res") {
+	if l.checkUrl && strings.HasPrefix(r.URL.Path, "/res") {
+		l.f.ServeHTTP(w, r)
+		return
+	}
+
+	// 用户信息只能由认证之后写入
+	clearUserHeaders(r.Header)
+
+	// 自动化脚本使用Token: Authorization: Bearer gsv_xxxx
+	bearerPrefix := "Bearer "
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, bearerPrefix) {
+		apiToken, err := LookupApiToken(l.tokenDB(), l.cfg.Host, strings.TrimSpace(auth[len(bearerPrefix):]))
+		var groups []string
+		if err == nil {
+			groups, err = l.tokenOwnerGroups(apiToken.Owner)
+		}
+		if err == nil {
+			apiToken.UpdateHeaders(r.Header, groups)
 			l.f.ServeHTTP(w, r)
 			return
-		} else if strings.HasPrefix(r.URL.Path, "/ws/") {
-			// localhost 访问API, 直接放行
+		}
+		log.Warnf("Invalid api token from %s: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if l.checkUrl {
+		if strings.HasPrefix(r.URL.Path, "/ws/") {
+			// websocket不弹出认证框: 浏览器会带上之前的Authorization, 识别已经登录的用户
+			// 否则作为匿名用户, 只有localhost可以访问(参考: rbac.go)
+			if userInfo := GetUserInfo(r); userInfo != nil {
+				userInfo.UpdateHeaders(r.Header)
+			}
 			l.f.ServeHTTP(w, r)
 			return
 		} else if strings.HasPrefix(r.RequestURI, "/api/restart") {
@@ -86,7 +150,6 @@ func (l *LdapAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	basicAuthPrefix := "Basic "
 	// Parse request header
-	auth := r.Header.Get("Authorization")
 	rwLock.RLock()
 	userInfo, ok := auth2UserInfo[auth]
 	rwLock.RUnlock()
@@ -132,6 +195,70 @@ func (l *LdapAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
+//
+// Token的创建者当前所在的ldap组(不使用创建Token时的组), 创建者已经不在ldap中时返回错误
+// 结果缓存tokenGroupsTTL, 避免每个请求都查询ldap
+//
+func (l *LdapAuth) tokenOwnerGroups(owner string) ([]string, error) {
+	if !l.cfg.Server.Ldap.Enabled {
+		return nil, nil
+	}
+
+	tokenGroupsMu.Lock()
+	cached, ok := tokenGroupsCache[owner]
+	tokenGroupsMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.groups, nil
+	}
+
+	groups, err := lookupUserGroups(owner, l.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("lookup groups of token owner %s failed: %v", owner, err)
+	}
+	tokenGroupsMu.Lock()
+	tokenGroupsCache[owner] = &cachedGroups{groups: groups, expiresAt: time.Now().Add(tokenGroupsTTL)}
+	tokenGroupsMu.Unlock()
+	return groups, nil
+}
+
+// 使用bind_dn查询用户所在的ldap组, 用户不存在时返回错误
+func LookupUserGroups(username string, cfg *Configuration) ([]string, error) {
+	client := &ldap.LDAPClient{
+		Base:         cfg.Server.Ldap.Base,
+		Host:         cfg.Server.Ldap.Host,
+		Port:         cfg.Server.Ldap.Port,
+		UseSSL:       cfg.Server.Ldap.UseSSL,
+		BindDN:       cfg.Server.Ldap.BindDN,
+		BindPassword: cfg.Server.Ldap.BindPassword,
+		UserFilter:   cfg.Server.Ldap.UserFilter,
+		GroupFilter:  "(memberUid=%s)",
+	}
+	defer client.Close()
+
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	if client.BindDN != "" && client.BindPassword != "" {
+		if err := client.Conn.Bind(client.BindDN, client.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	sr, err := client.Conn.Search(ldapv2.NewSearchRequest(
+		client.Base,
+		ldapv2.ScopeWholeSubtree, ldapv2.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(client.UserFilter, ldapv2.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, fmt.Errorf("user %s does not exist", username)
+	}
+	return client.GetGroupsOfUser(username)
+}
+
 func VerifyUserNamePassword(username, password string, cfg *Configuration) (bool, map[string]string, []string) {
 	log.Printf("cfg.Server.Ldap: %+v", cfg.Server.Ldap)
 	client := &ldap.LDAPClient{
@@ -0,0 +1,204 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"path/filepath"
+	"time"
+)
+
+// 数据库不可用时的重试间隔
+const dbRetryInterval = 10 * time.Second
+
+//
+// 降级模式: 启动时数据库不可用, Program从本地快照加载, 不能修改
+// 数据库恢复之后以数据库为准重新加载, 退出降级模式
+//
+type offlineState struct {
+	Err   error
+	Since time.Time
+}
+
+// 数据库不可用时的store: 所有的修改都失败(Api返回500)
+type unavailableStore struct {
+	err error
+}
+
+func (s unavailableStore) List() ([]*Program, error)                 { return nil, s.err }
+func (s unavailableStore) Get(name string) (*Program, error)         { return nil, s.err }
+func (s unavailableStore) Insert(program *Program) error             { return s.err }
+func (s unavailableStore) Update(program *Program) error             { return s.err }
+func (s unavailableStore) Delete(program *Program) error             { return s.err }
+func (s unavailableStore) Watch(stop <-chan struct{}) <-chan struct{} { return nil }
+
+// 本地快照: Program保存在数据库中时才需要
+func (s *Supervisor) snapshotPath() string {
+	if len(s.cfg.Store.Snapshot) > 0 {
+		return s.cfg.Store.Snapshot
+	}
+	return filepath.Join(s.ConfigDir, "programs.snapshot.yml")
+}
+
+// 快照中包含环境变量(密码), 只有gosuv的运行用户可以读取
+func (s *Supervisor) initSnapshot() error {
+	storeType, err := programStoreType(s.cfg)
+	if err != nil {
+		return err
+	}
+	if storeType != StoreYaml {
+		s.snapshot = NewYamlStore(s.snapshotPath(), s.Host)
+	}
+	return nil
+}
+
+// 从store加载成功之后, 写入快照
+func (s *Supervisor) saveSnapshot(pgs []*Program) {
+	if s.snapshot == nil {
+		return
+	}
+	if err := s.snapshot.Replace(pgs); err != nil {
+		log.ErrorErrorf(err, "Write program snapshot failed: %s", s.snapshot.path)
+	}
+}
+
+// 修改store之后, 重新读取所有的Program写入快照
+func (s *Supervisor) refreshSnapshot() {
+	if s.snapshot == nil {
+		return
+	}
+	pgs, err := s.store.List()
+	if err != nil {
+		log.ErrorErrorf(err, "Refresh program snapshot failed")
+		return
+	}
+	s.saveSnapshot(pgs)
+}
+
+// 当前的数据库连接池, 没有配置数据库, 或者数据库不可用(降级模式)时为nil
+func (s *Supervisor) DB() *gorm.DB {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+	return s.db
+}
+
+// 需要数据库的功能(操作记录, Token等)
+func (s *Supervisor) requireDB() (*gorm.DB, error) {
+	if db := s.DB(); db != nil {
+		return db, nil
+	}
+	if !s.cfg.HasDatabase() {
+		return nil, errDatabaseNotConfigured
+	}
+	return nil, errDatabaseUnavailable
+}
+
+// 降级模式的状态, 正常时为nil
+func (s *Supervisor) offlineState() *offlineState {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+	return s.offline
+}
+
+// 连接数据库(如果还没有连接)
+func (s *Supervisor) connectDB() error {
+	if !s.cfg.HasDatabase() || s.DB() != nil {
+		return nil
+	}
+	db, err := OpenDB(s.cfg)
+	if err != nil {
+		return err
+	}
+	s.dbMu.Lock()
+	s.db = db
+	s.dbMu.Unlock()
+	return nil
+}
+
+//
+// 启动时加载Program, 需要WLock
+// 数据库不可用(连接失败, 或者读取programs表失败)时进入降级模式:
+// 1. Program保存在数据库中: 从本地快照加载, 不能修改
+// 2. Program保存在yaml文件中: 正常加载, 只是操作记录, 运行历史, Token不可用
+// 在后台重试, 数据库恢复之后退出降级模式
+//
+func (s *Supervisor) loadProgramsWithLock() error {
+	err := s.connectDB()
+	if err == nil {
+		if s.store, err = NewProgramStore(s.cfg, s.DB(), s.programPath()); err != nil {
+			return err
+		}
+		// 数据库正常, 或者Program保存在yaml文件中(yaml文件的错误不需要重试)
+		if err = s.LoadDBWithLock(); err == nil || s.snapshot == nil {
+			return err
+		}
+	}
+
+	log.ErrorErrorf(err, "Database unavailable, start in degraded mode")
+	s.dbMu.Lock()
+	s.offline = &offlineState{Err: err, Since: time.Now()}
+	s.dbMu.Unlock()
+	go s.reconnect()
+
+	if s.snapshot == nil {
+		if s.store, err = NewProgramStore(s.cfg, nil, s.programPath()); err != nil {
+			return err
+		}
+		return s.LoadDBWithLock()
+	}
+
+	s.store = unavailableStore{err: fmt.Errorf("%v, programs are read-only in degraded mode", errDatabaseUnavailable)}
+	pgs, err := s.snapshot.List()
+	if err != nil {
+		return fmt.Errorf("Read program snapshot %s failed: %v", s.snapshot.path, err)
+	}
+	for _, pg := range pgs {
+		if err := s.addOrUpdateProgram(pg, false); err != nil {
+			log.ErrorErrorf(err, "Load program from snapshot failed: %s", pg.Name)
+		}
+	}
+	log.Warnf("Loaded %d programs from snapshot: %s", len(pgs), s.snapshot.path)
+	return nil
+}
+
+// 在后台重试数据库, 恢复之后以数据库为准重新加载(添加, 更新, 删除快照中的Program)
+func (s *Supervisor) reconnect() {
+	for {
+		time.Sleep(dbRetryInterval)
+
+		s.namesMu.Lock()
+		err := s.reconnectWithLock()
+		s.namesMu.Unlock()
+		if err != nil {
+			log.Warnf("Database still unavailable: %v", err)
+			continue
+		}
+
+		s.dbMu.Lock()
+		s.offline = nil
+		s.dbMu.Unlock()
+		log.Printf("Database recovered, leave degraded mode")
+		gEventPub.PostEvent("Database recovered")
+		if s.snapshot != nil {
+			go s.watchStore()
+		}
+		return
+	}
+}
+
+func (s *Supervisor) reconnectWithLock() error {
+	if err := s.connectDB(); err != nil {
+		return err
+	}
+	if s.snapshot == nil {
+		return nil
+	}
+
+	oldStore := s.store
+	s.store = NewGormStore(s.DB(), s.Host)
+	if err := s.LoadDBWithLock(); err != nil {
+		s.store = oldStore
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package gosuv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSupervisor(cfg *Configuration, dir string) *Supervisor {
+	return &Supervisor{
+		ConfigDir:    dir,
+		name2Program: map[string]*ProgramEx{},
+		Host:         cfg.Host,
+		cfg:          cfg,
+		scheduler:    NewScheduler(),
+	}
+}
+
+// go test gosuv -v -run "TestSnapshot"
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreMysql
+	cfg.Db.DbDsn = "root@tcp(127.0.0.1:1)/gosuv_db"
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	if err := s.initSnapshot(); err != nil || s.snapshot == nil {
+		t.Fatalf("expected snapshot for mysql store, got %v", err)
+	}
+
+	// 从store加载之后写入快照
+	s.store = NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1, Environ: EnvironList{"PASSWORD=123456"}})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(s.snapshotPath())
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected snapshot with mode 0600, got %v, %v", info, err)
+	}
+	if programs, _ := s.snapshot.List(); len(programs) != 1 || programs[0].Environ[0] != "PASSWORD=123456" {
+		t.Errorf("unexpected snapshot: %v", programs)
+	}
+
+	// yaml文件不需要快照
+	if err := newTestSupervisor(&Configuration{}, dir).initSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test gosuv -v -run "TestDegradedMode"
+func TestDegradedMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// mysql不可用
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreMysql
+	cfg.Db.DbDsn = "root@tcp(127.0.0.1:1)/gosuv_db?timeout=1s"
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	if err := s.initSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.saveSnapshot([]*Program{{Name: "web", Command: "./web", ProcessNum: 1}})
+
+	s.namesMu.Lock()
+	err = s.loadProgramsWithLock()
+	s.namesMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.name2Program["web"]; !ok || s.offlineState() == nil {
+		t.Fatalf("expected degraded mode with programs from snapshot")
+	}
+
+	// 不能修改
+	if err := s.addOrUpdateProgram(&Program{Name: "redis", Command: "redis-server", ProcessNum: 1}, true); errorHTTPStatus(err) != http.StatusInternalServerError {
+		t.Errorf("expected store error in degraded mode, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.hStatus(w, httptest.NewRequest("GET", "/api/status", nil))
+	var status map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status["degraded"] != true {
+		t.Errorf("expected degraded status, got %s", w.Body.String())
+	}
+}
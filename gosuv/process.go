@@ -1,12 +1,13 @@
 package gosuv
 
 import (
+	"errors"
 	"fmt"
 	"github.com/codeskyblue/kexec"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/log"
 	"io"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,29 +21,50 @@ type Process struct {
 	ProcessName string                    `json:"process_name"`
 	Program     *ProgramEx                `json:"program"`
 	Index       int                       `json:"index"`
+	Generation  int                       `json:"generation"` // 平滑重启的次数
 	cmd         *kexec.KCommand                      // 运行的命令
 	Output      *QuickLossBroadcastWriter `json:"-"` // 输出？
 	stopC       chan syscall.Signal
 	retryLeft   int
+	retryDelay  time.Duration // 上一次重试的等待时间
+	startedAt   time.Time     // 最近一次启动的时间
+	replacing   atomic2.Bool  // 是否正在被平滑重启
+	queued      atomic2.Bool  // 定时任务是否有排队等待的运行
 	Status      string `json:"status"`
+	ExitCode    int    `json:"exit_code"`   // 最近一次退出的exit code, 被信号杀死时为-1
+	ExitSignal  string `json:"exit_signal"` // 最近一次退出时收到的信号
+	ExitReason  string `json:"exit_reason"` // 最近一次退出的原因: exit, signal, oom-killed
+
+	environ   []string   // 最近一次启动时的环境变量
+	execAttrs *execAttrs // 最近一次启动时的用户, 工作目录和环境变量, exec健康检查使用
+
+	// 运行记录
+	run          *ProcessRun // 当前的运行, 没有运行时为nil
+	startTrigger runTrigger  // 下一次启动的操作者
+	stopTrigger  runTrigger  // 下一次停止的操作者
+	journalMu    sync.Mutex
+
+	// 资源限制
+	cgroupPath string // 进程所在的cgroup, 没有资源限制时为""
+	oomKills   int    // 启动时cgroup中oom_kill的计数
+
+	// 健康检查
+	Health         string `json:"health"`
+	HealthFailures int    `json:"health_failures"` // 连续失败的次数
+	HealthMessage  string `json:"health_message"`  // 最近一次失败的原因
 	mu          sync.Mutex
 
 	stopWg      sync.WaitGroup
 }
 
 // Process --> KCommand(但是还没有运行起来)
-func (p *Process) buildCommand() *kexec.KCommand {
-	// 1. 运行命令行
-	commandStr := p.Program.Command
-
-	var tmpEnvs []string
-	commandStr, tmpEnvs = PreprocessCommand(commandStr)
-
-	// Hack: 只对php进程添加额外的id参数
-	if strings.Contains(commandStr, ".php") {
-		commandStr = fmt.Sprintf("%s --id=%d", commandStr, p.Index)
+func (p *Process) buildCommand() (*kexec.KCommand, error) {
+	// 1. 运行命令行, 支持模板变量, 例如: --id={{.Index}}
+	vars := p.commandVars()
+	cmd, tmpEnvs, err := p.newKCommand(vars)
+	if err != nil {
+		return nil, err
 	}
-	cmd := kexec.CommandString(commandStr)
 
 	// cmd将输出同时写到3个文件中
 	// 标准输出/err最终都输出到 Output中
@@ -56,50 +78,121 @@ func (p *Process) buildCommand() *kexec.KCommand {
 	cmd.Stdout = io.MultiWriter(p.Output, p.Program.Merger.NewWriter(p.Index))
 	cmd.Stderr = io.MultiWriter(p.Output, p.Program.Merger.NewWriter(p.Index))
 
-	// config environ
-	cmd.Env = os.Environ() // inherit current vars
 	environ := map[string]string{}
+	var userCred *userCredential
+	var credential *syscall.Credential
 	if p.Program.User != "" {
-		if !IsRoot() {
-			// 不是root时不能切换用户
-			log.Warnf("detect not root, can not switch user")
-		} else if err := cmd.SetUser(p.Program.User); err != nil {
-			log.Warnf("[%s] chusr to %s failed, %v", p.Program.Name, p.Program.User, err)
-		} else {
-			var homeDir string
-			switch runtime.GOOS {
-			case "linux":
-				homeDir = "/home/" + p.Program.User // FIXME(ssx): maybe there is a better way
-			case "darwin":
-				homeDir = "/Users/" + p.Program.User
-			}
-			cmd.Env = append(cmd.Env, "HOME=" + homeDir, "USER=" + p.Program.User)
-			environ["HOME"] = homeDir
-			environ["USER"] = p.Program.User
+		// 切换用户失败时不能以root运行, 直接返回错误(进程变为Fatal)
+		cred, err := lookupCredential(p.Program.User, p.Program.Group)
+		if err != nil {
+			return nil, fmt.Errorf("switch to user %s failed: %v", p.Program.User, err)
 		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = cred.Credential
+		credential = cred.Credential
+		userCred = cred
+		environ["HOME"] = cred.HomeDir
+		environ["USER"] = p.Program.User
 	}
 
-	// 来自程序参数的命令
-	if len(tmpEnvs) > 0 {
-		cmd.Env = append(cmd.Env, tmpEnvs...)
-	}
-
-	cmd.Env = append(cmd.Env, p.Program.Environ...)
+	// 切换用户之后使用运行用户的HOME, USER, 而不是gosuv自己的
 	mapping := func(key string) string {
-		val := os.Getenv(key)
-		if val != "" {
+		if val, ok := environ[key]; ok {
 			return val
 		}
-		return environ[key]
+		return os.Getenv(key)
 	}
 
 	// 根据环境变量
-	cmd.Dir = os.Expand(p.Program.Dir, mapping)
+	dir, err := RenderTemplate(p.Program.Dir, vars)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Dir = os.Expand(dir, mapping)
 	if strings.HasPrefix(cmd.Dir, "~") {
 		cmd.Dir = mapping("HOME") + cmd.Dir[1:]
 	}
+
+	// config environ: env_files中的相对路径相对于工作目录
+	env, err := p.buildEnviron(vars, userCred, tmpEnvs, cmd.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// 只记录密码引用, 在exec之前才解析出明文
+	p.environ = env
+	p.execAttrs = &execAttrs{Dir: cmd.Dir, Env: env, Credential: credential}
+	if cmd.Env, err = ResolveSecrets(env); err != nil {
+		return nil, err
+	}
+
 	log.Infof("Program: [%s], DIR: %s\n", p.Program.Name, cmd.Dir)
-	return cmd
+	return cmd, nil
+}
+
+//
+// 创建KCommand:
+//   shell模式: 通过 /bin/bash -c 运行Command(或者转义之后的Args)
+//   非shell模式: 直接exec Args(或者拆分之后的Command)
+// tmpEnvs: 命令行开头的环境变量赋值
+//
+func (p *Process) newKCommand(vars *CommandVars) (cmd *kexec.KCommand, tmpEnvs []string, err error) {
+	args := make([]string, 0, len(p.Program.Args))
+	for _, arg := range p.Program.Args {
+		arg, err = RenderTemplate(arg, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if p.Program.UseShell() {
+		commandStr := JoinCommand(args)
+		if len(args) == 0 {
+			if commandStr, err = RenderTemplate(p.Program.Command, vars); err != nil {
+				return nil, nil, err
+			}
+		}
+		commandStr, tmpEnvs = PreprocessCommand(commandStr)
+		if p.Program.legacyPhpId() {
+			commandStr = fmt.Sprintf("%s --id=%d", commandStr, p.Index)
+		}
+		return kexec.CommandString(commandStr), tmpEnvs, nil
+	}
+
+	if len(args) == 0 {
+		commandStr, err := RenderTemplate(p.Program.Command, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+		if args, err = SplitCommand(commandStr); err != nil {
+			return nil, nil, err
+		}
+		for len(args) > 0 && envAssignPattern.MatchString(args[0]) {
+			tmpEnvs = append(tmpEnvs, args[0])
+			args = args[1:]
+		}
+		if p.Program.legacyPhpId() {
+			args = append(args, fmt.Sprintf("--id=%d", p.Index))
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil, errors.New("Program command empty")
+	}
+	return kexec.Command(args[0], args[1:]...), tmpEnvs, nil
+}
+
+// 没有资源限制时cgroupPath为""
+func (p *Process) startInCgroup(cgroupPath string) error {
+	if cgroupPath != "" {
+		f, err := useCgroupFD(p.cmd, cgroupPath)
+		if err != nil {
+			return fmt.Errorf("open cgroup failed: %v", err)
+		}
+		defer f.Close()
+	}
+	return p.startWithLimits()
 }
 
 // 只运行在 startCommand内部的独立的go func中
@@ -122,10 +215,15 @@ func (p *Process) waitNextRetry() {
 	}
 
 	// 开始Command
-	// 等待2s, 如果没有stop, 则重新开始
+	// 按照指数退避等待, 如果没有stop, 则重新开始
 	p.retryLeft -= 1
+	p.retryDelay = p.Program.NextRestartDelay(p.retryDelay)
+	log.Printf("Program %s retry after %v, retry left: %d", p.ProcessName, p.retryDelay, p.retryLeft)
 	select {
-	case <-time.After(2 * time.Second):
+	case <-time.After(p.retryDelay):
+		p.journalMu.Lock()
+		p.startTrigger = runTrigger{User: TriggerAutoRetry, Reason: "retry after " + exitDescription(p.ExitCode, p.ExitSignal, p.ExitReason)}
+		p.journalMu.Unlock()
 		p.startCommand()
 	case <-p.stopC:
 
@@ -146,30 +244,41 @@ func (p *Process) stopCommand() {
 
 	// 准备停止
 	p.SetState(Stopping)
-	if p.cmd.Process != nil {
-		// 首先发送信号：SIGTERM
-		// kill -15 pid
-		io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: Kill by SIGTERM: %s\n", p.ProcessName))
-		p.cmd.Process.Signal(syscall.SIGTERM)
-	}
 
-	// 等待程序的正常退出：StopTimeout
-	// 或者直接通过 kill -9 pid 直接杀死
-	select {
-	case <-GoFunc(p.cmd.Wait):
-	// 等待正常返回
-		log.Printf("Program quit normally: %s", p.ProcessName)
-	case <-time.After(time.Duration(p.Program.StopTimeout) * time.Second):
-	// 只要没有正式"开杀", StopTimeout还是可以调整的
-	// 如果超过: StopTimeout, 则直接kill -9 杀死
+	// 按照StopSteps依次发送信号(默认: SIGTERM), 等待程序的正常退出
+	// 最后通过 kill -9 直接杀死整个进程组
 	// StopTimeout 这个很重要， 对于某些耗时操作，这个需要等待
-		log.Printf("Program terminate all: %s", p.ProcessName)
-		io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: Kill by SIGKILL: %s\n", p.ProcessName))
-		p.cmd.Terminate(syscall.SIGKILL) // cleanup
+	waitC := GoFunc(p.cmd.Wait)
+	for _, step := range p.Program.StopSteps() {
+		if step.Signal == syscall.SIGKILL {
+			log.Printf("Program terminate all: %s", p.ProcessName)
+			io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: Kill by SIGKILL: %s\n", p.ProcessName))
+			p.cmd.Terminate(syscall.SIGKILL) // cleanup
+			break
+		}
+
+		if p.cmd.Process != nil {
+			io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: Kill by %s: %s\n", step.Signal, p.ProcessName))
+			p.cmd.Process.Signal(step.Signal)
+		}
+
+		exited := false
+		select {
+		case <-waitC:
+			// 等待正常返回
+			log.Printf("Program quit normally: %s", p.ProcessName)
+			exited = true
+		case <-time.After(step.Wait):
+		}
+		if exited {
+			break
+		}
 	}
 
 	// 等待结束
 	err := p.cmd.Wait() // This is OK, because Signal KILL will definitely work
+	p.defaultStopTrigger()
+	p.recordExitStatus()
 
 	// Stopped状态必须在stopWg.Done()之前设置
 	p.SetState(Stopped)
@@ -186,24 +295,89 @@ func (p *Process) stopCommand() {
 	p.cmd = nil
 }
 
+// 记录进程的exit code和signal(cmd.Wait()返回之后调用)
+func (p *Process) recordExitStatus() {
+	p.ExitCode, p.ExitSignal, p.ExitReason = -1, "", ""
+	defer p.releaseCgroup()
+	defer p.Program.finishRun(p) // 定时任务的运行记录
+	defer p.endRun()
+	if p.cmd == nil || p.cmd.ProcessState == nil {
+		return
+	}
+	status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		p.ExitCode = p.cmd.ProcessState.ExitCode()
+		p.ExitReason = ExitReasonExit
+		return
+	}
+	if status.Signaled() {
+		p.ExitSignal = status.Signal().String()
+		p.ExitReason = ExitReasonSignal
+	} else {
+		p.ExitCode = status.ExitStatus()
+		p.ExitReason = ExitReasonExit
+	}
+
+	// cgroup中的oom_kill计数增加, 说明进程(或者它的子进程)因为内存超限被杀死
+	if p.cgroupPath != "" && readOomKills(p.cgroupPath) > p.oomKills {
+		p.ExitReason = ExitReasonOomKilled
+		io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: OOM killed: %s, memory_max: %s\n", p.ProcessName, p.Program.MemoryMax))
+		gEventPub.PostEvent(fmt.Sprintf("OOM killed[%s] memory_max: %s", p.ProcessName, p.Program.MemoryMax))
+	}
+}
+
 func (p *Process) IsRunning() bool {
-	return p.State() == Running || p.State() == RetryWait
+	state := p.State()
+	return state == Running || state == RetryWait || state == Unhealthy
 }
 
 func (p *Process) startCommand() {
 	log.Printf("START %s --> %s", p.ProcessName, p.Program.Command)
-	p.cmd = p.buildCommand()
+	cmd, err := p.buildCommand()
+	if err != nil {
+		// 命令有问题，重试也没用，直接Fatal
+		log.Warnf("Program %s build command failed: %v", p.ProcessName, err)
+		p.Program.Merger.WriteStrLine(fmt.Sprintf("GOSUV: build command failed: %s, %v\n", p.ProcessName, err))
+		p.cmd = nil
+		p.beginRun(0, err)
+		p.SetState(Fatal)
+		return
+	}
+
+	// 资源限制: 配置了资源限制, 但是无法创建cgroup时不能启动
+	cgroupPath, err := p.setupCgroup()
+	if err != nil {
+		log.Warnf("Program %s setup cgroup failed: %v", p.ProcessName, err)
+		p.Program.Merger.WriteStrLine(fmt.Sprintf("GOSUV: setup cgroup failed: %s, %v\n", p.ProcessName, err))
+		p.cmd = nil
+		p.beginRun(0, err)
+		p.SetState(Fatal)
+		return
+	}
+	p.oomKills = readOomKills(cgroupPath)
+
+	p.cmd = cmd
 	io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: startCommand: %s\n", p.ProcessName))
 
+	p.startedAt = time.Now()
 	p.SetState(Running)
 
-	// 启动程序（异步）
-	if err := p.cmd.Start(); err != nil {
-		// 如果启动报错，那就没有办法再尝试，直接Fatal
+	// 启动程序（异步）, 子进程直接创建在cgroup中, 并使用limits中配置的rlimit
+	p.cgroupPath = cgroupPath
+	if err := p.startInCgroup(cgroupPath); err != nil {
+		// 如果启动报错，那就没有办法再尝试，直接Fatal; 释放已经创建的cgroup
 		log.Warnf("Program %s start failed: %v", p.ProcessName, err)
+		io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: start failed: %s, %v\n", p.ProcessName, err))
+		p.releaseCgroup()
+		p.beginRun(0, err)
 		p.SetState(Fatal)
 		return
 	}
+	p.beginRun(p.cmd.Process.Pid, nil)
+
+	// 健康检查
+	healthDone := make(chan struct{})
+	go p.runHealthCheck(healthDone)
 
 	go func() {
 		ProcessWg.Add(1)
@@ -219,9 +393,27 @@ func (p *Process) startCommand() {
 		select {
 		case err := <-errC:
 		// 结束
+			p.stopHealthCheck(healthDone)
 			elapsed := time.Since(startTime)
 			log.Printf("Program finished: %s, time used %v", p.ProcessName, elapsed)
 
+			// 根据exit code和重启策略判断是否需要重启
+			p.recordExitStatus()
+			if !p.Program.ShouldRestart(p.ExitCode) {
+				io.WriteString(p.cmd.Stderr, fmt.Sprintf("GOSUV: Program exit: %s, exit code: %d, signal: %s, restart policy: %s\n",
+					p.ProcessName, p.ExitCode, p.ExitSignal, p.Program.RestartPolicy))
+				p.cmd = nil
+				if p.Program.IsExpectedExit(p.ExitCode) {
+					// 一次性任务正常结束
+					p.SetState(Exited)
+				} else {
+					p.SetState(Fatal)
+				}
+				ProcessWg.Done()
+				p.stopWg.Done()
+				return
+			}
+
 			if elapsed < time.Duration(p.Program.StartSeconds) * time.Second {
 				// 第一次很快就退出，则设置为Fatal
 				if p.retryLeft == p.Program.StartRetries {
@@ -231,9 +423,10 @@ func (p *Process) startCommand() {
 					log.Printf("Program exit too quick: %s, status -> fatal", p.ProcessName)
 					return
 				}
-			} else if elapsed >= 600 * time.Second {
-				// 如果程序跑了10分钟以上，则不减少retry的次数
-				p.retryLeft++
+			} else if elapsed >= time.Duration(p.Program.RestartResetSeconds) * time.Second {
+				// 如果程序稳定运行了一段时间，则重置retry的次数和等待时间(waitNextRetry会消耗一次)
+				p.retryLeft = p.Program.StartRetries + 1
+				p.retryDelay = 0
 			}
 
 		// 失败重试
@@ -243,6 +436,7 @@ func (p *Process) startCommand() {
 			p.waitNextRetry()
 		case <-p.stopC:
 			log.Printf("Recv stop command：%s", p.ProcessName)
+			p.stopHealthCheck(healthDone)
 			p.stopCommand()
 		}
 	}()
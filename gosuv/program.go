@@ -5,31 +5,91 @@ import (
 	"errors"
 	"fmt"
 	"github.com/kennygrant/sanitize"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/log"
 	"io"
 	"os"
 	"path"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type Program struct {
 	ID           uint     `yaml:"-" json:"-" gorm:"primary_key"`
-	Host         string   `yaml:"_" json:"host" gorm:"size:100" gorm:"index:host_name"`    // 名字
-	Name         string   `yaml:"name" json:"name" gorm:"size:100" gorm:"index:host_name"` // 名字
+	Host         string   `yaml:"-" json:"host" gorm:"size:100;unique_index:idx_host_name"`   // 名字
+	Name         string   `yaml:"name" json:"name" gorm:"size:100;unique_index:idx_host_name"` // 名字
 	Command      string   `yaml:"command" json:"command" gorm:"size:500"`                  // 命令
-	Environ      []string `yaml:"environ" json:"environ" sql:"-"`                          // 环境变量
+	Args         []string `yaml:"args,omitempty" json:"args" sql:"-"`                     // 命令参数列表(Command的替代)
+	ArgsDb       string   `yaml:"-" json:"-" gorm:"size:2000"`
+	Shell        *bool    `yaml:"shell,omitempty" json:"shell"`                           // 是否通过shell运行, 默认: 没有Args时通过shell运行
+	Environ      EnvironList `yaml:"environ" json:"environ" sql:"-"`                       // 环境变量, 密码使用secret://引用
 	EnvironDb    string   `yaml:"-" json:"-" gorm:"size:2000"`                             // 环境变量
+	ExitCodes    []int    `yaml:"exit_codes,omitempty" json:"exit_codes" sql:"-"`         // 预期的exit code
+	ExitCodesDb  string   `yaml:"-" json:"-" gorm:"size:100"`
+	EnvFiles     []string `yaml:"env_files,omitempty" json:"env_files" sql:"-"` // dotenv格式的文件, 启动时读取
+	EnvFilesDb   string   `yaml:"-" json:"-" gorm:"size:1000"`
+	CleanEnv     bool     `yaml:"clean_env,omitempty" json:"clean_env"`            // 不继承gosuv的环境变量
+	PassEnv      []string `yaml:"pass_env,omitempty" json:"pass_env" sql:"-"`      // clean_env时透传的环境变量, 默认: PATH, LANG, LC_ALL, TZ
+	PassEnvDb    string   `yaml:"-" json:"-" gorm:"size:500"`
+	Limits       map[string]string `yaml:"limits,omitempty" json:"limits" sql:"-"` // rlimit, 例如: nofile: 65535, core: unlimited
+	LimitsDb     string            `yaml:"-" json:"-" gorm:"size:500"`
 	Dir          string   `yaml:"directory" json:"directory" gorm:"size:255"`              // 当前工作目录
 	StartAuto    bool     `yaml:"start_auto" json:"start_auto"`                            // 是否自动重启
 	StartRetries int      `yaml:"start_retries" json:"start_retries"`
 	StartSeconds int      `yaml:"start_seconds,omitempty" json:"start_seconds"`
 	StopTimeout  int      `yaml:"stop_timeout,omitempty" json:"stop_timeout"`
+	StopSignal   string   `yaml:"stop_signal,omitempty" json:"stop_signal" gorm:"size:10"`       // 停止时发送的信号, 默认: TERM
+	StopSequence string   `yaml:"stop_sequence,omitempty" json:"stop_sequence" gorm:"size:200"` // 停止序列, 例如: INT:10,TERM:10,KILL
 	User         string   `yaml:"user,omitempty" json:"user" gorm:"size:40"` // 运行用户
+	Group        string   `yaml:"group,omitempty" json:"group" gorm:"size:40"` // 运行用户组, 默认: 用户的主组
+	Umask        string   `yaml:"umask,omitempty" json:"umask" gorm:"size:4"`  // 例如: 022, 默认: 继承gosuv
 	ProcessNum   int      `yaml:"process_num,omitempty" json:"process_num"`  // 同时运行进程数
+	BasePort     int      `yaml:"base_port,omitempty" json:"base_port"`      // 模板变量{{.Port}} = BasePort + Index
+
+	// 资源限制(cgroup v2), 对每个进程生效
+	MemoryMax string `yaml:"memory_max,omitempty" json:"memory_max" gorm:"size:20"` // 最大内存, 例如: 512M, 2G
+	CpuQuota  int    `yaml:"cpu_quota,omitempty" json:"cpu_quota"`                  // 单个CPU的百分比, 例如: 150表示1.5个CPU
+	PidsMax   int    `yaml:"pids_max,omitempty" json:"pids_max"`                    // 最大进程(线程)数
+
+	// 启动顺序: 先启动依赖的Program, 同一层级按照Priority从小到大启动
+	DependsOn   []string `yaml:"depends_on,omitempty" json:"depends_on" sql:"-"`
+	DependsOnDb string   `yaml:"-" json:"-" gorm:"size:500"`
+	Priority    int      `yaml:"priority,omitempty" json:"priority"`
+
+	// 定时任务: cron表达式, 例如: */5 * * * *, @daily
+	Schedule          string `yaml:"schedule,omitempty" json:"schedule" gorm:"size:100"`
+	ScheduleTimezone  string `yaml:"schedule_timezone,omitempty" json:"schedule_timezone" gorm:"size:50"`   // 例如: Asia/Shanghai, 默认: 本地时区
+	ScheduleJitter    int    `yaml:"schedule_jitter,omitempty" json:"schedule_jitter"`                      // 随机延迟0-N秒启动
+	ConcurrencyPolicy string `yaml:"concurrency_policy,omitempty" json:"concurrency_policy" gorm:"size:20"` // skip, queue, replace
+
+	// 重启策略: always, on-failure, never
+	RestartPolicy       string  `yaml:"restart_policy,omitempty" json:"restart_policy" gorm:"size:20"`
+	RestartMode         string  `yaml:"restart_mode,omitempty" json:"restart_mode" gorm:"size:20"`       // stop-first, start-first
+	RestartDelay        int     `yaml:"restart_delay,omitempty" json:"restart_delay"`                 // 第一次重试的等待时间(s)
+	RestartMaxDelay     int     `yaml:"restart_max_delay,omitempty" json:"restart_max_delay"`         // 最长等待时间(s)
+	RestartBackoff      float64 `yaml:"restart_backoff,omitempty" json:"restart_backoff"`             // 等待时间的增长倍数
+	RestartResetSeconds int     `yaml:"restart_reset_seconds,omitempty" json:"restart_reset_seconds"` // 运行超过该时间，则重置重试次数和等待时间
+
+	// 健康检查: http, tcp, exec
+	HealthCheck          string `yaml:"health_check,omitempty" json:"health_check" gorm:"size:20"`
+	HealthCheckTarget    string `yaml:"health_check_target,omitempty" json:"health_check_target" gorm:"size:500"` // url, host:port 或者命令
+	HealthCheckInterval  int    `yaml:"health_check_interval,omitempty" json:"health_check_interval"`             // 检查间隔(s)
+	HealthCheckTimeout   int    `yaml:"health_check_timeout,omitempty" json:"health_check_timeout"`               // 单次检查的超时时间(s)
+	HealthCheckThreshold int    `yaml:"health_check_threshold,omitempty" json:"health_check_threshold"`           // 连续失败多少次之后重启
 
 	// 脚本作者
 	Author string `yaml:"author,omitempty" json:"author" gorm:"size:40"`
+
+	// 其他负责人: ldap用户和ldap组, 和作者一样可以操作Program
+	Owners        []string `yaml:"owners,omitempty" json:"owners" sql:"-"`
+	OwnersDb      string   `yaml:"-" json:"-" gorm:"size:500"`
+	OwnerGroups   []string `yaml:"owner_groups,omitempty" json:"owner_groups" sql:"-"`
+	OwnerGroupsDb string   `yaml:"-" json:"-" gorm:"size:500"`
+
+	// 数据库中每次保存时加1, 其他gosuv或者工具修改programs表之后, 根据version和updated_at发现修改
+	Version   int       `yaml:"-" json:"version"`
+	UpdatedAt time.Time `yaml:"-" json:"updated_at"`
 }
 
 // 如何控制并发数呢?
@@ -39,10 +99,19 @@ type ProgramEx struct {
 	*Program
 	Status     FSMState                  `yaml:"-" json:"status"`
 	RunningNum int                       `yaml:"-" json:"running_num"`
-	Processes  []*Process                `yaml:"-" json:"-"`
+	Health     string                    `yaml:"-" json:"health"`
+	Processes  []*Process                `yaml:"-" json:"-"` // 读写都需要mu, 参考: processList
 	Output     *QuickLossBroadcastWriter `yaml:"-" json:"-"`
 	OutputFile io.Writer                 `yaml:"-" json:"-"` // 输出文件
 	Merger     *MergeWriter              `yaml:"-" json:"-"`
+	rolling    atomic2.Bool              // 是否正在滚动重启
+	mu         sync.Mutex                // 保护Processes和standby
+	standby    []*Process                // 平滑重启时的新进程, 接替旧进程之前不在Processes中
+	runs       []*ScheduledRun           // 定时任务最近的运行记录
+	runsMu     sync.Mutex
+	history    map[int][]*ProcessRun     // 每个进程(index)最近的运行记录
+	historyMu  sync.Mutex
+	revision   string // store中保存的版本, 参考: syncWithLock
 }
 
 func (p *Program) String() string {
@@ -55,14 +124,97 @@ func (p *Program) Decode() {
 	} else {
 		p.Environ = environ
 	}
+
+	var exitCodes []int
+	if err := json.Unmarshal([]byte(p.ExitCodesDb), &exitCodes); err != nil {
+		p.ExitCodes = nil
+	} else {
+		p.ExitCodes = exitCodes
+	}
+
+	var envFiles []string
+	if err := json.Unmarshal([]byte(p.EnvFilesDb), &envFiles); err != nil {
+		p.EnvFiles = nil
+	} else {
+		p.EnvFiles = envFiles
+	}
+
+	var passEnv []string
+	if err := json.Unmarshal([]byte(p.PassEnvDb), &passEnv); err != nil {
+		p.PassEnv = nil
+	} else {
+		p.PassEnv = passEnv
+	}
+
+	var limits map[string]string
+	if err := json.Unmarshal([]byte(p.LimitsDb), &limits); err != nil {
+		p.Limits = nil
+	} else {
+		p.Limits = limits
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(p.ArgsDb), &args); err != nil {
+		p.Args = nil
+	} else {
+		p.Args = args
+	}
+
+	var dependsOn []string
+	if err := json.Unmarshal([]byte(p.DependsOnDb), &dependsOn); err != nil {
+		p.DependsOn = nil
+	} else {
+		p.DependsOn = dependsOn
+	}
+
+	var owners []string
+	if err := json.Unmarshal([]byte(p.OwnersDb), &owners); err != nil {
+		p.Owners = nil
+	} else {
+		p.Owners = owners
+	}
+
+	var ownerGroups []string
+	if err := json.Unmarshal([]byte(p.OwnerGroupsDb), &ownerGroups); err != nil {
+		p.OwnerGroups = nil
+	} else {
+		p.OwnerGroups = ownerGroups
+	}
 }
 func (p *Program) Encode() {
-	environDb, _ := json.Marshal(p.Environ)
+	// 数据库中保存原始值, 不能使用EnvironList.MarshalJSON
+	environDb, _ := json.Marshal([]string(p.Environ))
 	p.EnvironDb = string(environDb)
+
+	exitCodesDb, _ := json.Marshal(p.ExitCodes)
+	p.ExitCodesDb = string(exitCodesDb)
+
+	envFilesDb, _ := json.Marshal(p.EnvFiles)
+	p.EnvFilesDb = string(envFilesDb)
+
+	passEnvDb, _ := json.Marshal(p.PassEnv)
+	p.PassEnvDb = string(passEnvDb)
+
+	limitsDb, _ := json.Marshal(p.Limits)
+	p.LimitsDb = string(limitsDb)
+
+	argsDb, _ := json.Marshal(p.Args)
+	p.ArgsDb = string(argsDb)
+
+	dependsOnDb, _ := json.Marshal(p.DependsOn)
+	p.DependsOnDb = string(dependsOnDb)
+
+	ownersDb, _ := json.Marshal(p.Owners)
+	p.OwnersDb = string(ownersDb)
+
+	ownerGroupsDb, _ := json.Marshal(p.OwnerGroups)
+	p.OwnerGroupsDb = string(ownerGroupsDb)
 }
 
-func (p *ProgramEx) InitProgram(logDir string) {
+// autoStart: 是否直接启动StartAuto的进程; 初次加载时由AutoStartPrograms按照依赖顺序启动
+func (p *ProgramEx) InitProgram(logDir string, autoStart bool) {
 	log.Printf("InitProgram: %s, log: %s", p.Program.String(), logDir)
+	p.initShell()
 
 	// 1. 创建日志输出
 	if len(logDir) > 0 {
@@ -90,41 +242,88 @@ func (p *ProgramEx) InitProgram(logDir string) {
 	}
 
 	// 3. 创建多个进程
-	p.Processes = nil
-	p.Processes = make([]*Process, 0, p.ProcessNum)
+	processes := make([]*Process, 0, p.ProcessNum)
 	for i := 0; i < p.ProcessNum; i++ {
-		p.Processes = append(p.Processes, p.NewProcess(i))
+		processes = append(processes, p.NewProcess(i))
 		log.Printf("New Process at index: %d", i)
-
-		// 如果是自动启动，则启动
-		if p.StartAuto {
-			p.Processes[i].Operate(StartEvent)
+	}
+	p.mu.Lock()
+	p.Processes = processes
+	p.mu.Unlock()
+
+	// 如果是自动启动，则启动; 定时任务由Scheduler启动
+	if autoStart && p.StartAuto && !p.IsScheduled() {
+		for _, process := range processes {
+			process.OperateBy(StartEvent, TriggerGosuv, "autostart")
 		}
 	}
 }
 
 func (p *ProgramEx) UpdateState() {
 	runningNum := 0
-	for i := 0; i < len(p.Processes); i++ {
-		if p.Processes[i] == nil {
+	exitedNum := 0
+	health := HealthUnknown
+	processes := p.processList()
+	for i := 0; i < len(processes); i++ {
+		if processes[i] == nil {
 			log.Printf("Process is nil at: %d", i)
 			continue
 		}
-		if p.Processes[i] != nil && p.Processes[i].state == Running {
+		// 任何一个进程不健康，则Program不健康
+		switch processes[i].Health {
+		case HealthUnhealthy:
+			health = HealthUnhealthy
+		case HealthStarting:
+			if health != HealthUnhealthy {
+				health = HealthStarting
+			}
+		case HealthHealthy:
+			if health == HealthUnknown {
+				health = HealthHealthy
+			}
+		}
+		if processes[i].state == Running {
 			runningNum++
 		}
+		if processes[i].state == Exited {
+			exitedNum++
+		}
 	}
 	p.RunningNum = runningNum
+	p.Health = health
 	if runningNum > 0 {
 		p.Status = Running
+	} else if exitedNum > 0 && exitedNum == len(processes) {
+		// 所有的进程都正常退出了
+		p.Status = Exited
 	} else {
 		p.Status = Stopped
 	}
 }
 
-func (p *ProgramEx) IndexName(index int) string {
+func (p *ProgramEx) IndexName(index int, generation int) string {
 	// 最多支持999个并发进程
-	return fmt.Sprintf("%s_%03d", p.Name, index)
+	if generation == 0 {
+		return fmt.Sprintf("%s_%03d", p.Name, index)
+	}
+	// 平滑重启时，新旧进程同时存在，通过generation区分
+	return fmt.Sprintf("%s_%03d.%d", p.Name, index, generation)
+}
+
+// 是否通过shell运行
+func (p *Program) UseShell() bool {
+	if p.Shell != nil {
+		return *p.Shell
+	}
+	return len(p.Args) == 0
+}
+
+// 将默认值固定下来，方便在页面上展示和修改
+func (p *Program) initShell() {
+	if p.Shell == nil {
+		shell := p.UseShell()
+		p.Shell = &shell
+	}
 }
 
 //
@@ -134,33 +333,123 @@ func (p *Program) Check() error {
 	if p.Name == "" {
 		return errors.New("Program name empty")
 	}
-	if p.Command == "" {
+	if p.Command == "" && len(p.Args) == 0 {
 		return errors.New("Program command empty")
 	}
+	if !p.UseShell() && len(p.Args) == 0 {
+		// 直接exec时, 必须能正确拆分命令行
+		if _, err := SplitCommand(p.Command); err != nil {
+			return fmt.Errorf("Invalid command: %v", err)
+		}
+	}
+	if err := p.checkTemplates(); err != nil {
+		return err
+	}
+	if err := p.checkRestartPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkHealthCheck(); err != nil {
+		return err
+	}
+	if err := p.checkDependsOn(); err != nil {
+		return err
+	}
+	if err := p.checkResourceLimits(); err != nil {
+		return err
+	}
+	if err := p.checkLimits(); err != nil {
+		return err
+	}
+	if err := p.checkUser(); err != nil {
+		return err
+	}
+	if err := p.checkSecrets(); err != nil {
+		return err
+	}
+	if err := p.checkSchedule(); err != nil {
+		return err
+	}
+	if err := p.checkStopSignal(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (p *ProgramEx) UpdateProgram(newProgram *Program) bool {
-	// 除了进程数，其他参数暂不作为明显的区分标志
+// 修改之后保存在store中的Program, 不修改内存中的Program
+func (p *ProgramEx) mergedProgram(newProgram *Program) *Program {
+	program := *p.Program
+	program.mergeProgram(newProgram)
+	program.ProcessNum = newProgram.ProcessNum
+	return &program
+}
+
+// 除了进程数之外的参数
+func (p *Program) mergeProgram(newProgram *Program) {
 	p.Command = newProgram.Command
-	p.Environ = newProgram.Environ
+	p.Args = newProgram.Args
+	p.Shell = newProgram.Shell
+	p.initShell()
+	p.Environ = mergeMaskedEnviron(p.Environ, newProgram.Environ)
+	p.EnvFiles = newProgram.EnvFiles
+	p.CleanEnv = newProgram.CleanEnv
+	p.PassEnv = newProgram.PassEnv
 	p.Dir = newProgram.Dir
+	p.BasePort = newProgram.BasePort
 
 	p.StartAuto = newProgram.StartAuto
 	p.StartRetries = newProgram.StartRetries
 	p.StartSeconds = newProgram.StartSeconds
 
+	p.ExitCodes = newProgram.ExitCodes
+	p.DependsOn = newProgram.DependsOn
+	p.Priority = newProgram.Priority
+	p.Schedule = newProgram.Schedule
+	p.ScheduleTimezone = newProgram.ScheduleTimezone
+	p.ScheduleJitter = newProgram.ScheduleJitter
+	p.ConcurrencyPolicy = newProgram.ConcurrencyPolicy
+	p.RestartPolicy = newProgram.RestartPolicy
+	p.RestartMode = newProgram.RestartMode
+	p.RestartDelay = newProgram.RestartDelay
+	p.RestartMaxDelay = newProgram.RestartMaxDelay
+	p.RestartBackoff = newProgram.RestartBackoff
+	p.RestartResetSeconds = newProgram.RestartResetSeconds
+	p.initRestartPolicy()
+
+	p.HealthCheck = newProgram.HealthCheck
+	p.HealthCheckTarget = newProgram.HealthCheckTarget
+	p.HealthCheckInterval = newProgram.HealthCheckInterval
+	p.HealthCheckTimeout = newProgram.HealthCheckTimeout
+	p.HealthCheckThreshold = newProgram.HealthCheckThreshold
+	p.initHealthCheck()
+
+	p.MemoryMax = newProgram.MemoryMax
+	p.CpuQuota = newProgram.CpuQuota
+	p.PidsMax = newProgram.PidsMax
+	p.Limits = newProgram.Limits
+
 	// 运行用户
 	// 所有者
 	if len(newProgram.Author) > 0 {
 		p.Author = newProgram.Author
 	}
+	p.Owners = newProgram.Owners
+	p.OwnerGroups = newProgram.OwnerGroups
 	if newProgram.StopTimeout >= 3 {
 		p.StopTimeout = newProgram.StopTimeout
 	}
+	p.StopSignal = newProgram.StopSignal
+	p.StopSequence = newProgram.StopSequence
 	// 这个如何修改呢?
 	p.User = newProgram.User
+	p.Group = newProgram.Group
+	p.Umask = newProgram.Umask
+}
+
+func (p *ProgramEx) UpdateProgram(newProgram *Program) bool {
+	// 除了进程数，其他参数暂不作为明显的区分标志
+	p.Program.mergeProgram(newProgram)
+	p.applyCgroupLimits()
 
 	log.Printf("UpdateProgram: %s, ProcessNum: %d --> %d", p.Name, p.ProcessNum, newProgram.ProcessNum)
 
@@ -175,20 +464,25 @@ func (p *ProgramEx) UpdateProgram(newProgram *Program) bool {
 		// TODO: 如果command被修改了，则可能有一致性的问题
 		for i := p.ProcessNum; i < newProgram.ProcessNum; i++ {
 			newProc := p.NewProcess(i)
+			p.mu.Lock()
 			p.Processes = append(p.Processes, newProc)
+			p.mu.Unlock()
 
-			// 如果是自动启动，则启动
-			if p.StartAuto {
-				newProc.Operate(StartEvent)
+			// 如果是自动启动，则启动; 定时任务由Scheduler启动
+			if p.StartAuto && !p.IsScheduled() {
+				newProc.OperateBy(StartEvent, TriggerGosuv, "process num changed")
 			}
 		}
 	} else {
+		// 平滑重启的新进程不在Processes中, Processes[i]就是序号为i的进程
 		for i := p.ProcessNum - 1; i >= newProgram.ProcessNum; i-- {
-			p.stopAndWait(p.Processes[i])
-
+			p.mu.Lock()
+			process := p.Processes[i]
 			p.Processes[i] = nil
 			p.Processes = p.Processes[0:i] // 删除最后一个元素
+			p.mu.Unlock()
 
+			p.stopAndWait(process)
 		}
 	}
 
@@ -203,13 +497,15 @@ func (p *ProgramEx) StopAndWaitAll() bool {
 		return false
 	}
 	result := false
-	for i := p.ProcessNum - 1; i >= 0; i-- {
-		if p.stopAndWait(p.Processes[i]) {
+	// 包括平滑重启时的新进程
+	processes := p.allProcesses()
+	p.mu.Lock()
+	p.Processes = nil
+	p.mu.Unlock()
+	for i := len(processes) - 1; i >= 0; i-- {
+		if p.stopAndWait(processes[i]) {
 			result = true
 		}
-
-		p.Processes[i] = nil
-		p.Processes = p.Processes[0:i] // 删除最后一个元素
 	}
 	return result
 }
@@ -242,48 +538,57 @@ func (p *ProgramEx) stopAndWait(process *Process) bool {
 	}
 }
 
-func (p *ProgramEx) StartOne(index int) {
-	if index < len(p.Processes) {
-		if !p.Processes[index].IsRunning() {
-			p.Processes[index].Operate(StartEvent)
+func (p *ProgramEx) StartOne(opUser string, index int) {
+	if process := p.processAt(index); process != nil {
+		if !process.IsRunning() {
+			process.OperateBy(StartEvent, opUser, "start")
 		}
 	}
 }
 
 func (p *ProgramEx) StartAll(opUser string) {
-	log.Printf("操作: %s start all: %s --> %d", opUser, p.Name, len(p.Processes))
-	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s start all: %s --> %d\n", opUser, p.Name, len(p.Processes)))
+	processes := p.processList()
+	log.Printf("操作: %s start all: %s --> %d", opUser, p.Name, len(processes))
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s start all: %s --> %d\n", opUser, p.Name, len(processes)))
+
+	// 定时任务: 立即运行一次, 同样按照并发策略处理, 并记录运行结果
+	if p.IsScheduled() {
+		p.runScheduled(opUser, time.Now())
+		return
+	}
 
-	for index := 0; index < len(p.Processes); index++ {
-		if !p.Processes[index].IsRunning() {
-			p.Processes[index].Operate(StartEvent)
+	for _, process := range processes {
+		if !process.IsRunning() {
+			process.OperateBy(StartEvent, opUser, "start all")
 		}
 	}
 }
 
-func (p *ProgramEx) StopOne(index int) {
-	if index < len(p.Processes) {
-		p.Processes[index].Operate(StopEvent)
+func (p *ProgramEx) StopOne(opUser string, index int) {
+	if process := p.processAt(index); process != nil {
+		process.OperateBy(StopEvent, opUser, "stop")
 	}
 }
 
 func (p *ProgramEx) StopAll(opUser string) {
+	processes := p.processList()
 	// 记录操作日志：
-	log.Printf("操作: %s stop all: %s --> %d", opUser, p.Name, len(p.Processes))
-	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s stop all: %s --> %d\n", opUser, p.Name, len(p.Processes)))
+	log.Printf("操作: %s stop all: %s --> %d", opUser, p.Name, len(processes))
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s stop all: %s --> %d\n", opUser, p.Name, len(processes)))
 
-	for index := 0; index < len(p.Processes); index++ {
-		p.Processes[index].Operate(StopEvent)
+	for _, process := range processes {
+		process.OperateBy(StopEvent, opUser, "stop all")
 	}
 }
 
-func (p *ProgramEx) RestartAll() {
+func (p *ProgramEx) RestartAll(opUser string) {
+	processes := p.processList()
 
-	log.Printf("操作: admin restart all: %s --> %d", p.Name, len(p.Processes))
-	p.Merger.WriteStrLine(fmt.Sprintf("操作: admin restart all: %s --> %d\n", p.Name, len(p.Processes)))
+	log.Printf("操作: %s restart all: %s --> %d", opUser, p.Name, len(processes))
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s restart all: %s --> %d\n", opUser, p.Name, len(processes)))
 
-	for index := 0; index < len(p.Processes); index++ {
-		p.Processes[index].Operate(RestartEvent)
+	for _, process := range processes {
+		process.OperateBy(RestartEvent, opUser, "restart all")
 	}
 }
 
@@ -291,12 +596,17 @@ func (p *ProgramEx) RestartAll() {
 // 从Program创建一个Process
 //
 func (p *ProgramEx) NewProcess(index int) *Process {
+	return p.newProcess(index, 0)
+}
+
+func (p *ProgramEx) newProcess(index int, generation int) *Process {
 	outputBufferSize := 10 * 1024 // 10k
 	pr := &Process{
 		FSM:         NewFSM(Stopped),
-		ProcessName: p.IndexName(index),
+		ProcessName: p.IndexName(index, generation),
 		Program:     p,
 		Index:       index,
+		Generation:  generation,
 		stopC:       make(chan syscall.Signal),
 		retryLeft:   p.StartRetries,
 		Status:      string(Stopped),
@@ -319,22 +629,31 @@ func (p *ProgramEx) NewProcess(index int) *Process {
 	if pr.Program.StopTimeout <= 0 {
 		pr.Program.StopTimeout = 5
 	}
+	pr.Program.initRestartPolicy()
+	pr.Program.initHealthCheck()
 
-	pr.AddHandler(Stopped, StartEvent, func() {
+	startFromStopped := func() {
 		// 重新开始retry
 		pr.retryLeft = pr.Program.StartRetries
+		pr.retryDelay = 0
 		pr.startCommand()
-	})
+	}
+	pr.AddHandler(Stopped, StartEvent, startFromStopped)
+	pr.AddHandler(Exited, StartEvent, startFromStopped)
 	pr.AddHandler(Fatal, StartEvent, pr.startCommand)
 
-	pr.AddHandler(Running, StopEvent, func() {
+	stopRunning := func() {
 		select {
 		case pr.stopC <- syscall.SIGTERM:
 		// 如果stopC有太多的积压，则直接放弃
 		case <-time.After(200 * time.Millisecond):
 		}
-
-	}).AddHandler(Running, RestartEvent, func() {
+	}
+	restartRunning := func() {
+		if p.RestartMode == RestartModeStartFirst {
+			go p.replaceProcess(pr)
+			return
+		}
 		go func() {
 			// 不要做异步操作，直接Block即可
 			if pr.IsRunning() {
@@ -361,7 +680,11 @@ func (p *ProgramEx) NewProcess(index int) *Process {
 				pr.Operate(StartEvent)
 			}
 		}()
-	})
+	}
+	pr.AddHandler(Running, StopEvent, stopRunning).AddHandler(Running, RestartEvent, restartRunning)
+
+	// 健康检查失败的进程仍然在运行，可以stop或restart
+	pr.AddHandler(Unhealthy, StopEvent, stopRunning).AddHandler(Unhealthy, RestartEvent, restartRunning)
 	return pr
 }
 
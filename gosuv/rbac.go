@@ -0,0 +1,231 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 角色, 权限从低到高
+const (
+	RoleViewer   = "viewer"   // 只读: 状态, 日志, 性能, 运行历史, 操作记录
+	RoleOperator = "operator" // 添加Program, 操作(启停, 信号, 编辑, 删除)自己负责的Program
+	RoleAdmin    = "admin"    // 所有的操作, 包括其他人的Program, reload, restart
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// 接口需要的权限
+const (
+	PermView   = "view"   // viewer
+	PermCreate = "create" // operator: 添加Program, 加密密码
+	PermManage = "manage" // operator + Program的负责人(或者admin), Program不存在时等同于PermCreate
+	PermAdmin  = "admin"  // admin
+	PermTokens = "tokens" // viewer, 管理自己的Token; 不能使用Token
+)
+
+// 当前请求的用户和角色
+type requestUser struct {
+	Name   string
+	Groups []string
+	Role   string // 空表示没有任何权限
+
+	Token    string // 使用Token认证时Token的名字
+	Programs string // Token可以操作的Program(glob)
+}
+
+//
+// 用户的角色:
+// 1. 没有开启ldap时, 不区分用户, 都是admin(和之前的行为一致)
+// 2. 没有ldap用户的请求(/api/restart, /ws/), 只有从本机直接访问(例如: 命令行)时是admin
+// 3. admins中的用户是admin
+// 4. 其他用户取所在ldap组对应的最高角色, 没有匹配到任何组时使用default_role
+// 5. 使用Token时, 角色不超过Token的scope
+//
+func (s *Supervisor) requestUser(r *http.Request) *requestUser {
+	user := &requestUser{
+		Name:   r.Header.Get(LdapUserKey),
+		Groups: splitUserGroups(r.Header.Get(LdapUserGroupsKey)),
+	}
+	if !s.cfg.Server.Ldap.Enabled {
+		user.Role = RoleAdmin
+		return user
+	}
+	if len(user.Name) == 0 {
+		if isLocalRequest(r) {
+			user.Role = RoleAdmin
+		}
+		return user
+	}
+	if containsString(s.cfg.Admins, user.Name) {
+		user.Role = RoleAdmin
+	} else {
+		user.Role = groupsRole(user.Groups, s.cfg.Rbac.Groups, s.cfg.Rbac.DefaultRole)
+	}
+
+	if scope := r.Header.Get(TokenScopeKey); len(scope) > 0 {
+		user.Token = r.Header.Get(TokenNameKey)
+		user.Programs = r.Header.Get(TokenProgramsKey)
+		if scopeRole := tokenScopeRoles[scope]; roleLevels[scopeRole] < roleLevels[user.Role] {
+			user.Role = scopeRole
+		}
+	}
+	return user
+}
+
+// ldap组对应的最高角色
+func groupsRole(groups []string, groupRoles map[string]string, defaultRole string) string {
+	role, matched := "", false
+	for _, group := range groups {
+		if groupRole, ok := groupRoles[group]; ok {
+			matched = true
+			if roleLevels[groupRole] > roleLevels[role] {
+				role = groupRole
+			}
+		}
+	}
+	if !matched {
+		role = defaultRole
+	}
+	if _, ok := roleLevels[role]; !ok {
+		return ""
+	}
+	return role
+}
+
+func splitUserGroups(value string) []string {
+	var groups []string
+	for _, group := range strings.Split(value, ",") {
+		group = strings.TrimSpace(group)
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// 直接从本机访问(没有经过nginx转发)
+func isLocalRequest(r *http.Request) bool {
+	if len(r.Header.Get("X-Forwarded-For")) > 0 || len(r.Header.Get("X-Real-IP")) > 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//
+// Program的负责人: 作者(兼容逗号分隔的多个作者), owners中的用户, 或者属于owner_groups
+//
+func (p *Program) IsOwner(user string, groups []string) bool {
+	if len(user) == 0 {
+		return false
+	}
+	for _, author := range strings.Split(p.Author, ",") {
+		if strings.TrimSpace(author) == user {
+			return true
+		}
+	}
+	if containsString(p.Owners, user) {
+		return true
+	}
+	for _, group := range groups {
+		if containsString(p.OwnerGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查权限; name, exists, owner: 操作的Program, 是否存在, 当前用户是否是负责人
+func (u *requestUser) authorize(perm string, name string, exists bool, owner bool) error {
+	level := roleLevels[u.Role]
+
+	// Token只能操作programs匹配的Program, 不能管理Token
+	if len(u.Token) > 0 {
+		switch perm {
+		case PermManage:
+			if !tokenMatchProgram(u.Programs, name) {
+				return fmt.Errorf("Permission denied: token %s can not operate program %s", u.Token, strconv.Quote(name))
+			}
+		case PermCreate, PermAdmin:
+			if u.Programs != "*" {
+				return fmt.Errorf("Permission denied: token %s is limited to programs %s", u.Token, u.Programs)
+			}
+		case PermTokens:
+			return fmt.Errorf("Permission denied: token %s can not manage tokens", u.Token)
+		}
+	}
+
+	switch perm {
+	case PermView, PermTokens:
+		if level >= roleLevels[RoleViewer] {
+			return nil
+		}
+	case PermCreate:
+		if level >= roleLevels[RoleOperator] {
+			return nil
+		}
+	case PermManage:
+		if level >= roleLevels[RoleAdmin] || (level >= roleLevels[RoleOperator] && (owner || !exists)) {
+			return nil
+		}
+		if level >= roleLevels[RoleOperator] {
+			return fmt.Errorf("Permission denied: %s is not owner of the program", u.Name)
+		}
+	case PermAdmin:
+		if level >= roleLevels[RoleAdmin] {
+			return nil
+		}
+	}
+	if len(u.Role) == 0 {
+		return fmt.Errorf("Permission denied: user %s has no role", strconv.Quote(u.Name))
+	}
+	return fmt.Errorf("Permission denied: %s requires %s permission, role: %s", u.Name, perm, u.Role)
+}
+
+//
+// 包装handler: 检查权限之后再执行, 否则返回403
+// PermManage针对路由中的{name}对应的Program
+//
+func (s *Supervisor) requirePerm(perm string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := s.requestUser(r)
+
+		name := mux.Vars(r)["name"]
+		exists, owner := false, false
+		if perm == PermManage && len(name) > 0 {
+			s.namesMu.Lock()
+			if program, ok := s.name2Program[name]; ok {
+				exists, owner = true, program.IsOwner(user.Name, user.Groups)
+			}
+			s.namesMu.Unlock()
+		}
+
+		if err := user.authorize(perm, name, exists, owner); err != nil {
+			log.Printf("操作: %s denied: %s %s, %v", user.Name, r.Method, r.URL.Path, err)
+			writeForbidden(w, err)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// 403, 返回JSON格式的错误
+func writeForbidden(w http.ResponseWriter, err error) {
+	WriteJSONStatus(w, http.StatusForbidden, JSONResponse{
+		Status: 1,
+		Value:  err.Error(),
+	})
+}
@@ -0,0 +1,117 @@
+package gosuv
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// go test gosuv -v -run "TestRequestUserRole"
+func TestRequestUserRole(t *testing.T) {
+	cfg := &Configuration{Admins: []string{"root"}}
+	cfg.Server.Ldap.Enabled = true
+	cfg.Rbac.DefaultRole = RoleViewer
+	cfg.Rbac.Groups = map[string]string{"ops": RoleAdmin, "dev": RoleOperator, "qa": RoleViewer}
+	s := &Supervisor{cfg: cfg}
+
+	cases := []struct {
+		user     string
+		groups   string
+		remote   string
+		expected string
+	}{
+		{"root", "", "10.0.0.1:1234", RoleAdmin},
+		{"alice", "qa,dev", "10.0.0.1:1234", RoleOperator},
+		{"bob", "ops", "10.0.0.1:1234", RoleAdmin},
+		{"carol", "sales", "10.0.0.1:1234", RoleViewer},
+		{"", "", "127.0.0.1:1234", RoleAdmin}, // 本机的命令行
+		{"", "", "10.0.0.1:1234", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/programs", nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set(LdapUserKey, c.user)
+		r.Header.Set(LdapUserGroupsKey, c.groups)
+		if role := s.requestUser(r).Role; role != c.expected {
+			t.Errorf("%s(%s): expected %q, got %q", c.user, c.groups, c.expected, role)
+		}
+	}
+
+	// 经过nginx转发的匿名请求
+	r := httptest.NewRequest("GET", "/ws/events", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	if role := s.requestUser(r).Role; role != "" {
+		t.Errorf("expected no role for proxied anonymous request, got %q", role)
+	}
+
+	// 没有开启ldap时都是admin
+	cfg.Server.Ldap.Enabled = false
+	if role := s.requestUser(r).Role; role != RoleAdmin {
+		t.Errorf("expected admin without ldap, got %q", role)
+	}
+}
+
+// go test gosuv -v -run "TestProgramIsOwner"
+func TestProgramIsOwner(t *testing.T) {
+	p := &Program{Author: "alice, bob", Owners: []string{"carol"}, OwnerGroups: []string{"dba"}}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if !p.IsOwner(user, nil) {
+			t.Errorf("expected %s to be owner", user)
+		}
+	}
+	if !p.IsOwner("dave", []string{"dev", "dba"}) {
+		t.Errorf("expected owner by group")
+	}
+	if p.IsOwner("dave", []string{"dev"}) || p.IsOwner("", []string{"dba"}) {
+		t.Errorf("unexpected owner")
+	}
+}
+
+// go test gosuv -v -run "TestRequirePerm"
+func TestRequirePerm(t *testing.T) {
+	cfg := &Configuration{}
+	cfg.Server.Ldap.Enabled = true
+	cfg.Rbac.Groups = map[string]string{"dev": RoleOperator, "qa": RoleViewer}
+	s := &Supervisor{
+		cfg: cfg,
+		name2Program: map[string]*ProgramEx{
+			"redis": {Program: &Program{Name: "redis", Author: "alice"}},
+		},
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, JSONResponse{Status: 0})
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/programs", s.requirePerm(PermView, ok)).Methods("GET")
+	router.HandleFunc("/api/programs/{name}/stop", s.requirePerm(PermManage, ok)).Methods("POST")
+	router.HandleFunc("/api/reload", s.requirePerm(PermAdmin, ok)).Methods("POST")
+
+	cases := []struct {
+		method   string
+		path     string
+		user     string
+		groups   string
+		expected int
+	}{
+		{"GET", "/api/programs", "eve", "qa", http.StatusOK},
+		{"POST", "/api/programs/redis/stop", "eve", "qa", http.StatusForbidden},
+		{"POST", "/api/programs/redis/stop", "bob", "dev", http.StatusForbidden},
+		{"POST", "/api/programs/redis/stop", "alice", "dev", http.StatusOK},
+		{"POST", "/api/programs/missing/stop", "bob", "dev", http.StatusOK}, // 由handler返回不存在
+		{"POST", "/api/reload", "alice", "dev", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set(LdapUserKey, c.user)
+		r.Header.Set(LdapUserGroupsKey, c.groups)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != c.expected {
+			t.Errorf("%s %s by %s: expected %d, got %d: %s", c.method, c.path, c.user, c.expected, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package gosuv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 修改之后, 正在运行的进程需要重启才能生效; 其他字段(进程数, 重启策略, 健康检查, 资源限制等)reload之后直接生效
+var restartFields = map[string]bool{
+	"command":   true,
+	"args":      true,
+	"shell":     true,
+	"environ":   true,
+	"env_files": true,
+	"clean_env": true,
+	"pass_env":  true,
+	"limits":    true,
+	"directory": true,
+	"user":      true,
+	"group":     true,
+	"umask":     true,
+	"base_port": true,
+}
+
+type FieldDiff struct {
+	Field string      `json:"field"` // yaml中的名字, 例如: process_num
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type ProgramDiff struct {
+	Name          string      `json:"name"`
+	Fields        []FieldDiff `json:"fields"`
+	OldProcessNum int         `json:"old_process_num"`
+	NewProcessNum int         `json:"new_process_num"`
+}
+
+//
+// reload的计划: store中的Program和正在运行的Program的差异
+// 进程的名字和页面上一样, 例如: web_000
+//
+type ReloadPlan struct {
+	Hash    string         `json:"hash"`    // store和正在运行的Program的hash, 执行计划时必须一致
+	Added   []*ProgramDiff `json:"added"`   // 只有new_process_num
+	Removed []*ProgramDiff `json:"removed"` // 只有old_process_num
+	Updated []*ProgramDiff `json:"updated"`
+	Start   []string       `json:"start"`   // 会启动的进程(新的Program, 增加的进程, 需要start_auto)
+	Stop    []string       `json:"stop"`    // 会停止的进程(删除的Program, 减少的进程)
+	Restart []string       `json:"restart"` // reload不会重启, 需要重启之后才能使用新配置的进程
+}
+
+func (plan *ReloadPlan) Empty() bool {
+	return len(plan.Added) == 0 && len(plan.Removed) == 0 && len(plan.Updated) == 0
+}
+
+// 零值, 空的slice, map等同于没有设置
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// 比较所有保存在yaml中的字段
+func diffProgram(oldProgram *Program, newProgram *Program) []FieldDiff {
+	var diffs []FieldDiff
+	oldValue := reflect.ValueOf(oldProgram).Elem()
+	newValue := reflect.ValueOf(newProgram).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := strings.Split(oldValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if len(field) == 0 || field == "-" || field == "name" {
+			continue
+		}
+
+		oldField, newField := oldValue.Field(i), newValue.Field(i)
+		if isEmptyValue(oldField) && isEmptyValue(newField) {
+			continue
+		}
+		if reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			continue
+		}
+		// environ通过EnvironList的MarshalJSON隐藏密码
+		diffs = append(diffs, FieldDiff{
+			Field: field,
+			Old:   fieldValue(oldField),
+			New:   fieldValue(newField),
+		})
+	}
+	return diffs
+}
+
+// 指针(例如: shell)返回指向的值
+func fieldValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+// 和UpdateProgram一样补全默认值, 避免把默认值当作修改
+func (p *ProgramEx) reloadedProgram(program *Program) *Program {
+	newProgram := *program
+	newProgram.initShell()
+	newProgram.initRestartPolicy()
+	newProgram.initHealthCheck()
+	newProgram.Environ = mergeMaskedEnviron(p.Environ, program.Environ)
+	if len(newProgram.Author) == 0 {
+		newProgram.Author = p.Author
+	}
+	if newProgram.StopTimeout < 3 {
+		newProgram.StopTimeout = p.StopTimeout
+	}
+	// 没有设置时, NewProcess使用默认值3
+	if newProgram.StartSeconds <= 0 && (p.StartSeconds <= 0 || p.StartSeconds == 3) {
+		newProgram.StartSeconds = p.StartSeconds
+	}
+	return &newProgram
+}
+
+// 正在运行的进程
+func (p *ProgramEx) runningProcesses(from int, to int) []string {
+	var names []string
+	processes := p.processList()
+	for i := from; i < to && i < len(processes); i++ {
+		if processes[i] != nil && processes[i].IsRunning() {
+			names = append(names, processes[i].ProcessName)
+		}
+	}
+	return names
+}
+
+//
+// 计算reload的计划, 需要WLock
+// 返回store中的Program, 执行计划时使用
+//
+func (s *Supervisor) reloadPlanWithLock() (*ReloadPlan, map[string]*Program, error) {
+	pgs, err := s.readPrograms()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan := &ReloadPlan{}
+	programs := make(map[string]*Program, len(pgs))
+	revisions := make([]string, 0, len(pgs)+len(s.name2Program))
+	for _, pg := range pgs {
+		programs[pg.Name] = pg
+		revisions = append(revisions, "store:"+pg.Name+":"+pg.revision())
+
+		oldProg, ok := s.name2Program[pg.Name]
+		if !ok {
+			plan.Added = append(plan.Added, &ProgramDiff{Name: pg.Name, NewProcessNum: pg.ProcessNum})
+			if s.autoStarted && pg.StartAuto && !pg.IsScheduled() {
+				added := &ProgramEx{Program: pg}
+				for i := 0; i < pg.ProcessNum; i++ {
+					plan.Start = append(plan.Start, added.IndexName(i, 0))
+				}
+			}
+			continue
+		}
+
+		newProgram := oldProg.reloadedProgram(pg)
+		fields := diffProgram(oldProg.Program, newProgram)
+		if len(fields) == 0 {
+			continue
+		}
+		plan.Updated = append(plan.Updated, &ProgramDiff{
+			Name:          pg.Name,
+			Fields:        fields,
+			OldProcessNum: oldProg.ProcessNum,
+			NewProcessNum: pg.ProcessNum,
+		})
+
+		if pg.ProcessNum < oldProg.ProcessNum {
+			plan.Stop = append(plan.Stop, oldProg.runningProcesses(pg.ProcessNum, oldProg.ProcessNum)...)
+		} else if pg.StartAuto && !newProgram.IsScheduled() {
+			for i := oldProg.ProcessNum; i < pg.ProcessNum; i++ {
+				plan.Start = append(plan.Start, oldProg.IndexName(i, 0))
+			}
+		}
+		for _, field := range fields {
+			if restartFields[field.Field] {
+				plan.Restart = append(plan.Restart, oldProg.runningProcesses(0, pg.ProcessNum)...)
+				break
+			}
+		}
+	}
+
+	for name, program := range s.name2Program {
+		revisions = append(revisions, "running:"+name+":"+program.revision)
+		if _, ok := programs[name]; ok {
+			continue
+		}
+		plan.Removed = append(plan.Removed, &ProgramDiff{Name: name, OldProcessNum: program.ProcessNum})
+		plan.Stop = append(plan.Stop, program.runningProcesses(0, program.ProcessNum)...)
+	}
+
+	sort.Slice(plan.Removed, func(i, j int) bool {
+		return plan.Removed[i].Name < plan.Removed[j].Name
+	})
+	sort.Strings(plan.Stop)
+	sort.Strings(revisions)
+	sum := sha256.Sum256([]byte(strings.Join(revisions, "\n")))
+	plan.Hash = hex.EncodeToString(sum[:])
+	return plan, programs, nil
+}
+
+//
+// 执行计划: 只修改计划中的Program, 需要WLock
+// 某个Program失败(例如: 无效的配置)时继续执行其他的Program, 最后返回所有的错误
+//
+func (s *Supervisor) applyReloadPlanWithLock(plan *ReloadPlan, programs map[string]*Program) error {
+	s.saveSnapshot(pgsOf(programs))
+	revisions := make(map[string]string, len(programs))
+	for name, pg := range programs {
+		revisions[name] = pg.revision()
+	}
+
+	for _, diff := range plan.Removed {
+		s.removeProgram(diff.Name, false)
+	}
+	var failed []string
+	failedNames := map[string]bool{}
+	for _, diffs := range [][]*ProgramDiff{plan.Added, plan.Updated} {
+		for _, diff := range diffs {
+			if err := s.addOrUpdateProgram(programs[diff.Name], false); err != nil {
+				log.ErrorErrorf(err, "Reload program failed: %s", diff.Name)
+				failed = append(failed, fmt.Sprintf("%s: %v", diff.Name, err))
+				failedNames[diff.Name] = true
+			}
+		}
+	}
+
+	// 内容没有变化(例如: 只有默认值不同), 只需要记录store中的版本
+	// 失败的Program仍然是旧的版本, 下次同步或者reload时重试
+	for name, pg := range programs {
+		if failedNames[name] {
+			continue
+		}
+		if program, ok := s.name2Program[name]; ok {
+			program.Version = pg.Version
+			program.UpdatedAt = pg.UpdatedAt
+			program.revision = revisions[name]
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Reload programs failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func pgsOf(programs map[string]*Program) []*Program {
+	pgs := make([]*Program, 0, len(programs))
+	for _, pg := range programs {
+		pgs = append(pgs, pg)
+	}
+	sort.Slice(pgs, func(i, j int) bool {
+		return pgs[i].Name < pgs[j].Name
+	})
+	return pgs
+}
+
+//
+// reload的两个步骤, 需要WLock:
+// 1. dry_run=1: 只返回计划, 不会修改
+// 2. hash=xxx: 执行dry_run返回的计划; store或者正在运行的Program已经修改(hash不一致)时返回409, 需要重新dry_run
+//
+func (s *Supervisor) hReloadPlan(w http.ResponseWriter, r *http.Request, dryRun bool, hash string) {
+	plan, programs, err := s.reloadPlanWithLock()
+	if err != nil {
+		WriteJSONStatus(w, errorHTTPStatus(err), JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	if dryRun {
+		WriteJSON(w, JSONResponse{
+			Status: 0,
+			Value:  plan,
+		})
+		return
+	}
+
+	auditRecord := &AuditRecord{Action: AuditReload, Params: auditParams("hash", hash)}
+	if plan.Hash != hash {
+		err := fmt.Errorf("Reload plan changed, expected hash: %s, current: %s", hash, plan.Hash)
+		s.audit(r, auditRecord, err)
+		WriteJSONStatus(w, http.StatusConflict, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	err = s.applyReloadPlanWithLock(plan, programs)
+	log.Printf("操作: %s Reload config file, plan: %s, added: %d, removed: %d, updated: %d",
+		r.Header.Get(LdapUserKey), hash, len(plan.Added), len(plan.Removed), len(plan.Updated))
+	s.audit(r, auditRecord, err)
+	if err != nil {
+		// 其他的修改已经生效, 需要修改store中的Program之后重新reload
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  plan,
+	})
+}
+
+// dry_run=1, dry_run=true
+func formBoolValue(r *http.Request, key string) bool {
+	value, _ := strconv.ParseBool(r.FormValue(key))
+	return value
+}
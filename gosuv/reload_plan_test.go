@@ -0,0 +1,106 @@
+package gosuv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test gosuv -v -run "TestReloadPlan"
+func TestReloadPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSupervisor(&Configuration{Host: "host1"}, dir)
+	defer s.scheduler.Close()
+	s.store = NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "worker", Command: "./worker", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "cron", Command: "./cron", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	other.Update(&Program{Name: "worker", Command: "./worker -n 2", ProcessNum: 2})
+	other.Delete(&Program{Name: "cron"})
+	other.Insert(&Program{Name: "redis", Command: "redis-server", ProcessNum: 1})
+
+	reload := func(query string) (int, JSONResponse, *ReloadPlan) {
+		w := httptest.NewRecorder()
+		s.hReload(w, httptest.NewRequest("POST", "/api/reload?"+query, nil))
+		var ret JSONResponse
+		var plan ReloadPlan
+		if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Fatalf("unexpected response: %s", w.Body.String())
+		}
+		// 成功时返回计划, 失败时返回错误
+		if ret.Status == 0 {
+			ret.Value = &plan
+			json.Unmarshal(w.Body.Bytes(), &ret)
+		}
+		return w.Code, ret, &plan
+	}
+
+	// dry_run: 只返回计划
+	code, _, plan := reload("dry_run=1")
+	if code != http.StatusOK || len(plan.Hash) == 0 {
+		t.Fatalf("expected plan, got %d, %v", code, plan)
+	}
+	if len(plan.Added) != 1 || plan.Added[0].Name != "redis" || len(plan.Removed) != 1 || plan.Removed[0].Name != "cron" {
+		t.Errorf("unexpected added/removed: %v, %v", plan.Added, plan.Removed)
+	}
+	if len(plan.Updated) != 1 || plan.Updated[0].Name != "worker" || plan.Updated[0].NewProcessNum != 2 || len(plan.Updated[0].Fields) != 2 {
+		t.Errorf("unexpected updated: %v", plan.Updated)
+	}
+	if _, ok := s.name2Program["cron"]; !ok {
+		t.Fatalf("dry run should not remove programs")
+	}
+
+	// store又被修改了, 计划失效
+	other.Update(&Program{Name: "web", Command: "./web -v", ProcessNum: 1})
+	if code, _, _ := reload("hash=" + plan.Hash); code != http.StatusConflict {
+		t.Errorf("expected 409 for a stale plan, got %d", code)
+	}
+	if _, ok := s.name2Program["cron"]; !ok {
+		t.Fatalf("stale plan should not be applied")
+	}
+
+	// 执行新的计划
+	_, _, plan = reload("dry_run=1")
+	if code, ret, _ := reload("hash=" + plan.Hash); code != http.StatusOK || ret.Status != 0 {
+		t.Fatalf("expected plan applied, got %d, %v", code, ret)
+	}
+	if _, ok := s.name2Program["cron"]; ok {
+		t.Errorf("expected cron removed")
+	}
+	if s.name2Program["redis"] == nil || s.name2Program["worker"].ProcessNum != 2 || s.name2Program["web"].Command != "./web -v" {
+		t.Errorf("unexpected programs after reload: %v", s.name2Program)
+	}
+	if _, _, plan = reload("dry_run=1"); !plan.Empty() {
+		t.Errorf("expected empty plan after apply, got %v", plan)
+	}
+
+	// 无效的Program不会生效, 返回错误; 其他的修改仍然生效
+	other.Update(&Program{Name: "worker", ProcessNum: 2})
+	other.Insert(&Program{Name: "api", Command: "./api", ProcessNum: 1})
+	_, _, plan = reload("dry_run=1")
+	code, ret, _ := reload("hash=" + plan.Hash)
+	if message, _ := ret.Value.(string); code != http.StatusOK || ret.Status != 1 || !strings.Contains(message, "worker: Program command empty") {
+		t.Errorf("expected reload error, got %d, %v", code, ret)
+	}
+	if s.name2Program["api"] == nil || s.name2Program["worker"].Command != "./worker -n 2" {
+		t.Errorf("unexpected programs after failed reload: %v", s.name2Program)
+	}
+	if _, _, plan = reload("dry_run=1"); len(plan.Updated) != 1 || plan.Updated[0].Name != "worker" {
+		t.Errorf("expected worker still in plan, got %v", plan)
+	}
+}
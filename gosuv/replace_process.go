@@ -0,0 +1,97 @@
+package gosuv
+
+import (
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"time"
+)
+
+//
+// 平滑重启(start-first): 先启动一个新的进程，等它运行(健康)之后，再停止旧的进程
+// 新的进程先放在standby中, 接替之后才放到Processes中, 因此Processes[i]总是序号为i的进程
+// 注意: 新旧进程的{{.Port}}相同, 同时运行期间需要进程自己支持(例如: SO_REUSEPORT)
+//
+func (p *ProgramEx) replaceProcess(old *Process) {
+	if !old.replacing.CompareAndSwap(false, true) {
+		log.Printf("Process %s is already being replaced", old.ProcessName)
+		return
+	}
+	defer old.replacing.Set(false)
+
+	newProc := p.newProcess(old.Index, old.Generation+1)
+	p.mu.Lock()
+	p.standby = append(p.standby, newProc)
+	p.mu.Unlock()
+
+	p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Replace Process: %s --> %s starting\n", old.ProcessName, newProc.ProcessName))
+	since := time.Now()
+	trigger := old.takeStartTrigger()
+	newProc.OperateBy(StartEvent, trigger.User, trigger.Reason)
+
+	err := newProc.waitRestarted(since)
+	if err != nil {
+		// 新的进程启动失败，保留旧的进程
+		p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Replace Process: %s failed, keep old process, %v\n", old.ProcessName, err))
+		p.stopAndWait(newProc)
+		p.removeStandby(newProc)
+		return
+	}
+
+	// 新的进程接替旧进程的位置
+	p.mu.Lock()
+	replaced := false
+	if old.Index < len(p.Processes) && p.Processes[old.Index] == old {
+		p.Processes[old.Index] = newProc
+		replaced = true
+	}
+	p.mu.Unlock()
+	p.removeStandby(newProc)
+
+	if !replaced {
+		// 在此期间旧的进程已经被删除(例如: 减少了进程数)
+		p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Replace Process: %s removed, stop %s\n", old.ProcessName, newProc.ProcessName))
+		p.stopAndWait(newProc)
+		return
+	}
+
+	p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Replace Process: %s running, stopping %s\n", newProc.ProcessName, old.ProcessName))
+	p.stopAndWait(old)
+	gEventPub.PostEvent(fmt.Sprintf("Process %s replaced by %s", old.ProcessName, newProc.ProcessName))
+}
+
+func (p *ProgramEx) removeStandby(process *Process) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.standby) - 1; i >= 0; i-- {
+		if p.standby[i] == process {
+			p.standby = append(p.standby[:i], p.standby[i+1:]...)
+			return
+		}
+	}
+}
+
+// 当前占据index位置的进程
+func (p *ProgramEx) processAt(index int) *Process {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.Processes) {
+		return nil
+	}
+	return p.Processes[index]
+}
+
+// Processes的快照, 不包括平滑重启时的新进程
+func (p *ProgramEx) processList() []*Process {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Process(nil), p.Processes...)
+}
+
+// 包括平滑重启时的新进程(例如: 停止所有的进程, 修改资源限制)
+func (p *ProgramEx) allProcesses() []*Process {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	processes := make([]*Process, 0, len(p.Processes)+len(p.standby))
+	processes = append(processes, p.Processes...)
+	return append(processes, p.standby...)
+}
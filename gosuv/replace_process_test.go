@@ -0,0 +1,45 @@
+package gosuv
+
+import (
+	"sync"
+	"testing"
+)
+
+// go test gosuv -v -run "TestReplaceStandby"
+func TestReplaceStandby(t *testing.T) {
+	p := &ProgramEx{Program: &Program{Name: "web", Command: "./web", ProcessNum: 2}}
+	p.InitProgram("", false)
+
+	// 平滑重启期间, 新的进程不在Processes中
+	standby := p.newProcess(1, 1)
+	p.mu.Lock()
+	p.standby = append(p.standby, standby)
+	p.mu.Unlock()
+	if len(p.processList()) != 2 || len(p.allProcesses()) != 3 {
+		t.Fatalf("expected standby process out of Processes")
+	}
+
+	// 同时读取Processes(go test -race)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			p.UpdateState()
+			p.processAt(1)
+		}
+	}()
+
+	// 减少进程数: 删除的是序号为1的进程, 而不是standby
+	first := p.processAt(0)
+	p.UpdateProgram(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	wg.Wait()
+	if processes := p.processList(); len(processes) != 1 || processes[0] != first {
+		t.Errorf("expected only process 0 left, got %v", processes)
+	}
+
+	p.removeStandby(standby)
+	if len(p.allProcesses()) != 1 {
+		t.Errorf("expected standby removed")
+	}
+}
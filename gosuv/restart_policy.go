@@ -0,0 +1,124 @@
+package gosuv
+
+import (
+	"fmt"
+	"time"
+)
+
+// 进程退出之后的重启策略
+const (
+	RestartAlways    = "always"     // 不管如何退出，都重启
+	RestartOnFailure = "on-failure" // 只有exit code非0(或被信号杀死)才重启
+	RestartNever     = "never"      // 从不重启
+)
+
+// 重启方式
+const (
+	RestartModeStopFirst  = "stop-first"  // 先停止旧的进程，再启动新的进程(默认)
+	RestartModeStartFirst = "start-first" // 先启动新的进程，等它运行(健康)之后，再停止旧的进程
+)
+
+// 重启间隔的默认值
+const (
+	DefaultRestartDelay        = 2  // 第一次重试等待2s(和之前的行为保持一致)
+	DefaultRestartMaxDelay     = 60 // 最长等待60s
+	DefaultRestartBackoff      = 2.0
+	DefaultRestartResetSeconds = 600 // 运行10分钟以上，则认为进程是健康的
+)
+
+func (p *Program) checkRestartPolicy() error {
+	switch p.RestartPolicy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("Invalid restart policy: %s", p.RestartPolicy)
+	}
+	switch p.RestartMode {
+	case "", RestartModeStopFirst, RestartModeStartFirst:
+	default:
+		return fmt.Errorf("Invalid restart mode: %s", p.RestartMode)
+	}
+	if p.RestartDelay < 0 || p.RestartMaxDelay < 0 || p.RestartResetSeconds < 0 {
+		return fmt.Errorf("Restart delay should not be negative")
+	}
+	if p.RestartBackoff != 0 && p.RestartBackoff < 1 {
+		return fmt.Errorf("Restart backoff should be >= 1: %v", p.RestartBackoff)
+	}
+	for _, code := range p.ExitCodes {
+		if code < 0 || code > 255 {
+			return fmt.Errorf("Invalid exit code: %d", code)
+		}
+	}
+	return nil
+}
+
+// 设置重启策略的默认参数
+func (p *Program) initRestartPolicy() {
+	if p.RestartPolicy == "" {
+		p.RestartPolicy = RestartAlways
+	}
+	if p.RestartDelay <= 0 {
+		p.RestartDelay = DefaultRestartDelay
+	}
+	if p.RestartMaxDelay <= 0 {
+		p.RestartMaxDelay = DefaultRestartMaxDelay
+	}
+	if p.RestartMaxDelay < p.RestartDelay {
+		p.RestartMaxDelay = p.RestartDelay
+	}
+	if p.RestartBackoff < 1 {
+		p.RestartBackoff = DefaultRestartBackoff
+	}
+	if p.RestartResetSeconds <= 0 {
+		p.RestartResetSeconds = DefaultRestartResetSeconds
+	}
+}
+
+// 进程的exit code是否符合预期
+// 没有配置exit_codes时，只有0是预期的; 被信号杀死时exitCode为-1, 总是不符合预期
+func (p *Program) IsExpectedExit(exitCode int) bool {
+	if len(p.ExitCodes) == 0 {
+		return exitCode == 0
+	}
+	for _, code := range p.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// 进程退出之后是否需要重启; exit_codes只影响on-failure, never(以及定时任务)
+func (p *Program) ShouldRestart(exitCode int) bool {
+	// 定时任务正常结束之后等待下一次调度
+	if p.IsScheduled() && p.IsExpectedExit(exitCode) {
+		return false
+	}
+	switch p.RestartPolicy {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		// 一次性任务: 以预期的exit code退出之后进入exited状态, 不再重启
+		return !p.IsExpectedExit(exitCode)
+	}
+	// always(默认): 不管exit code是什么, 都重启
+	return true
+}
+
+// 计算下一次重试的等待时间(指数退避)
+// lastDelay: 上一次的等待时间, 0表示第一次重试
+func (p *Program) NextRestartDelay(lastDelay time.Duration) time.Duration {
+	initDelay := time.Duration(p.RestartDelay) * time.Second
+	maxDelay := time.Duration(p.RestartMaxDelay) * time.Second
+	if lastDelay <= 0 {
+		return initDelay
+	}
+
+	delay := time.Duration(float64(lastDelay) * p.RestartBackoff)
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay < initDelay {
+		delay = initDelay
+	}
+	return delay
+}
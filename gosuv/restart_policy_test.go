@@ -0,0 +1,58 @@
+package gosuv
+
+import (
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestNextRestartDelay"
+func TestNextRestartDelay(t *testing.T) {
+	p := &Program{
+		RestartDelay:    2,
+		RestartMaxDelay: 10,
+		RestartBackoff:  2,
+	}
+	p.initRestartPolicy()
+
+	expected := []time.Duration{2, 4, 8, 10, 10}
+	delay := time.Duration(0)
+	for i, e := range expected {
+		delay = p.NextRestartDelay(delay)
+		if delay != e*time.Second {
+			t.Errorf("retry %d: expected %v, got %v", i, e*time.Second, delay)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestShouldRestart"
+func TestShouldRestart(t *testing.T) {
+	cases := []struct {
+		policy    string
+		exitCodes []int
+		exitCode  int
+		expect    bool
+	}{
+		{RestartAlways, nil, 0, true},
+		{RestartAlways, nil, 1, true},
+		{RestartAlways, []int{0, 2}, 2, true},
+		{RestartAlways, []int{0, 2}, -1, true},
+		{RestartOnFailure, nil, 0, false},
+		{RestartOnFailure, nil, 1, true},
+		{RestartOnFailure, []int{3}, 0, true},
+		{RestartOnFailure, []int{0, 2}, 2, false},
+		{"", nil, 0, true},
+		{RestartNever, nil, 0, false},
+		{RestartNever, nil, 1, false},
+	}
+	for _, c := range cases {
+		p := &Program{RestartPolicy: c.policy, ExitCodes: c.exitCodes}
+		if p.ShouldRestart(c.exitCode) != c.expect {
+			t.Errorf("policy: %s, exit_codes: %v, exit code: %d, expected: %v", c.policy, c.exitCodes, c.exitCode, c.expect)
+		}
+	}
+
+	p := &Program{Name: "test", Command: "ls", RestartPolicy: "sometimes"}
+	if p.Check() == nil {
+		t.Errorf("invalid restart policy should be rejected")
+	}
+}
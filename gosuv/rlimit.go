@@ -0,0 +1,215 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/codeskyblue/kexec"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// 不限制
+const RlimitInfinity = ^uint64(0)
+
+// 支持的rlimit(Linux), 名字和ulimit/limits.conf保持一致
+var rlimitResources = map[string]int{
+	"cpu":        syscall.RLIMIT_CPU,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"data":       syscall.RLIMIT_DATA,
+	"stack":      syscall.RLIMIT_STACK,
+	"core":       syscall.RLIMIT_CORE,
+	"rss":        5,
+	"nproc":      6,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"memlock":    8,
+	"as":         syscall.RLIMIT_AS,
+	"locks":      10,
+	"sigpending": 11,
+	"msgqueue":   12,
+	"nice":       13,
+	"rtprio":     14,
+}
+
+// 一个rlimit的设置
+type rlimitSetting struct {
+	Name     string
+	Resource int
+	Limit    syscall.Rlimit
+}
+
+//
+// 解析limits的配置, 例如: nofile=65535, core=unlimited, nproc=1024:4096
+//
+func ParseLimits(value string) (map[string]string, error) {
+	limits := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid limit: %s", item)
+		}
+		limits[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return limits, nil
+}
+
+// 解析单个值: unlimited, 65535, 8M
+func parseRlimitValue(value string) (uint64, error) {
+	switch strings.ToLower(value) {
+	case "unlimited", "infinity", "max":
+		return RlimitInfinity, nil
+	}
+	if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return n, nil
+	}
+	// 支持K/M/G等单位, 例如: stack=8M
+	size, err := ParseMemorySize(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid limit value: %s", value)
+	}
+	return uint64(size), nil
+}
+
+//
+// 解析一个rlimit, 格式: soft:hard, 只有一个值时soft和hard相同
+//
+func parseRlimit(name string, value string) (*rlimitSetting, error) {
+	resource, ok := rlimitResources[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown limit: %s", name)
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	soft, err := parseRlimitValue(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	hard := soft
+	if len(parts) == 2 {
+		if hard, err = parseRlimitValue(strings.TrimSpace(parts[1])); err != nil {
+			return nil, err
+		}
+	}
+	if soft > hard {
+		return nil, fmt.Errorf("Limit %s: soft limit is greater than hard limit", name)
+	}
+	return &rlimitSetting{
+		Name:     strings.ToLower(name),
+		Resource: resource,
+		Limit:    syscall.Rlimit{Cur: soft, Max: hard},
+	}, nil
+}
+
+// 按照名字排序的rlimit设置
+func (p *Program) rlimits() ([]*rlimitSetting, error) {
+	names := make([]string, 0, len(p.Limits))
+	for name := range p.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settings := make([]*rlimitSetting, 0, len(names))
+	for _, name := range names {
+		setting, err := parseRlimit(name, p.Limits[name])
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+func (p *Program) checkLimits() error {
+	_, err := p.rlimits()
+	return err
+}
+
+// 通过prlimit(2)修改其他进程的rlimit
+func prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+//
+// 启动进程, 只修改子进程的rlimit和umask, gosuv自己的rlimit和umask不变:
+//   1. 通过/bin/sh启动: 设置umask, 然后等待gosuv的通知(fd 3)
+//   2. gosuv通过prlimit(2)修改子进程的rlimit
+//   3. 收到通知之后, /bin/sh再exec真正的命令(pid不变, rlimit和umask在exec之后保留)
+// 真正的命令启动时已经设置好了rlimit和umask
+// 非root用户不能调高hard limit, 因此不允许修改hard limit
+// umask: UmaskNone表示不修改
+//
+func startWithAttrs(cmd *kexec.KCommand, settings []*rlimitSetting, umask int) error {
+	if len(settings) == 0 && umask == UmaskNone {
+		return cmd.Start()
+	}
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	if !IsRoot() {
+		for _, setting := range settings {
+			var current syscall.Rlimit
+			if err := syscall.Getrlimit(setting.Resource, &current); err != nil {
+				return fmt.Errorf("get limit %s failed: %v", setting.Name, err)
+			}
+			if setting.Limit.Max != current.Max {
+				return fmt.Errorf("set hard limit %s requires root", setting.Name)
+			}
+		}
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer notify.Close()
+
+	script := `read ready <&3 || exit 1; exec 3<&-; exec "$@"`
+	if umask != UmaskNone {
+		script = fmt.Sprintf("umask %04o; %s", umask, script)
+	}
+	cmd.Args = append([]string{"/bin/sh", "-c", script, "gosuv", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	cmd.ExtraFiles = []*os.File{ready}
+
+	err = cmd.Start()
+	ready.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range settings {
+		if err := prlimit(cmd.Process.Pid, setting.Resource, &setting.Limit); err != nil {
+			// 没有收到通知, 不会exec真正的命令
+			notify.Close()
+			cmd.Terminate(syscall.SIGKILL)
+			cmd.Wait()
+			return fmt.Errorf("set limit %s failed: %v", setting.Name, err)
+		}
+	}
+	_, err = notify.Write([]byte("\n"))
+	return err
+}
+
+// 按照Program的limits和umask启动进程
+func (p *Process) startWithLimits() error {
+	settings, err := p.Program.rlimits()
+	if err != nil {
+		return err
+	}
+	umask, err := ParseUmask(p.Program.Umask)
+	if err != nil {
+		return err
+	}
+	return startWithAttrs(p.cmd, settings, umask)
+}
@@ -0,0 +1,114 @@
+package gosuv
+
+import (
+	"bytes"
+	"github.com/codeskyblue/kexec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// go test gosuv -v -run "TestParseRlimit"
+func TestParseRlimit(t *testing.T) {
+	limits, err := ParseLimits("nofile=65535, core=unlimited, nproc=1024:4096, stack=8M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Program{Limits: limits}
+	settings, err := p.rlimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]syscall.Rlimit{
+		"core":   {Cur: RlimitInfinity, Max: RlimitInfinity},
+		"nofile": {Cur: 65535, Max: 65535},
+		"nproc":  {Cur: 1024, Max: 4096},
+		"stack":  {Cur: 8 << 20, Max: 8 << 20},
+	}
+	if len(settings) != len(expected) {
+		t.Fatalf("expected %d limits, got %d", len(expected), len(settings))
+	}
+	for _, setting := range settings {
+		if setting.Limit != expected[setting.Name] {
+			t.Errorf("%s: expected %v, got %v", setting.Name, expected[setting.Name], setting.Limit)
+		}
+	}
+
+	for _, value := range []string{"foo=1", "nofile=abc", "nofile=4096:1024", "nofile"} {
+		limits, err := ParseLimits(value)
+		if err == nil {
+			err = (&Program{Limits: limits}).checkLimits()
+		}
+		if err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestStartWithAttrs"
+func TestStartWithAttrs(t *testing.T) {
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Cur < 200 {
+		t.Skip("nofile limit too small")
+	}
+	oldUmask := syscall.Umask(0022)
+	syscall.Umask(oldUmask)
+
+	// 启动期间不停地检查gosuv自己的rlimit
+	done := make(chan struct{})
+	changed := make(chan syscall.Rlimit, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(changed)
+				return
+			default:
+			}
+			var current syscall.Rlimit
+			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &current)
+			if current != old {
+				changed <- current
+				close(changed)
+				return
+			}
+		}
+	}()
+
+	// 只修改soft limit, 非root用户也可以运行
+	settings := []*rlimitSetting{{
+		Name:     "nofile",
+		Resource: syscall.RLIMIT_NOFILE,
+		Limit:    syscall.Rlimit{Cur: 100, Max: old.Max},
+	}}
+	var out bytes.Buffer
+	cmd := kexec.CommandString("ulimit -n; umask")
+	cmd.Stdout = &out
+	if err := startWithAttrs(cmd, settings, 0027); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	close(done)
+	if current, ok := <-changed; ok {
+		t.Errorf("gosuv rlimit changed during start: %v -> %v", old, current)
+	}
+
+	if lines := strings.Fields(out.String()); len(lines) != 2 || lines[0] != "100" || lines[1] != "0027" {
+		t.Errorf("expected child nofile 100 and umask 0027, got %q", out.String())
+	}
+	if umask := syscall.Umask(oldUmask); umask != oldUmask {
+		t.Errorf("gosuv umask changed: %o -> %o", oldUmask, umask)
+	}
+
+	// 非root用户不能修改hard limit
+	if !IsRoot() && old.Max != RlimitInfinity {
+		settings[0].Limit = syscall.Rlimit{Cur: 100, Max: old.Max + 1}
+		if err := startWithAttrs(kexec.CommandString("true"), settings, UmaskNone); err == nil {
+			t.Errorf("expected error for hard limit")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gosuv
+
+import (
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"time"
+)
+
+//
+// 在后台滚动重启, 同一个Program同时只能有一个滚动重启
+// 进度和结果通过gEventPub通知; done: 结束之后调用(例如: 写入操作记录)
+//
+func (p *ProgramEx) StartRollingRestart(opUser string, batchSize int, pause time.Duration, done func(err error)) error {
+	if !p.rolling.CompareAndSwap(false, true) {
+		return fmt.Errorf("Program %s is already rolling restarting", p.Name)
+	}
+	go func() {
+		err := p.rollingRestart(opUser, batchSize, pause)
+		p.rolling.Set(false)
+		if err != nil {
+			gEventPub.PostEvent(fmt.Sprintf("Program %s rolling restart failed: %v", p.Name, err))
+		} else {
+			gEventPub.PostEvent(fmt.Sprintf("Program %s rolling restart finished", p.Name))
+		}
+		if done != nil {
+			done(err)
+		}
+	}()
+	return nil
+}
+
+//
+// 滚动重启: 每次重启batchSize个进程, 等这批进程重新运行(超过StartSeconds, 并且通过健康检查)之后，再重启下一批
+// 如果有进程Fatal或者超时，则放弃后续的重启
+//
+func (p *ProgramEx) rollingRestart(opUser string, batchSize int, pause time.Duration) error {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	// 只重启运行中的进程
+	var processes []*Process
+	for _, process := range p.processList() {
+		if process == nil {
+			continue
+		}
+		if state := process.State(); state == Running || state == Unhealthy {
+			processes = append(processes, process)
+		}
+	}
+
+	log.Printf("操作: %s rolling restart: %s --> %d, batch: %d, pause: %v", opUser, p.Name, len(processes), batchSize, pause)
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s rolling restart: %s --> %d, batch: %d, pause: %v\n",
+		opUser, p.Name, len(processes), batchSize, pause))
+
+	for start := 0; start < len(processes); start += batchSize {
+		end := start + batchSize
+		if end > len(processes) {
+			end = len(processes)
+		}
+
+		batch := processes[start:end]
+		since := time.Now()
+		for _, process := range batch {
+			process.OperateBy(RestartEvent, opUser, "rolling restart")
+		}
+		for _, process := range batch {
+			// start-first模式下，新的进程会接替旧进程的位置
+			index := process.Index
+			err := waitRestarted(func() *Process { return p.processAt(index) }, since)
+			if err != nil {
+				p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Rolling restart aborted: %s, %v\n", p.Name, err))
+				return err
+			}
+		}
+		p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: Rolling restart: %s, %d/%d restarted\n", p.Name, end, len(processes)))
+		gEventPub.PostEvent(fmt.Sprintf("Program %s rolling restart %d/%d", p.Name, end, len(processes)))
+
+		if end < len(processes) && pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+	return nil
+}
+
+// 等待进程在since之后重新启动，并且稳定运行StartSeconds
+func (p *Process) waitRestarted(since time.Time) error {
+	return waitRestarted(func() *Process { return p }, since)
+}
+
+// current: 返回需要等待的进程(平滑重启时会发生变化)
+func waitRestarted(current func() *Process, since time.Time) error {
+	var deadline time.Time
+	for {
+		p := current()
+		if p == nil {
+			return fmt.Errorf("Process removed during restart")
+		}
+
+		startSeconds := time.Duration(p.Program.StartSeconds) * time.Second
+		if deadline.IsZero() {
+			timeout := time.Duration(p.Program.StopTimeout)*time.Second + startSeconds + DependencyWaitTimeout
+			deadline = time.Now().Add(timeout)
+		}
+
+		if p.State() == Fatal {
+			return fmt.Errorf("Process %s fatal after restart", p.ProcessName)
+		}
+		if p.startedAt.After(since) && time.Since(p.startedAt) >= startSeconds && p.IsReady() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Wait for process %s to restart timeout, state: %s", p.ProcessName, p.State())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,53 @@
+package gosuv
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestStartRollingRestart"
+func TestStartRollingRestart(t *testing.T) {
+	program := &ProgramEx{Program: &Program{Name: "web", Command: "./web"}}
+	program.InitProgram("", false)
+	s := newTestSupervisor(&Configuration{}, "")
+	defer s.scheduler.Close()
+	s.name2Program["web"] = program
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/programs/{name}/rolling-restart", s.hRollingRestartProgram).Methods("POST")
+	rollingRestart := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/programs/web/rolling-restart", nil))
+		return w.Code
+	}
+
+	// 正在滚动重启时拒绝
+	program.rolling.Set(true)
+	if code := rollingRestart(); code != http.StatusConflict {
+		t.Errorf("expected 409 while rolling restarting, got %d", code)
+	}
+	program.rolling.Set(false)
+	if code := rollingRestart(); code != http.StatusOK {
+		t.Errorf("expected rolling restart started, got %d", code)
+	}
+
+	// 在后台执行, 结束之后调用done
+	done := make(chan error, 1)
+	for i := 0; program.rolling.Get() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := program.StartRollingRestart("alice", 1, 0, func(err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected rolling restart error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected rolling restart finished")
+	}
+}
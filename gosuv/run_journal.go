@@ -0,0 +1,283 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"time"
+)
+
+// 启动(停止)进程的操作者, 除了ldap用户之外
+const (
+	TriggerAutoRetry = "auto-retry" // 进程退出之后自动重启
+	TriggerGosuv     = "gosuv"      // 自动启动, 定时任务, 健康检查等
+)
+
+// 进程启动失败(没有运行起来)
+const ExitReasonStartFailed = "start-failed"
+
+// 每个进程保留的最近的运行记录数(内存和数据库)
+const MaxProcessRuns = 50
+
+//
+// 进程的一次运行: 从启动到退出
+//
+type ProcessRun struct {
+	ID           uint       `json:"id" gorm:"primary_key"`
+	Host         string     `json:"host" gorm:"size:100;index:idx_host_program_index"`
+	ProgramName  string     `json:"program_name" gorm:"size:100;index:idx_host_program_index"`
+	ProcessIndex int        `json:"process_index" gorm:"index:idx_host_program_index"`
+	ProcessName  string     `json:"process_name" gorm:"size:120"`
+	Pid          int        `json:"pid"`
+	StartedAt    time.Time  `json:"started_at"`
+	StoppedAt    *time.Time `json:"stopped_at"` // 还在运行时为null
+	Duration     float64    `json:"duration"`   // 运行时间(s)
+	ExitCode     int        `json:"exit_code"`
+	ExitSignal   string     `json:"exit_signal" gorm:"size:20"`
+	ExitReason   string     `json:"exit_reason" gorm:"size:20"`  // exit, signal, oom-killed, start-failed
+	StartedBy    string     `json:"started_by" gorm:"size:40"`   // ldap用户, auto-retry, gosuv
+	StartReason  string     `json:"start_reason" gorm:"size:200"`
+	StoppedBy    string     `json:"stopped_by" gorm:"size:40"`   // 进程自己退出时为空
+	StopReason   string     `json:"stop_reason" gorm:"size:200"` // 退出的原因, 或者启动失败的错误
+}
+
+// 操作者和原因
+type runTrigger struct {
+	User   string
+	Reason string
+}
+
+//
+// 记录操作者之后再执行FSM的事件, 例如: OperateBy(StopEvent, ldapUser, "stop")
+// 重启时同时记录停止和启动的操作者
+//
+func (p *Process) OperateBy(event FSMEvent, user string, reason string) FSMState {
+	trigger := runTrigger{User: user, Reason: reason}
+	p.journalMu.Lock()
+	switch event {
+	case StartEvent:
+		p.startTrigger = trigger
+	case StopEvent:
+		p.stopTrigger = trigger
+	case RestartEvent:
+		p.startTrigger, p.stopTrigger = trigger, trigger
+	}
+	p.journalMu.Unlock()
+	return p.Operate(event)
+}
+
+// 平滑重启时, 新的进程沿用旧进程的启动操作者
+func (p *Process) takeStartTrigger() runTrigger {
+	p.journalMu.Lock()
+	defer p.journalMu.Unlock()
+	trigger := p.startTrigger
+	p.startTrigger = runTrigger{}
+	return trigger
+}
+
+// 由gosuv停止(例如: 删除Program, 减少进程数)时, 没有记录操作者
+func (p *Process) defaultStopTrigger() {
+	p.journalMu.Lock()
+	defer p.journalMu.Unlock()
+	if p.stopTrigger.User == "" {
+		p.stopTrigger = runTrigger{User: TriggerGosuv, Reason: "stop"}
+	}
+}
+
+// 开始一次运行(startCommand中调用), 没有记录操作者时为gosuv
+func (p *Process) beginRun(pid int, startErr error) {
+	p.journalMu.Lock()
+	trigger := p.startTrigger
+	p.startTrigger, p.stopTrigger = runTrigger{}, runTrigger{}
+	p.journalMu.Unlock()
+	if trigger.User == "" {
+		trigger = runTrigger{User: TriggerGosuv, Reason: "start"}
+	}
+
+	run := &ProcessRun{
+		ProgramName:  p.Program.Name,
+		ProcessIndex: p.Index,
+		ProcessName:  p.ProcessName,
+		Pid:          pid,
+		StartedAt:    time.Now(),
+		StartedBy:    trigger.User,
+		StartReason:  trigger.Reason,
+	}
+	if startErr != nil {
+		now := run.StartedAt
+		run.StoppedAt = &now
+		run.ExitCode = -1
+		run.ExitReason = ExitReasonStartFailed
+		run.StopReason = startErr.Error()
+	} else {
+		p.journalMu.Lock()
+		p.run = run
+		p.journalMu.Unlock()
+	}
+	p.Program.addHistory(run)
+	gRunJournal.Save(run, startErr != nil)
+}
+
+// 结束当前的运行(recordExitStatus中调用)
+func (p *Process) endRun() {
+	p.journalMu.Lock()
+	run, trigger := p.run, p.stopTrigger
+	p.run, p.stopTrigger = nil, runTrigger{}
+	p.journalMu.Unlock()
+	if run == nil {
+		return
+	}
+
+	p.Program.historyMu.Lock()
+	now := time.Now()
+	run.StoppedAt = &now
+	run.Duration = now.Sub(run.StartedAt).Seconds()
+	run.ExitCode, run.ExitSignal, run.ExitReason = p.ExitCode, p.ExitSignal, p.ExitReason
+	run.StoppedBy, run.StopReason = trigger.User, trigger.Reason
+	if run.StopReason == "" {
+		run.StopReason = exitDescription(p.ExitCode, p.ExitSignal, p.ExitReason)
+	}
+	p.Program.historyMu.Unlock()
+	gRunJournal.Save(run, true)
+}
+
+// 进程退出的描述, 例如: exit code 1, signal killed
+func exitDescription(exitCode int, exitSignal string, exitReason string) string {
+	switch exitReason {
+	case ExitReasonOomKilled:
+		return "oom killed"
+	case ExitReasonSignal:
+		return "signal " + exitSignal
+	}
+	return fmt.Sprintf("exit code %d", exitCode)
+}
+
+func (p *ProgramEx) addHistory(run *ProcessRun) {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	if p.history == nil {
+		p.history = make(map[int][]*ProcessRun)
+	}
+	runs := append(p.history[run.ProcessIndex], run)
+	if len(runs) > MaxProcessRuns {
+		runs = runs[len(runs)-MaxProcessRuns:]
+	}
+	p.history[run.ProcessIndex] = runs
+}
+
+//
+// 第index个进程最近的运行记录, 最新的在前
+// 平滑重启时新旧进程的index相同, 所以按照index而不是Process记录
+//
+func (p *ProgramEx) History(index int) []ProcessRun {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	runs := p.history[index]
+	result := make([]ProcessRun, 0, len(runs))
+	for i := len(runs) - 1; i >= 0; i-- {
+		result = append(result, *runs[i])
+	}
+	return result
+}
+
+// 运行记录的持久化, 没有配置数据库时(例如: 测试)为nil
+var gRunJournal *RunJournal
+
+type journalWrite struct {
+	run      *ProcessRun // 用于关联数据库中的ID
+	record   ProcessRun  // 写入时的快照
+	finished bool
+}
+
+//
+// 在单独的goroutine中将运行记录写入数据库, 避免数据库的延迟影响进程的启停
+//
+type RunJournal struct {
+	host   string
+	db     func() *gorm.DB // 数据库不可用(降级模式)时返回nil
+	writes chan journalWrite
+}
+
+func NewRunJournal(host string, db func() *gorm.DB) *RunJournal {
+	j := &RunJournal{
+		host:   host,
+		db:     db,
+		writes: make(chan journalWrite, 1000),
+	}
+	go j.loop()
+	return j
+}
+
+// 异步保存; finished: 运行已经结束, 不会再修改
+func (j *RunJournal) Save(run *ProcessRun, finished bool) {
+	if j == nil {
+		return
+	}
+	w := journalWrite{run: run, record: *run, finished: finished}
+	w.record.Host = j.host
+	select {
+	case j.writes <- w:
+	default:
+		log.Warnf("Run journal queue full, drop: %s", run.ProcessName)
+	}
+}
+
+func (j *RunJournal) loop() {
+	ids := make(map[*ProcessRun]uint)
+	for w := range j.writes {
+		db := j.db()
+		if db == nil {
+			log.Warnf("Database unavailable, drop run journal: %s", w.record.ProcessName)
+			if w.finished {
+				delete(ids, w.run)
+			}
+			continue
+		}
+
+		var err error
+		record := w.record
+		record.ID = ids[w.run]
+		if record.ID == 0 {
+			err = db.Create(&record).Error
+		} else {
+			err = db.Save(&record).Error
+		}
+		if err != nil {
+			log.ErrorErrorf(err, "Save run journal failed: %s", record.ProcessName)
+		} else if w.finished {
+			j.trim(db, &record)
+		} else {
+			ids[w.run] = record.ID
+		}
+		if w.finished {
+			delete(ids, w.run)
+		}
+	}
+}
+
+// 每个进程只保留最近的MaxProcessRuns条记录
+func (j *RunJournal) trim(db *gorm.DB, run *ProcessRun) {
+	var ids []uint
+	db.Model(&ProcessRun{}).
+		Where("host = ? AND program_name = ? AND process_index = ?", run.Host, run.ProgramName, run.ProcessIndex).
+		Order("id desc").Offset(MaxProcessRuns).Limit(1).Pluck("id", &ids)
+	if len(ids) > 0 {
+		db.Where("host = ? AND program_name = ? AND process_index = ? AND id <= ?",
+			run.Host, run.ProgramName, run.ProcessIndex, ids[0]).Delete(&ProcessRun{})
+	}
+}
+
+// 从数据库读取before之前的运行记录(例如: gosuv重启之前的), 最新的在前
+func (j *RunJournal) History(programName string, index int, before time.Time, limit int) ([]ProcessRun, error) {
+	var runs []ProcessRun
+	if j == nil || limit <= 0 {
+		return runs, nil
+	}
+	db := j.db()
+	if db == nil {
+		return nil, errDatabaseUnavailable
+	}
+	err := db.Where("host = ? AND program_name = ? AND process_index = ? AND started_at < ?",
+		j.host, programName, index, before).Order("started_at desc").Limit(limit).Find(&runs).Error
+	return runs, err
+}
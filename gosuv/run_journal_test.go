@@ -0,0 +1,51 @@
+package gosuv
+
+import (
+	"errors"
+	"testing"
+)
+
+// go test gosuv -v -run "TestProcessRunJournal"
+func TestProcessRunJournal(t *testing.T) {
+	program := &ProgramEx{Program: &Program{Name: "job"}}
+	p := &Process{FSM: NewFSM(Stopped), ProcessName: "job_000", Program: program}
+
+	// 1. 用户启动, 自己退出
+	p.OperateBy(StartEvent, "alice", "start")
+	p.beginRun(100, nil)
+	p.ExitCode, p.ExitSignal, p.ExitReason = 1, "", ExitReasonExit
+	p.endRun()
+
+	// 2. 自动重试, 被用户停止
+	p.startTrigger = runTrigger{User: TriggerAutoRetry, Reason: "retry after exit code 1"}
+	p.beginRun(101, nil)
+	p.OperateBy(StopEvent, "bob", "stop")
+	p.ExitCode, p.ExitSignal, p.ExitReason = -1, "terminated", ExitReasonSignal
+	p.endRun()
+
+	// 3. 启动失败
+	p.beginRun(0, errors.New("exec: not found"))
+
+	runs := program.History(0)
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 runs, got %d", len(runs))
+	}
+
+	if r := runs[2]; r.Pid != 100 || r.StartedBy != "alice" || r.StoppedBy != "" || r.StopReason != "exit code 1" || r.StoppedAt == nil {
+		t.Errorf("unexpected first run: %+v", r)
+	}
+	if r := runs[1]; r.Pid != 101 || r.StartedBy != TriggerAutoRetry || r.StoppedBy != "bob" || r.ExitSignal != "terminated" {
+		t.Errorf("unexpected second run: %+v", r)
+	}
+	if r := runs[0]; r.StartedBy != TriggerGosuv || r.ExitReason != ExitReasonStartFailed || r.StopReason != "exec: not found" {
+		t.Errorf("unexpected third run: %+v", r)
+	}
+
+	for i := 0; i < MaxProcessRuns; i++ {
+		p.beginRun(200+i, nil)
+		p.endRun()
+	}
+	if runs := program.History(0); len(runs) != MaxProcessRuns || runs[0].Pid != 200+MaxProcessRuns-1 {
+		t.Errorf("expected %d runs, newest first, got %d", MaxProcessRuns, len(runs))
+	}
+}
@@ -0,0 +1,345 @@
+package gosuv
+
+import (
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 定时任务的并发策略: 上一次运行还没有结束时如何处理
+const (
+	ConcurrencySkip    = "skip"    // 跳过本次运行(默认)
+	ConcurrencyQueue   = "queue"   // 等上一次运行结束之后再运行(最多排队一次)
+	ConcurrencyReplace = "replace" // 停止上一次运行, 然后重新运行
+)
+
+// 定时任务运行的状态
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunSkipped   = "skipped"
+	RunReplaced  = "replaced"
+)
+
+// 每个Program保留的最近的运行记录数
+const MaxScheduledRuns = 50
+
+// 定时任务的一次运行
+type ScheduledRun struct {
+	ProcessName string     `json:"process_name"`
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	Duration    float64    `json:"duration"` // 运行时间(s)
+	ExitCode    int        `json:"exit_code"`
+	ExitReason  string     `json:"exit_reason"`
+	Status      string     `json:"status"`
+}
+
+// 是否是定时任务
+func (p *Program) IsScheduled() bool {
+	return p.Schedule != ""
+}
+
+func (p *Program) checkSchedule() error {
+	if !p.IsScheduled() {
+		return nil
+	}
+	if _, err := ParseCron(p.Schedule); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(p.ScheduleTimezone); err != nil {
+		return fmt.Errorf("Invalid schedule timezone: %s", p.ScheduleTimezone)
+	}
+	if p.ScheduleJitter < 0 {
+		return fmt.Errorf("Schedule jitter should not be negative")
+	}
+	switch p.ConcurrencyPolicy {
+	case "", ConcurrencySkip, ConcurrencyQueue, ConcurrencyReplace:
+	default:
+		return fmt.Errorf("Invalid concurrency policy: %s", p.ConcurrencyPolicy)
+	}
+	return nil
+}
+
+// 计算下一次运行的时间(不包括jitter)
+func (p *Program) NextScheduleTime(now time.Time) (time.Time, error) {
+	schedule, err := ParseCron(p.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// 空字符串表示UTC, 需要使用本地时区
+	loc := time.Local
+	if p.ScheduleTimezone != "" {
+		if loc, err = time.LoadLocation(p.ScheduleTimezone); err != nil {
+			return time.Time{}, err
+		}
+	}
+	next := schedule.Next(now.In(loc))
+	if next.IsZero() {
+		return next, fmt.Errorf("No next schedule time: %s", p.Schedule)
+	}
+	return next, nil
+}
+
+func (p *ProgramEx) addRun(run *ScheduledRun) {
+	p.runsMu.Lock()
+	defer p.runsMu.Unlock()
+	p.runs = append(p.runs, run)
+	if len(p.runs) > MaxScheduledRuns {
+		p.runs = p.runs[len(p.runs)-MaxScheduledRuns:]
+	}
+}
+
+// 最近的运行记录, 最新的在前
+func (p *ProgramEx) Runs() []ScheduledRun {
+	p.runsMu.Lock()
+	defer p.runsMu.Unlock()
+	runs := make([]ScheduledRun, 0, len(p.runs))
+	for i := len(p.runs) - 1; i >= 0; i-- {
+		runs = append(runs, *p.runs[i])
+	}
+	return runs
+}
+
+// 进程还没有结束的运行记录
+func (p *ProgramEx) openRun(processName string) *ScheduledRun {
+	for i := len(p.runs) - 1; i >= 0; i-- {
+		if p.runs[i].ProcessName == processName && p.runs[i].FinishedAt == nil {
+			return p.runs[i]
+		}
+	}
+	return nil
+}
+
+// 进程退出时记录运行结果(在recordExitStatus中调用)
+func (p *ProgramEx) finishRun(process *Process) {
+	p.runsMu.Lock()
+	defer p.runsMu.Unlock()
+	run := p.openRun(process.ProcessName)
+	if run == nil {
+		return
+	}
+
+	now := time.Now()
+	run.FinishedAt = &now
+	run.Duration = now.Sub(run.StartedAt).Seconds()
+	run.ExitCode = process.ExitCode
+	run.ExitReason = process.ExitReason
+	if run.Status == RunRunning {
+		if p.IsExpectedExit(process.ExitCode) {
+			run.Status = RunSucceeded
+		} else {
+			run.Status = RunFailed
+		}
+	}
+}
+
+func (p *ProgramEx) markRunReplaced(process *Process) {
+	p.runsMu.Lock()
+	defer p.runsMu.Unlock()
+	if run := p.openRun(process.ProcessName); run != nil {
+		run.Status = RunReplaced
+	}
+}
+
+// 启动一次运行
+func (p *ProgramEx) startRun(opUser string, process *Process, scheduledAt time.Time) {
+	p.Merger.WriteStrLine(fmt.Sprintf("GOSUV: scheduled run: %s, scheduled at: %s\n",
+		process.ProcessName, scheduledAt.Format(time.RFC3339)))
+	p.addRun(&ScheduledRun{
+		ProcessName: process.ProcessName,
+		ScheduledAt: scheduledAt,
+		StartedAt:   time.Now(),
+		Status:      RunRunning,
+	})
+	process.OperateBy(StartEvent, opUser, "schedule")
+
+	// 启动失败(例如: 命令有问题)时进程直接变为Fatal, 不会调用recordExitStatus
+	if process.State() == Fatal {
+		process.ExitCode, process.ExitReason = -1, ""
+		p.finishRun(process)
+	}
+}
+
+//
+// 等待进程停止, 超时返回false
+// 等待重试(RetryWait)的进程不会自己停止, 需要通过stopC取消重试
+//
+func waitProcessStopped(process *Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !process.IsStopped() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		if process.State() == RetryWait {
+			select {
+			case process.stopC <- syscall.SIGTERM:
+			case <-time.After(200 * time.Millisecond):
+			}
+			continue
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return true
+}
+
+// 停止进程最多需要的时间: 所有停止步骤的等待时间
+func (p *Program) stopWaitTimeout() time.Duration {
+	timeout := 5 * time.Second
+	for _, step := range p.StopSteps() {
+		timeout += step.Wait
+	}
+	return timeout
+}
+
+// 记录跳过的运行
+func (p *ProgramEx) skipRun(process *Process, scheduledAt time.Time) {
+	now := time.Now()
+	p.addRun(&ScheduledRun{
+		ProcessName: process.ProcessName,
+		ScheduledAt: scheduledAt,
+		StartedAt:   now,
+		FinishedAt:  &now,
+		ExitCode:    -1,
+		Status:      RunSkipped,
+	})
+}
+
+//
+// 运行定时任务的所有进程, 上一次运行还没有结束时按照并发策略处理
+//
+func (p *ProgramEx) runScheduled(opUser string, scheduledAt time.Time) {
+	processes := make([]*Process, 0, p.ProcessNum)
+	for _, process := range p.processList() {
+		if process != nil {
+			processes = append(processes, process)
+		}
+	}
+
+	for _, process := range processes {
+		if process.IsStopped() {
+			p.startRun(opUser, process, scheduledAt)
+			continue
+		}
+
+		switch p.ConcurrencyPolicy {
+		case ConcurrencyQueue:
+			// 最多排队一次
+			// 最多等到下一次调度, 之后重新排队
+			timeout := time.Hour
+			if next, err := p.NextScheduleTime(scheduledAt); err == nil {
+				timeout = next.Sub(time.Now())
+			}
+			if process.queued.CompareAndSwap(false, true) {
+				log.Printf("Scheduled run queued: %s", process.ProcessName)
+				go func(process *Process) {
+					stopped := waitProcessStopped(process, timeout)
+					process.queued.Set(false)
+					if !stopped {
+						log.Printf("Scheduled run skipped: %s, still %s after %v", process.ProcessName, process.State(), timeout)
+						p.skipRun(process, scheduledAt)
+						return
+					}
+					p.startRun(opUser, process, scheduledAt)
+				}(process)
+			}
+		case ConcurrencyReplace:
+			log.Printf("Scheduled run replace: %s", process.ProcessName)
+			p.markRunReplaced(process)
+			go func(process *Process) {
+				process.OperateBy(StopEvent, opUser, "replaced by scheduled run")
+				if !waitProcessStopped(process, p.stopWaitTimeout()) {
+					log.Warnf("Scheduled run skipped: %s, stop timeout, still %s", process.ProcessName, process.State())
+					p.skipRun(process, scheduledAt)
+					return
+				}
+				p.startRun(opUser, process, scheduledAt)
+			}(process)
+		default:
+			log.Printf("Scheduled run skipped: %s, still %s", process.ProcessName, process.State())
+			p.skipRun(process, scheduledAt)
+		}
+	}
+}
+
+//
+// 定时任务的调度: 每个定时任务一个goroutine, 到点之后通过FSM启动进程
+// Program的StartAuto为false(在页面上停止)时暂停调度
+//
+type Scheduler struct {
+	mu    sync.Mutex
+	stops map[string]chan struct{}
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{stops: make(map[string]chan struct{})}
+}
+
+// 添加或者修改Program之后调用, 重新计算调度
+func (s *Scheduler) Update(program *ProgramEx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stop, ok := s.stops[program.Name]; ok {
+		close(stop)
+		delete(s.stops, program.Name)
+	}
+	if !program.IsScheduled() {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stops[program.Name] = stop
+	go s.run(program, program.Schedule, stop)
+}
+
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.stops[name]; ok {
+		close(stop)
+		delete(s.stops, name)
+	}
+}
+
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, stop := range s.stops {
+		close(stop)
+		delete(s.stops, name)
+	}
+}
+
+func (s *Scheduler) run(program *ProgramEx, schedule string, stop chan struct{}) {
+	log.Printf("Schedule program: %s, %s", program.Name, schedule)
+	for {
+		now := time.Now()
+		next, err := program.NextScheduleTime(now)
+		if err != nil {
+			log.Warnf("Schedule program %s failed: %v", program.Name, err)
+			return
+		}
+
+		delay := next.Sub(now)
+		if program.ScheduleJitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(program.ScheduleJitter)*int64(time.Second) + 1))
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if !program.StartAuto {
+			log.Printf("Schedule program %s paused, skip run at: %v", program.Name, next)
+			continue
+		}
+		program.runScheduled(TriggerGosuv, next)
+	}
+}
@@ -0,0 +1,251 @@
+package gosuv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// 环境变量中的密码使用引用, 在启动进程之前才解析, 数据库和API中只保存引用:
+//   DB_PASS=secret://file/db            读取secrets_dir目录下的文件的内容
+//   DB_PASS=secret://env/DB_PASS        读取gosuv自己的环境变量(只能读取secret_env中的变量)
+//   DB_PASS=secret://sealed/<base64>    使用supervisor的密钥(secret_key_file)解密
+//
+const (
+	SecretPrefix       = "secret://"
+	secretSchemeFile   = "file"
+	secretSchemeEnv    = "env"
+	secretSchemeSealed = "sealed"
+)
+
+// supervisor的密钥(AES-256), 通过配置文件中的 secret_key_file 读取
+var gSecretKey []byte
+
+var ErrNoSecretKey = errors.New("secret key not configured")
+
+// secret://file/的目录, 通过配置文件中的 secrets_dir 设置, 没有设置时不能使用
+var gSecretsDir string
+
+// secret://env/允许读取的环境变量, 通过配置文件中的 secret_env 设置
+var gSecretEnv []string
+
+var ErrNoSecretsDir = errors.New("secrets dir not configured")
+
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+// 读取密钥文件: 64个字符的hex, 例如: openssl rand -hex 32 > /etc/gosuv/secret.key
+func ReadSecretKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid secret key: %s, expect 64 hex characters", path)
+	}
+	return key, nil
+}
+
+// 使用supervisor的密钥加密, 返回 secret://sealed/<base64>
+func SealSecret(plaintext string) (string, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return SecretPrefix + secretSchemeSealed + "/" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func openSealedSecret(value string) (string, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid sealed secret")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("decrypt sealed secret failed")
+	}
+	return string(plaintext), nil
+}
+
+func newSecretCipher() (cipher.AEAD, error) {
+	if len(gSecretKey) == 0 {
+		return nil, ErrNoSecretKey
+	}
+	block, err := aes.NewCipher(gSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 拆分密码引用, 例如: secret://file/mysql/db --> file, mysql/db
+func parseSecretRef(ref string) (scheme string, name string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(ref, SecretPrefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid secret reference: %s", ref)
+	}
+	switch parts[0] {
+	case secretSchemeFile:
+		for _, elem := range strings.Split(parts[1], "/") {
+			if elem == ".." {
+				return "", "", fmt.Errorf("Invalid secret file: %s", parts[1])
+			}
+		}
+		return parts[0], parts[1], nil
+	case secretSchemeEnv, secretSchemeSealed:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("Unknown secret scheme: %s", parts[0])
+}
+
+// 解析一个密码引用
+func ResolveSecret(ref string) (string, error) {
+	scheme, name, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	switch scheme {
+	case secretSchemeFile:
+		return readSecretFile(name)
+	case secretSchemeEnv:
+		if !secretEnvAllowed(name) {
+			return "", fmt.Errorf("secret env %s not allowed, see: secret_env", name)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret env %s not set", name)
+		}
+		return value, nil
+	default:
+		return openSealedSecret(name)
+	}
+}
+
+//
+// 读取secrets_dir目录下的文件(相对路径), 不能通过..或者符号链接读取目录之外的文件
+//
+func readSecretFile(name string) (string, error) {
+	if len(gSecretsDir) == 0 {
+		return "", ErrNoSecretsDir
+	}
+	dir, err := filepath.EvalSymlinks(gSecretsDir)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.Clean("/"+name)))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("secret file %s is outside of secrets dir", name)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func secretEnvAllowed(name string) bool {
+	for _, allowed := range gSecretEnv {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查密码引用的格式(不读取内容)
+func (p *Program) checkSecrets() error {
+	for _, env := range p.Environ {
+		if i := strings.IndexByte(env, '='); i > 0 && IsSecretRef(env[i+1:]) {
+			if _, _, err := parseSecretRef(env[i+1:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 在exec之前解析环境变量中的密码引用
+func ResolveSecrets(env []string) ([]string, error) {
+	resolved := make([]string, 0, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 && IsSecretRef(kv[i+1:]) {
+			value, err := ResolveSecret(kv[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("resolve secret %s failed: %v", kv[:i], err)
+			}
+			kv = kv[:i+1] + value
+		}
+		resolved = append(resolved, kv)
+	}
+	return resolved, nil
+}
+
+//
+// Program中的环境变量, 序列化成JSON时隐藏看起来像密码的明文
+// 密码引用(secret://)本身不是密码, 原样返回
+//
+type EnvironList []string
+
+func (l EnvironList) MarshalJSON() ([]byte, error) {
+	if l == nil {
+		return []byte("null"), nil
+	}
+	masked := make([]string, 0, len(l))
+	for _, kv := range l {
+		if i := strings.IndexByte(kv, '='); i > 0 && IsSecretEnvKey(kv[:i]) && !IsSecretRef(kv[i+1:]) {
+			kv = kv[:i+1] + maskedEnvValue
+		}
+		masked = append(masked, kv)
+	}
+	return json.Marshal(masked)
+}
+
+// 通过API修改Program时, 被隐藏的值(******)保持原来的值
+func mergeMaskedEnviron(oldEnviron EnvironList, newEnviron EnvironList) EnvironList {
+	if newEnviron == nil {
+		return nil
+	}
+	oldValues := map[string]string{}
+	for _, kv := range oldEnviron {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			oldValues[kv[:i]] = kv
+		}
+	}
+	merged := make(EnvironList, 0, len(newEnviron))
+	for _, kv := range newEnviron {
+		if i := strings.IndexByte(kv, '='); i > 0 && kv[i+1:] == maskedEnvValue {
+			if old, ok := oldValues[kv[:i]]; ok {
+				kv = old
+			}
+		}
+		merged = append(merged, kv)
+	}
+	return merged
+}
@@ -0,0 +1,107 @@
+package gosuv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// go test gosuv -v -run "TestResolveSecrets"
+func TestResolveSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretsDir := filepath.Join(dir, "secrets")
+	os.Mkdir(secretsDir, 0700)
+	ioutil.WriteFile(filepath.Join(secretsDir, "db"), []byte("file-pass\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "outside"), []byte("outside-pass"), 0600)
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(secretsDir, "link"))
+	os.Symlink("db", filepath.Join(secretsDir, "inside_link"))
+
+	gSecretsDir = secretsDir
+	gSecretEnv = []string{"GOSUV_TEST_SECRET"}
+	defer func() { gSecretsDir, gSecretEnv = "", nil }()
+
+	os.Setenv("GOSUV_TEST_SECRET", "env-pass")
+	defer os.Unsetenv("GOSUV_TEST_SECRET")
+	os.Setenv("GOSUV_TEST_OTHER", "other-pass")
+	defer os.Unsetenv("GOSUV_TEST_OTHER")
+
+	gSecretKey = []byte(strings.Repeat("k", 32))
+	defer func() { gSecretKey = nil }()
+	sealed, err := SealSecret("sealed-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ResolveSecrets([]string{
+		"APP_ENV=prod",
+		"DB_PASS=secret://file/db",
+		"DB_PASS2=secret://file/inside_link",
+		"API_TOKEN=secret://env/GOSUV_TEST_SECRET",
+		"REDIS_PASS=" + sealed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"APP_ENV=prod", "DB_PASS=file-pass", "DB_PASS2=file-pass", "API_TOKEN=env-pass", "REDIS_PASS=sealed-pass"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected %v, got %v", expected, env)
+	}
+
+	rejected := []string{
+		"secret://foo/bar",
+		"secret://file/",
+		"secret://file/../outside",
+		"secret://file/a/../../outside",
+		"secret://file/link",
+		"secret://file/not_exists",
+		"secret://file" + filepath.Join(dir, "outside"),
+		"secret://env/GOSUV_TEST_OTHER",
+		"secret://env/GOSUV_NO_SUCH_ENV",
+		"secret://sealed/abc",
+	}
+	for _, ref := range rejected {
+		if value, err := ResolveSecret(ref); err == nil {
+			t.Errorf("%s should be rejected, got %s", ref, value)
+		}
+	}
+
+	// 没有配置secrets_dir时不能读取文件
+	gSecretsDir = ""
+	if _, err := ResolveSecret("secret://file/db"); err != ErrNoSecretsDir {
+		t.Errorf("expected %v, got %v", ErrNoSecretsDir, err)
+	}
+	if (&Program{Environ: EnvironList{"DB_PASS=secret://file/../db"}}).checkSecrets() == nil {
+		t.Errorf("secret file with .. should be rejected")
+	}
+}
+
+// go test gosuv -v -run "TestEnvironListJSON"
+func TestEnvironListJSON(t *testing.T) {
+	p := &Program{Name: "worker", Environ: EnvironList{"APP_ENV=prod", "DB_PASSWORD=plain", "DB_PASS=secret://file/db"}}
+	data, _ := json.Marshal(p)
+	if strings.Contains(string(data), "plain") {
+		t.Errorf("plaintext exposed: %s", data)
+	}
+
+	// 数据库中保存原始值
+	p.Encode()
+	if !strings.Contains(p.EnvironDb, "plain") {
+		t.Errorf("environ_db should keep the original value: %s", p.EnvironDb)
+	}
+
+	// 修改时被隐藏的值保持不变
+	var newProgram Program
+	json.Unmarshal(data, &newProgram)
+	merged := mergeMaskedEnviron(p.Environ, newProgram.Environ)
+	if !reflect.DeepEqual(merged, p.Environ) {
+		t.Errorf("expected %v, got %v", p.Environ, merged)
+	}
+}
@@ -0,0 +1,126 @@
+package gosuv
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrUnterminatedQuote = errors.New("unterminated quoted string")
+var ErrTrailingBackslash = errors.New("trailing backslash")
+
+// 环境变量的赋值, 例如: SENTRY_CONF=/etc/sentry
+var envAssignPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// 一个word, 以及它在原始字符串中的位置
+type shellWord struct {
+	Value string
+	Start int
+	End   int
+}
+
+//
+// 按照POSIX shell的规则拆分命令行:
+//   1. 空白字符分隔
+//   2. 单引号内的字符原样保留
+//   3. 双引号内支持 \" \\ \$ \` 转义
+//   4. 引号外的 \ 转义下一个字符
+// 不支持变量展开, 通配符, 管道等语法(需要这些功能时使用shell运行)
+//
+func splitShellWords(line string) ([]shellWord, error) {
+	// 特殊字符都是ASCII, 按照byte处理不会破坏UTF-8字符
+	var words []shellWord
+	var buf []byte
+	inWord := false
+	start := 0
+
+	beginWord := func(i int) {
+		if !inWord {
+			inWord = true
+			start = i
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch c {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, shellWord{Value: string(buf), Start: start, End: i})
+				buf = buf[:0]
+				inWord = false
+			}
+		case '\\':
+			if i+1 >= len(line) {
+				return nil, ErrTrailingBackslash
+			}
+			i++
+			// 行连接: 直接忽略
+			if line[i] != '\n' {
+				beginWord(i - 1)
+				buf = append(buf, line[i])
+			}
+		case '\'':
+			beginWord(i)
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, ErrUnterminatedQuote
+			}
+			buf = append(buf, line[i+1:i+1+end]...)
+			i += end + 1
+		case '"':
+			beginWord(i)
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`\n", line[i+1]) >= 0 {
+					i++
+					if line[i] == '\n' {
+						continue
+					}
+				}
+				buf = append(buf, line[i])
+			}
+			if i >= len(line) {
+				return nil, ErrUnterminatedQuote
+			}
+		default:
+			beginWord(i)
+			buf = append(buf, c)
+		}
+	}
+	if inWord {
+		words = append(words, shellWord{Value: string(buf), Start: start, End: len(line)})
+	}
+	return words, nil
+}
+
+// 拆分命令行, 例如: `php -r "echo 'a b';"` --> ["php", "-r", "echo 'a b';"]
+func SplitCommand(line string) ([]string, error) {
+	words, err := splitShellWords(line)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, len(words))
+	for _, word := range words {
+		args = append(args, word.Value)
+	}
+	return args, nil
+}
+
+// 将参数转义之后拼接成shell命令行
+func JoinCommand(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, QuoteShellWord(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// 必要时使用单引号转义
+func QuoteShellWord(word string) string {
+	if len(word) > 0 && strings.IndexFunc(word, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,@%+", r))
+	}) == -1 {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,56 @@
+package gosuv
+
+import (
+	"reflect"
+	"testing"
+)
+
+// go test gosuv -v -run "TestSplitCommand"
+func TestSplitCommand(t *testing.T) {
+	cases := map[string][]string{
+		"/usr/bin/php  a.php --env=prod":    {"/usr/bin/php", "a.php", "--env=prod"},
+		`php -r "echo 'a b';"`:              {"php", "-r", "echo 'a b';"},
+		`echo 'it'\''s' "a\"b" c\ d`:        {"echo", "it's", `a"b`, "c d"},
+		`echo "" ''`:                        {"echo", "", ""},
+		"echo a \\\n  b":                    {"echo", "a", "b"},
+		`echo "\$HOME" '$HOME' "\n"`:        {"echo", "$HOME", "$HOME", `\n`},
+		`SENTRY_CONF="/etc/a b" sentry run`: {"SENTRY_CONF=/etc/a b", "sentry", "run"},
+		"  ":                                {},
+	}
+	for line, expected := range cases {
+		args, err := SplitCommand(line)
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Errorf("%q: expected %q, got %q, %v", line, expected, args, err)
+		}
+	}
+
+	for _, line := range []string{`echo "abc`, `echo 'abc`, `echo abc\`} {
+		if _, err := SplitCommand(line); err == nil {
+			t.Errorf("%q should be rejected", line)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestJoinCommand"
+func TestJoinCommand(t *testing.T) {
+	args := []string{"php", "-r", "echo 'a b';", "", "--id=1"}
+	line := JoinCommand(args)
+	if line != `php -r 'echo '\''a b'\'';' '' --id=1` {
+		t.Errorf("unexpected command: %s", line)
+	}
+	newArgs, err := SplitCommand(line)
+	if err != nil || !reflect.DeepEqual(newArgs, args) {
+		t.Errorf("expected %q, got %q, %v", args, newArgs, err)
+	}
+}
+
+// go test gosuv -v -run "TestPreprocessQuotedCommand"
+func TestPreprocessQuotedCommand(t *testing.T) {
+	newCmd, kvs := PreprocessCommand(`A=1 B="x y" php -r "echo 'a=b';"`)
+	if newCmd != `php -r "echo 'a=b';"` {
+		t.Errorf("unexpected command: %s", newCmd)
+	}
+	if !reflect.DeepEqual(kvs, []string{"A=1", "B=x y"}) {
+		t.Errorf("unexpected envs: %q", kvs)
+	}
+}
@@ -0,0 +1,155 @@
+package gosuv
+
+import (
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 允许通过Api发送的信号
+var name2Signal = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// 解析信号: 支持 HUP, SIGHUP, sighup 以及数字 1
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if num, err := strconv.Atoi(name); err == nil {
+		for _, sig := range name2Signal {
+			if int(sig) == num {
+				return sig, nil
+			}
+		}
+		return 0, fmt.Errorf("Unsupported signal: %s", name)
+	}
+
+	name = strings.TrimPrefix(name, "SIG")
+	if sig, ok := name2Signal[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unsupported signal: %s", name)
+}
+
+// 停止进程的一个步骤: 发送信号，然后最多等待Wait
+type StopStep struct {
+	Signal syscall.Signal
+	Wait   time.Duration
+}
+
+//
+// 解析停止序列, 例如: "INT:10,TERM:10,KILL"
+// 表示先发送SIGINT, 10s之后没有退出则发送SIGTERM, 再过10s发送SIGKILL
+// 没有指定等待时间的步骤，等待defaultWait
+//
+func ParseStopSequence(sequence string, defaultWait time.Duration) ([]StopStep, error) {
+	var steps []StopStep
+	for _, field := range strings.Split(sequence, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(field, ":", 2)
+		sig, err := ParseSignal(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		step := StopStep{Signal: sig, Wait: defaultWait}
+		if len(parts) == 2 {
+			seconds, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("Invalid stop sequence wait time: %s", field)
+			}
+			step.Wait = time.Duration(seconds) * time.Second
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func (p *Program) checkStopSignal() error {
+	if p.StopSignal != "" {
+		if _, err := ParseSignal(p.StopSignal); err != nil {
+			return err
+		}
+	}
+	_, err := ParseStopSequence(p.StopSequence, 0)
+	return err
+}
+
+//
+// 停止进程的步骤: 优先使用StopSequence, 否则发送StopSignal(默认SIGTERM)并等待StopTimeout
+// 最后总是SIGKILL
+//
+func (p *Program) StopSteps() []StopStep {
+	stopTimeout := time.Duration(p.StopTimeout) * time.Second
+	steps, err := ParseStopSequence(p.StopSequence, stopTimeout)
+	if err != nil || len(steps) == 0 {
+		sig, err := ParseSignal(p.StopSignal)
+		if err != nil {
+			sig = syscall.SIGTERM
+		}
+		steps = []StopStep{{Signal: sig, Wait: stopTimeout}}
+	}
+	if steps[len(steps)-1].Signal != syscall.SIGKILL {
+		steps = append(steps, StopStep{Signal: syscall.SIGKILL})
+	}
+	return steps
+}
+
+// 给进程组发送信号
+func (p *Process) Signal(sig syscall.Signal) error {
+	cmd := p.cmd
+	if cmd == nil || cmd.Process == nil {
+		return fmt.Errorf("Process %s is not running", p.ProcessName)
+	}
+	return cmd.Terminate(sig)
+}
+
+func (p *ProgramEx) SignalOne(opUser string, index int, sig syscall.Signal) error {
+	process := p.processAt(index)
+	if process == nil {
+		return fmt.Errorf("Invalid process index: %d", index)
+	}
+	log.Printf("操作: %s signal process: %s, index: %d, signal: %v", opUser, p.Name, index, sig)
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s signal process: %s, index: %d, signal: %v\n", opUser, p.Name, index, sig))
+
+	return process.Signal(sig)
+}
+
+// 给所有运行中的进程发送信号
+func (p *ProgramEx) SignalAll(opUser string, sig syscall.Signal) error {
+	processes := p.processList()
+	log.Printf("操作: %s signal all: %s --> %d, signal: %v", opUser, p.Name, len(processes), sig)
+	p.Merger.WriteStrLine(fmt.Sprintf("操作: %s signal all: %s --> %d, signal: %v\n", opUser, p.Name, len(processes), sig))
+
+	var lastErr error
+	signaled := 0
+	for _, process := range processes {
+		if process == nil {
+			continue
+		}
+		if err := process.Signal(sig); err != nil {
+			lastErr = err
+		} else {
+			signaled++
+		}
+	}
+	if signaled == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
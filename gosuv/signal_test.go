@@ -0,0 +1,66 @@
+package gosuv
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestParseSignal"
+func TestParseSignal(t *testing.T) {
+	cases := map[string]syscall.Signal{
+		"HUP":     syscall.SIGHUP,
+		"sighup":  syscall.SIGHUP,
+		"SIGUSR1": syscall.SIGUSR1,
+		"15":      syscall.SIGTERM,
+	}
+	for name, expected := range cases {
+		sig, err := ParseSignal(name)
+		if err != nil || sig != expected {
+			t.Errorf("%s: expected %v, got %v, %v", name, expected, sig, err)
+		}
+	}
+
+	for _, name := range []string{"", "FOO", "999"} {
+		if _, err := ParseSignal(name); err == nil {
+			t.Errorf("%s should be rejected", name)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestStopSteps"
+func TestStopSteps(t *testing.T) {
+	p := &Program{StopTimeout: 5}
+	steps := p.StopSteps()
+	if len(steps) != 2 || steps[0].Signal != syscall.SIGTERM || steps[0].Wait != 5*time.Second ||
+		steps[1].Signal != syscall.SIGKILL {
+		t.Errorf("default stop steps: %v", steps)
+	}
+
+	p.StopSignal = "QUIT"
+	steps = p.StopSteps()
+	if len(steps) != 2 || steps[0].Signal != syscall.SIGQUIT {
+		t.Errorf("stop signal steps: %v", steps)
+	}
+
+	p.StopSequence = "INT:10, TERM, KILL"
+	steps = p.StopSteps()
+	expected := []StopStep{
+		{syscall.SIGINT, 10 * time.Second},
+		{syscall.SIGTERM, 5 * time.Second},
+		{syscall.SIGKILL, 5 * time.Second},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("stop sequence steps: %v", steps)
+	}
+	for i := range expected {
+		if steps[i] != expected[i] {
+			t.Errorf("step %d: expected %v, got %v", i, expected[i], steps[i])
+		}
+	}
+
+	p.StopSequence = "INT:abc"
+	if p.checkStopSignal() == nil {
+		t.Errorf("invalid stop sequence should be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package gosuv
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"net/http"
+	"time"
+)
+
+// Program的存储方式
+const (
+	StoreMysql  = "mysql"
+	StoreSqlite = "sqlite3"
+	StoreYaml   = "yaml"
+)
+
+var (
+	errDatabaseNotConfigured = errors.New("Database not configured")
+	errDatabaseUnavailable   = errors.New("Database unavailable")
+)
+
+// 读写store失败(例如: 数据库连接断开), Api返回500; 其他错误(例如: 参数无效)仍然返回200
+type StoreError struct {
+	Op  string // 例如: add program web
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("Failed to %s: %v", e.Op, e.Err)
+}
+
+// 错误对应的http状态
+func errorHTTPStatus(err error) int {
+	if _, ok := err.(*StoreError); ok {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// yaml文件的检查间隔
+const storeWatchInterval = 2 * time.Second
+
+// 数据库(programs表)的检查间隔
+const dbWatchInterval = 5 * time.Second
+
+//
+// Program的存储, 所有的Program都属于当前的host
+//
+type ProgramStore interface {
+	List() ([]*Program, error)
+	Get(name string) (*Program, error) // 不存在时返回nil
+	Insert(program *Program) error     // 已经存在时更新
+	Update(program *Program) error
+	Delete(program *Program) error
+
+	// 其他人(例如: 手动编辑yaml文件, 其他gosuv修改programs表)修改之后发送通知, 不支持时返回nil
+	Watch(stop <-chan struct{}) <-chan struct{}
+}
+
+//
+// 存储方式: store.type, 默认根据db.db_type
+// 1. mysql, sqlite3: 保存在数据库的programs表中, db为Supervisor的连接池(没有配置数据库时为nil)
+// 2. yaml: 保存在store.path(默认: 配置文件目录下的programs.yml), 不需要数据库
+//
+func NewProgramStore(cfg *Configuration, db *gorm.DB, defaultPath string) (ProgramStore, error) {
+	storeType, err := programStoreType(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if storeType == StoreYaml {
+		path := cfg.Store.Path
+		if len(path) == 0 {
+			path = defaultPath
+		}
+		return NewYamlStore(path, cfg.Host), nil
+	}
+	if db == nil {
+		return nil, errDatabaseUnavailable
+	}
+	return NewGormStore(db, cfg.Host), nil
+}
+
+// 检查store的配置, 返回存储方式
+func programStoreType(cfg *Configuration) (string, error) {
+	storeType := cfg.Store.Type
+	if len(storeType) == 0 {
+		storeType = cfg.Db.DbType
+	}
+	if len(storeType) == 0 {
+		storeType = StoreYaml
+	}
+
+	switch storeType {
+	case StoreYaml:
+		return storeType, nil
+	case StoreMysql, StoreSqlite:
+		if storeType != cfg.Db.DbType || !cfg.HasDatabase() {
+			return "", fmt.Errorf("Store %s requires db.db_type: %s and db.db_dsn", storeType, storeType)
+		}
+		return storeType, nil
+	}
+	return "", fmt.Errorf("Invalid store type: %s, expected: mysql, sqlite3, yaml", storeType)
+}
+
+func sqlDriverRegistered(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有重复的名字, 重复时保留第一个
+func uniquePrograms(programs []*Program) []*Program {
+	result := make([]*Program, 0, len(programs))
+	visited := map[string]bool{}
+	for _, program := range programs {
+		if visited[program.Name] {
+			log.Errorf("Duplicated program name: %s", program.Name)
+			continue
+		}
+		visited[program.Name] = true
+		result = append(result, program)
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+package gosuv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"time"
+)
+
+//
+// 保存在数据库(mysql, sqlite3)中的Program
+//
+type GormStore struct {
+	db   *gorm.DB // Supervisor的连接池, 参考: OpenDB
+	host string
+}
+
+func NewGormStore(db *gorm.DB, host string) *GormStore {
+	return &GormStore{
+		db:   db,
+		host: host,
+	}
+}
+
+func (s *GormStore) List() ([]*Program, error) {
+	var programs []Program
+	if err := s.db.Where("host = ?", s.host).Find(&programs).Error; err != nil {
+		return nil, err
+	}
+	pgs := make([]*Program, 0, len(programs))
+	for index := range programs {
+		programs[index].Decode()
+		pgs = append(pgs, &programs[index])
+	}
+	return uniquePrograms(pgs), nil
+}
+
+func (s *GormStore) Get(name string) (*Program, error) {
+	var program Program
+	query := s.db.First(&program, "host = ? and name = ?", s.host, name)
+	if query.RecordNotFound() {
+		return nil, nil
+	} else if query.Error != nil {
+		return nil, query.Error
+	}
+	program.Decode()
+	return &program, nil
+}
+
+func (s *GormStore) Insert(program *Program) error {
+	return s.save(program)
+}
+
+// 按照名字更新: 内存中的ID可能是0(从快照加载), 或者已经过期(其他gosuv删除之后重新添加)
+func (s *GormStore) Update(program *Program) error {
+	return s.save(program)
+}
+
+// 按照host和name保存, 不使用内存中的ID
+func (s *GormStore) save(program *Program) error {
+	program.Encode()
+	program.Host = s.host
+
+	// 已经存在时(例如: 数据库中残留的记录)直接覆盖
+	var oldProgram Program
+	query := s.db.First(&oldProgram, "host = ? and name = ?", program.Host, program.Name)
+	if query.Error == nil {
+		program.ID = oldProgram.ID
+		program.Version = oldProgram.Version + 1
+		return s.db.Save(program).Error
+	} else if !query.RecordNotFound() {
+		return query.Error
+	}
+	program.ID = 0
+	program.Version = 1
+	return s.db.Create(program).Error
+}
+
+func (s *GormStore) Delete(program *Program) error {
+	// 按照名字删除: 没有ID时db.Delete(program)会删除所有的记录
+	return s.db.Where("host = ? and name = ?", s.host, program.Name).Delete(&Program{}).Error
+}
+
+//
+// 定期检查每一行的version和updated_at(不读取整行), 其他gosuv或者工具修改programs表之后发送通知
+// 工具直接修改programs表时, 需要更新updated_at或者version = version + 1
+//
+func (s *GormStore) Watch(stop <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	revisions, err := s.revisions()
+	go func() {
+		ticker := time.NewTicker(dbWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			current, currentErr := s.revisions()
+			if currentErr != nil {
+				// 数据库断开时只打印一次
+				if err == nil {
+					log.ErrorErrorf(currentErr, "Watch programs failed")
+				}
+				err = currentErr
+				continue
+			}
+
+			// 数据库恢复之后也检查一次(断开期间的修改)
+			changed := err != nil || !bytes.Equal(current, revisions)
+			revisions, err = current, nil
+			if changed {
+				log.Printf("Program store changed: %s", s.host)
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+// 当前host所有Program的name, version, updated_at
+func (s *GormStore) revisions() ([]byte, error) {
+	var programs []Program
+	err := s.db.Select("name, version, updated_at").Where("host = ?", s.host).Order("name").Find(&programs).Error
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, program := range programs {
+		fmt.Fprintf(&buf, "%s:%d:%d\n", program.Name, program.Version, program.UpdatedAt.UnixNano())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package gosuv
+
+// sqlite3驱动需要cgo, 默认不编译: go build -tags sqlite cmds/tool_gosuv.go
+import _ "github.com/mattn/go-sqlite3"
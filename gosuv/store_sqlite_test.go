@@ -0,0 +1,338 @@
+//go:build sqlite
+// +build sqlite
+
+package gosuv
+
+import (
+	"github.com/jinzhu/gorm"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -tags sqlite gosuv -v -run "TestSqliteStore"
+func TestSqliteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testProgramStore(t, NewGormStore(db, "host1"))
+
+	// 重复的名字: 唯一索引
+	if err := db.Create(&Program{Host: "host1", Name: "web"}).Error; err == nil {
+		t.Errorf("expected unique index on host, name")
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestReconnect"
+func TestReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 数据库所在的目录不存在, 连接失败
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "data", "gosuv.db")
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	if err := s.initSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.saveSnapshot([]*Program{
+		{Name: "web", Command: "./web", ProcessNum: 1},
+		{Name: "old", Command: "./old", ProcessNum: 1},
+	})
+	s.namesMu.Lock()
+	err = s.loadProgramsWithLock()
+	s.namesMu.Unlock()
+	if err != nil || s.offlineState() == nil || len(s.name2Program) != 2 {
+		t.Fatalf("expected degraded mode, got %v", err)
+	}
+
+	// 数据库恢复
+	os.MkdirAll(filepath.Join(dir, "data"), 0755)
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(db, "host1")
+	store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 2})
+	store.Insert(&Program{Name: "redis", Command: "redis-server", ProcessNum: 1})
+	db.Close()
+
+	s.namesMu.Lock()
+	err = s.reconnectWithLock()
+	s.namesMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DB().Close()
+	if len(s.name2Program) != 2 || s.name2Program["web"].ProcessNum != 2 || s.name2Program["redis"] == nil {
+		t.Errorf("expected programs reconciled with database, got %v", s.name2Program)
+	}
+	if programs, _ := s.snapshot.List(); len(programs) != 2 {
+		t.Errorf("expected snapshot updated, got %v", programs)
+	}
+
+	// 从快照加载的Program没有ID, 恢复之后仍然可以修改
+	if err := s.addOrUpdateProgram(&Program{Name: "web", Command: "./web -v", ProcessNum: 2}, true); err != nil {
+		t.Fatalf("expected update after reconnect, got %v", err)
+	}
+	if web, err := s.store.Get("web"); err != nil || web == nil || web.Command != "./web -v" {
+		t.Errorf("expected web updated in database, got %v, %v", web, err)
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestGormStoreRevisions"
+func TestGormStoreRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := NewGormStore(db, "host1")
+
+	program := &Program{Name: "web", Command: "./web", ProcessNum: 1}
+	store.Insert(program)
+	revisions, _ := store.revisions()
+
+	// 每次保存version加1
+	program.ProcessNum = 2
+	if err := store.Update(program); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.Get("web"); saved == nil || saved.Version != 2 {
+		t.Fatalf("expected version 2, got %v", saved)
+	}
+	current, _ := store.revisions()
+	if string(current) == string(revisions) {
+		t.Errorf("expected revisions changed after update")
+	}
+
+	// 工具直接修改programs表
+	revisions = current
+	db.Exec("UPDATE programs SET command = ?, version = version + 1 WHERE host = ? AND name = ?", "./web -v", "host1", "web")
+	if current, _ = store.revisions(); string(current) == string(revisions) {
+		t.Errorf("expected revisions changed after update by other tools")
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestSyncRecreated"
+func TestSyncRecreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	s.store = NewGormStore(db, "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "worker", Command: "./worker", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他gosuv删除之后重新添加, ID已经变化
+	other := NewGormStore(db, "host1")
+	for _, pg := range []*Program{{Name: "web", Command: "./web", ProcessNum: 1}, {Name: "worker", Command: "./worker -n 2", ProcessNum: 1}} {
+		other.Delete(pg)
+		other.Insert(pg)
+	}
+	if err := s.syncWithLock(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"web", "worker"} {
+		pg, _ := other.Get(name)
+		if program := s.name2Program[name]; pg == nil || program.ID != pg.ID {
+			t.Errorf("%s: expected id refreshed from store, got %d", name, program.ID)
+		}
+	}
+
+	if err := s.addOrUpdateProgram(&Program{Name: "worker", Command: "./worker -n 3", ProcessNum: 1}, true); err != nil {
+		t.Fatalf("expected update after sync, got %v", err)
+	}
+	if pgs, _ := other.List(); len(pgs) != 2 {
+		t.Errorf("expected 2 programs in store, got %v", pgs)
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestRunJournalHistory"
+func TestRunJournalHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 时间字段需要能读回来
+	startedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	stoppedAt := startedAt.Add(time.Minute)
+	db.Create(&ProcessRun{Host: "host1", ProgramName: "job", ProcessIndex: 0, Pid: 100, StartedAt: startedAt, StoppedAt: &stoppedAt})
+	db.Create(&ProcessRun{Host: "host1", ProgramName: "job", ProcessIndex: 0, Pid: 101, StartedAt: time.Now()})
+
+	journal := &RunJournal{host: "host1", db: func() *gorm.DB { return db }}
+	runs, err := journal.History("job", 0, time.Now().Add(-time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Pid != 100 || !runs[0].StartedAt.Equal(startedAt) || runs[0].StoppedAt == nil || !runs[0].StoppedAt.Equal(stoppedAt) {
+		t.Errorf("unexpected history: %+v", runs)
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestAuditQuery"
+func TestAuditQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	s.db = db
+
+	yesterday := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	db.Create(&AuditRecord{Host: "host1", User: "alice", Action: AuditReload, CreatedAt: yesterday})
+	db.Create(&AuditRecord{Host: "host1", User: "bob", Action: AuditReload, CreatedAt: time.Now()})
+
+	// 按照时间过滤, 时间字段需要能读回来
+	records, err := s.dbQueryAudit(&AuditFilter{Until: time.Now().Add(-time.Hour), Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].User != "alice" || !records[0].CreatedAt.Equal(yesterday) {
+		t.Errorf("unexpected records: %+v", records)
+	}
+	if records, _ := s.dbQueryAudit(&AuditFilter{Since: time.Now().Add(-time.Hour), Limit: 10}); len(records) != 1 || records[0].User != "bob" {
+		t.Errorf("unexpected records: %+v", records)
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestReloadAudit"
+func TestReloadAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{Host: "host1"}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTestSupervisor(cfg, dir)
+	defer s.scheduler.Close()
+	s.db = db
+	s.store = NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无效的Program, reload失败时记录错误
+	s.store.Update(&Program{Name: "web", ProcessNum: 1})
+	plan, _, err := s.reloadPlanWithLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hReload(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/reload?hash="+plan.Hash, nil))
+
+	var record AuditRecord
+	if err := db.Where("action = ?", AuditReload).First(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if record.Result != AuditFailed || !strings.Contains(record.Error, "web: Program command empty") {
+		t.Errorf("unexpected audit record: %+v", record)
+	}
+}
+
+// go test -tags sqlite gosuv -v -run "TestLookupApiToken"
+func TestLookupApiToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Configuration{}
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = filepath.Join(dir, "gosuv.db")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+	yesterday := time.Now().Add(-24 * time.Hour)
+	db.Create(&ApiToken{Host: "host1", Name: "forever", TokenHash: hashToken("gsv_forever"), CreatedAt: time.Now()})
+	db.Create(&ApiToken{Host: "host1", Name: "valid", TokenHash: hashToken("gsv_valid"), CreatedAt: time.Now(), ExpiresAt: &tomorrow})
+	db.Create(&ApiToken{Host: "host1", Name: "expired", TokenHash: hashToken("gsv_expired"), CreatedAt: time.Now(), ExpiresAt: &yesterday})
+
+	for _, token := range []string{"gsv_forever", "gsv_valid"} {
+		if apiToken, err := LookupApiToken(db, "host1", token); err != nil || apiToken.LastUsedAt == nil {
+			t.Errorf("%s: expected token found, got %v", token, err)
+		}
+	}
+	if _, err := LookupApiToken(db, "host1", "gsv_expired"); err == nil {
+		t.Errorf("expected expired token rejected")
+	}
+}
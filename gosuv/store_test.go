@@ -0,0 +1,187 @@
+package gosuv
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// go test gosuv -v -run "TestYamlStore"
+func TestYamlStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testProgramStore(t, NewYamlStore(filepath.Join(dir, "programs.yml"), "host1"))
+
+	// 包含环境变量(密码), 只有gosuv的运行用户可以读写
+	if info, err := os.Stat(filepath.Join(dir, "programs.yml")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected programs.yml with mode 0600, got %v, %v", info, err)
+	}
+}
+
+func testProgramStore(t *testing.T, store ProgramStore) {
+	if programs, err := store.List(); err != nil || len(programs) != 0 {
+		t.Fatalf("expected empty store, got %v, %v", programs, err)
+	}
+
+	redis := &Program{Name: "redis", Command: "redis-server", ProcessNum: 1, Environ: EnvironList{"PASSWORD=123456"}, Owners: []string{"alice"}}
+	web := &Program{Name: "web", Command: "./web", ProcessNum: 2, DependsOn: []string{"redis"}}
+	for _, program := range []*Program{redis, web} {
+		if err := store.Insert(program); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	web.ProcessNum = 4
+	if err := store.Update(web); err != nil {
+		t.Fatal(err)
+	}
+	program, err := store.Get("web")
+	if err != nil || program == nil || program.ProcessNum != 4 || program.DependsOn[0] != "redis" || program.Host != "host1" {
+		t.Fatalf("unexpected program: %+v, %v", program, err)
+	}
+	// 保存原始的密码(不是隐藏之后的)
+	if program, _ := store.Get("redis"); program == nil || program.Environ[0] != "PASSWORD=123456" || program.Owners[0] != "alice" {
+		t.Errorf("unexpected program: %+v", program)
+	}
+
+	if err := store.Delete(redis); err != nil {
+		t.Fatal(err)
+	}
+	programs, err := store.List()
+	if err != nil || len(programs) != 1 || programs[0].Name != "web" {
+		t.Fatalf("unexpected programs: %v, %v", programs, err)
+	}
+	if program, err := store.Get("redis"); program != nil || err != nil {
+		t.Errorf("expected redis deleted, got %+v, %v", program, err)
+	}
+}
+
+// go test gosuv -v -run "TestYamlStoreWatch"
+func TestYamlStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "programs.yml")
+	store := NewYamlStore(path, "host1")
+	if err := store.Insert(&Program{Name: "web", Command: "./web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := store.Watch(stop)
+
+	// 手动修改文件
+	modTime := time.Now().Add(time.Minute)
+	if err := ioutil.WriteFile(path, []byte("- name: web\n  command: ./web2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime, modTime)
+
+	select {
+	case <-changes:
+	case <-time.After(3 * storeWatchInterval):
+		t.Fatal("expected change notification")
+	}
+	if program, _ := store.Get("web"); program == nil || program.Command != "./web2" {
+		t.Errorf("unexpected program: %+v", program)
+	}
+}
+
+// go test gosuv -v -run "TestNewProgramStore"
+func TestNewProgramStore(t *testing.T) {
+	cfg := &Configuration{}
+	store, err := NewProgramStore(cfg, nil, "/tmp/programs.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if yamlStore, ok := store.(*YamlStore); !ok || yamlStore.path != "/tmp/programs.yml" {
+		t.Errorf("expected yaml store, got %+v", store)
+	}
+
+	cfg.Store.Type = StoreMysql
+	if _, err := NewProgramStore(cfg, nil, ""); err == nil {
+		t.Errorf("expected error without database")
+	}
+	cfg.Store.Type = "redis"
+	if _, err := NewProgramStore(cfg, nil, ""); err == nil {
+		t.Errorf("expected invalid store type")
+	}
+}
+
+// 模拟数据库连接断开
+type brokenStore struct{}
+
+var errBrokenStore = errors.New("connection refused")
+
+func (s brokenStore) List() ([]*Program, error)                 { return nil, errBrokenStore }
+func (s brokenStore) Get(name string) (*Program, error)         { return nil, errBrokenStore }
+func (s brokenStore) Insert(program *Program) error             { return errBrokenStore }
+func (s brokenStore) Update(program *Program) error             { return errBrokenStore }
+func (s brokenStore) Delete(program *Program) error             { return errBrokenStore }
+func (s brokenStore) Watch(stop <-chan struct{}) <-chan struct{} { return nil }
+
+// go test gosuv -v -run "TestStoreError"
+func TestStoreError(t *testing.T) {
+	s := &Supervisor{
+		cfg:   &Configuration{},
+		store: brokenStore{},
+		name2Program: map[string]*ProgramEx{
+			"web": {Program: &Program{Name: "web", Command: "./web"}},
+		},
+		scheduler: NewScheduler(),
+	}
+	defer s.scheduler.Close()
+
+	// 保存失败时不添加
+	err := s.addOrUpdateProgram(&Program{Name: "redis", Command: "redis-server", ProcessNum: 1}, true)
+	if _, ok := err.(*StoreError); !ok {
+		t.Errorf("expected store error, got %v", err)
+	}
+	if _, ok := s.name2Program["redis"]; ok {
+		t.Errorf("expected redis not added")
+	}
+
+	// 保存失败时不修改
+	err = s.addOrUpdateProgram(&Program{Name: "web", Command: "./web -v", ProcessNum: 2}, true)
+	if _, ok := err.(*StoreError); !ok {
+		t.Errorf("expected store error, got %v", err)
+	}
+	if web := s.name2Program["web"]; web.Command != "./web" || web.ProcessNum != 0 || len(web.processList()) != 0 {
+		t.Errorf("expected web not updated, got %v", web.Program)
+	}
+
+	// 删除, reload失败时返回500, 并且不删除
+	router := mux.NewRouter()
+	router.HandleFunc("/api/programs/{name}", s.hDelProgram).Methods("DELETE")
+	router.HandleFunc("/api/reload", s.hReload).Methods("POST")
+	cases := []struct {
+		method string
+		path   string
+	}{
+		{"DELETE", "/api/programs/web"},
+		{"POST", "/api/reload"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s: expected 500, got %d: %s", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+	if _, ok := s.name2Program["web"]; !ok {
+		t.Errorf("expected web not removed")
+	}
+}
@@ -0,0 +1,183 @@
+package gosuv
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	log "github.com/wfxiang08/cyutils/utils/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//
+// 保存在本地yaml文件中的Program(列表), 不需要数据库; 适合小的机器和CI
+// 手动修改文件之后会自动reload
+//
+type YamlStore struct {
+	path string
+	host string
+	perm os.FileMode // 文件中包含环境变量(密码), 只有gosuv的运行用户可以读写
+
+	mu      sync.Mutex
+	modTime time.Time // 最近一次读写时文件的修改时间, 用于忽略自己的修改
+}
+
+func NewYamlStore(path string, host string) *YamlStore {
+	return &YamlStore{
+		path: path,
+		host: host,
+		perm: 0600,
+	}
+}
+
+// 文件不存在时为空
+func (s *YamlStore) read() ([]*Program, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+
+	var programs []*Program
+	if err := yaml.Unmarshal(data, &programs); err != nil {
+		return nil, fmt.Errorf("Parse %s failed: %v", s.path, err)
+	}
+	for _, program := range programs {
+		program.Host = s.host
+	}
+	return uniquePrograms(programs), nil
+}
+
+// 先写临时文件再rename, 避免写了一半的文件被读取
+func (s *YamlStore) write(programs []*Program) error {
+	data, err := yaml.Marshal(programs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, s.perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (s *YamlStore) List() ([]*Program, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *YamlStore) Get(name string) (*Program, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	programs, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, program := range programs {
+		if program.Name == name {
+			return program, nil
+		}
+	}
+	return nil, nil
+}
+
+// 替换同名的Program, 没有时添加到最后
+func (s *YamlStore) save(program *Program) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	programs, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	program.Host = s.host
+	copied := *program
+	for i, other := range programs {
+		if other.Name == program.Name {
+			programs[i] = &copied
+			return s.write(programs)
+		}
+	}
+	return s.write(append(programs, &copied))
+}
+
+// 替换所有的Program, 例如: 本地快照
+func (s *YamlStore) Replace(programs []*Program) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(programs)
+}
+
+func (s *YamlStore) Insert(program *Program) error {
+	return s.save(program)
+}
+
+func (s *YamlStore) Update(program *Program) error {
+	return s.save(program)
+}
+
+func (s *YamlStore) Delete(program *Program) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	programs, err := s.read()
+	if err != nil {
+		return err
+	}
+	result := make([]*Program, 0, len(programs))
+	for _, other := range programs {
+		if other.Name != program.Name {
+			result = append(result, other)
+		}
+	}
+	return s.write(result)
+}
+
+// 定期检查文件的修改时间
+func (s *YamlStore) Watch(stop <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(storeWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(s.path)
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			changed := !info.ModTime().Equal(s.modTime)
+			s.modTime = info.ModTime()
+			s.mu.Unlock()
+
+			if changed {
+				log.Printf("Program store changed: %s", s.path)
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes
+}
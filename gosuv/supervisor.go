@@ -4,11 +4,11 @@ import (
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
-	"github.com/wfxiang08/cyutils/utils/errors"
 	log "github.com/wfxiang08/cyutils/utils/log"
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 )
 
 // 全局的Event Pub/Scribe
@@ -27,12 +27,19 @@ type Supervisor struct {
 	name2Program map[string]*ProgramEx
 	namesMu      sync.Mutex // 只用在Api, 或者初始化脚本中；内部函数不使用
 
-	dbType string
-	dbDSN  string
-	Host   string
+	dbMu     sync.RWMutex
+	db       *gorm.DB      // 数据库连接池, 没有配置数据库或者数据库不可用时为nil, 参考: OpenDB
+	offline  *offlineState // 降级模式, 参考: offline.go
+	Host     string
+	store    ProgramStore // Program的存储: mysql, sqlite3, yaml
+	snapshot *YamlStore   // Program保存在数据库中时的本地快照
 
 	cfg    *Configuration
 	logDir string
+
+	autoStarted bool // AutoStartPrograms之后，新添加的Program直接启动
+
+	scheduler *Scheduler // 定时任务的调度
 }
 
 func (s *Supervisor) Programs() []*ProgramEx {
@@ -48,97 +55,146 @@ func (s *Supervisor) Programs() []*ProgramEx {
 	return pgs
 }
 
+// 按照依赖关系排序的Programs(被依赖的在前)
+func (s *Supervisor) sortedPrograms() []*ProgramEx {
+	pgs := make([]*Program, 0, len(s.name2Program))
+	for _, program := range s.name2Program {
+		pgs = append(pgs, program.Program)
+	}
+	sorted, err := SortProgramsByDependency(pgs)
+	if err != nil {
+		// addOrUpdateProgram会拒绝循环依赖, 理论上不会出现
+		log.ErrorErrorf(err, "Sort programs failed")
+		return s.Programs()
+	}
+
+	result := make([]*ProgramEx, 0, len(sorted))
+	for _, pg := range sorted {
+		result = append(result, s.name2Program[pg.Name])
+	}
+	return result
+}
+
+// 检查添加或更新newProg之后，是否会出现循环依赖
+func (s *Supervisor) checkDependencyCycle(newProg *Program) error {
+	pgs := []*Program{newProg}
+	for name, program := range s.name2Program {
+		if name != newProg.Name {
+			pgs = append(pgs, program.Program)
+		}
+	}
+	_, err := SortProgramsByDependency(pgs)
+	return err
+}
+
 // 获取配置文件的路径
 func (s *Supervisor) programPath() string {
 	return filepath.Join(s.ConfigDir, "programs.yml")
 }
 
 // 需要WLock
+// saveDb: 保存到store, 失败时返回错误
+// 1. 添加: 先保存, 失败时不添加
+// 2. 更新: 先保存修改之后的副本, 失败时不修改内存中的Program(进程数等)
 func (s *Supervisor) addOrUpdateProgram(newProg *Program, saveDb bool) error {
 	// 验证Program是否有效
 	if err := newProg.Check(); err != nil {
 		return err
 	}
+	if err := s.checkDependencyCycle(newProg); err != nil {
+		return err
+	}
 
 	oldProg, ok := s.name2Program[newProg.Name]
 
+	// 从store加载时, 记录store中的版本
+	revision := ""
+	if !saveDb {
+		revision = newProg.revision()
+	}
+
 	if ok {
+		var saved *Program
+		if saveDb {
+			saved = oldProg.mergedProgram(newProg)
+			if err := s.dbUpdateProgram(saved); err != nil {
+				return err
+			}
+		}
+
 		// 更新已有的Program
 		oldProg.UpdateProgram(newProg)
+		s.scheduler.Update(oldProg)
+		gEventPub.PostEvent(fmt.Sprintf("Program %s Updated", newProg.Name))
 
 		if saveDb {
-			s.dbUpdateProgram(oldProg.Program)
+			oldProg.ID = saved.ID
+			oldProg.Version = saved.Version
+			oldProg.UpdatedAt = saved.UpdatedAt
+			oldProg.revision = s.storeRevision(newProg.Name)
+		} else {
+			// 其他gosuv删除之后重新添加时, ID已经变化
+			oldProg.ID = newProg.ID
+			oldProg.Host = newProg.Host
+			oldProg.Version = newProg.Version
+			oldProg.UpdatedAt = newProg.UpdatedAt
+			oldProg.revision = revision
 		}
-
-		gEventPub.PostEvent(fmt.Sprintf("Program %s Updated", newProg.Name))
 	} else {
+		if saveDb {
+			if err := s.dbInsertProgram(newProg); err != nil {
+				return err
+			}
+			revision = s.storeRevision(newProg.Name)
+		}
+
 		// 添加新的Program
 		prog := &ProgramEx{
-			Program: newProg,
+			Program:  newProg,
+			revision: revision,
 		}
-		prog.InitProgram(s.logDir)
+		prog.InitProgram(s.logDir, s.autoStarted)
 		s.name2Program[newProg.Name] = prog
-		if saveDb {
-			s.dbInsertProgram(prog.Program)
-		}
 
+		s.scheduler.Update(prog)
 		gEventPub.PostEvent(fmt.Sprintf("Program %s Inserted", newProg.Name))
 	}
 
 	return nil
 }
 
-// Check
-// - Yaml format
-// - Duplicated program
-func (s *Supervisor) readConfigFromDB() (pgs []*Program, err error) {
-	log.Printf("readConfigFromDB ...")
+// 从store中读取所有的Program
+func (s *Supervisor) readPrograms() ([]*Program, error) {
+	log.Printf("readPrograms ...")
 
-	log.Printf("DB: %s, %s", s.dbType, s.dbDSN)
-	// 创建数据库连接
-	// http://jinzhu.me/gorm/database.html#connecting-to-a-database
-	db, err := gorm.Open(s.dbType, s.dbDSN)
+	pgs, err := s.store.List()
 	if err != nil {
-		return nil, errors.New("Failed to open database")
-	}
-
-	defer db.Close()
-
-	// 读取Programs
-	var programs []Program
-	db.Where("host = ?", s.Host).Find(&programs)
-	pgs = make([]*Program, 0)
-
-	visited := map[string]bool{}
-	for index, _ := range programs {
-		// 不能有重复的元素
-		if visited[programs[index].Name] {
-			log.Errorf("Duplicated program name: %s", programs[index].Name)
-			continue
-		}
-		pgs = append(pgs, &programs[index])
-		visited[programs[index].Name] = true
+		return nil, &StoreError{Op: "read programs", Err: err}
 	}
 
 	for _, pg := range pgs {
 		log.Printf("Loaded Program: %s", pg.String())
 	}
 	log.Printf("Programs Load Num: %d", len(pgs))
-
-	return
+	return pgs, nil
 }
 
 func (s *Supervisor) LoadDBWithLock() error {
 	// 加载配置文件
-	pgs, err := s.readConfigFromDB()
+	pgs, err := s.readPrograms()
 	if err != nil {
 		return err
 	}
+	s.saveSnapshot(pgs)
+
 	// add or update program
+	// 无效的Program(例如: 依赖有环)不会加载, 已经在运行的保持不变
 	visited := map[string]bool{}
 	for _, pg := range pgs {
 		visited[pg.Name] = true
-		s.addOrUpdateProgram(pg, false)
+		if err := s.addOrUpdateProgram(pg, false); err != nil {
+			log.ErrorErrorf(err, "Load program failed: %s", pg.Name)
+		}
 	}
 
 	// delete not exists program
@@ -146,102 +202,134 @@ func (s *Supervisor) LoadDBWithLock() error {
 		if visited[pg.Name] {
 			continue
 		}
-		s.removeProgram(pg.Name)
+		// 已经不在store中
+		s.removeProgram(pg.Name, false)
 	}
 	return nil
 }
 
-func (s *Supervisor) dbRemoveProgram(program *Program) {
-
-	// 创建数据库连接
-	// http://jinzhu.me/gorm/database.html#connecting-to-a-database
-	db, err := gorm.Open(s.dbType, s.dbDSN)
-	if err != nil {
-		panic("failed to connect database")
+// store被其他人修改之后(例如: 手动编辑yaml文件, 其他gosuv修改programs表), 同步修改
+func (s *Supervisor) watchStore() {
+	changes := s.store.Watch(nil)
+	if changes == nil {
+		return
+	}
+	for range changes {
+		s.namesMu.Lock()
+		if err := s.syncWithLock(); err != nil {
+			log.ErrorErrorf(err, "Sync programs failed")
+		}
+		s.namesMu.Unlock()
 	}
-	defer db.Close()
-
-	// 从数据库删除
-	db.Delete(program)
-
 }
 
-func (s *Supervisor) dbUpdateProgram(program *Program) {
-
-	// 创建数据库连接
-	// http://jinzhu.me/gorm/database.html#connecting-to-a-database
-	db, err := gorm.Open(s.dbType, s.dbDSN)
-	if err != nil {
-		log.ErrorErrorf(err, "failed to connect database")
-		return
+func (s *Supervisor) dbRemoveProgram(program *Program) error {
+	if err := s.store.Delete(program); err != nil {
+		log.ErrorErrorf(err, "Remove program failed: %s", program.String())
+		return &StoreError{Op: "remove program " + program.Name, Err: err}
 	}
-	defer db.Close()
-
-	program.Host = s.Host
-	program.Encode()
-	db.Save(program)
-	log.Printf("Update program: %s", program.String())
-
+	s.refreshSnapshot()
+	return nil
 }
 
-func (s *Supervisor) dbInsertProgram(program *Program) {
-
-	// 创建数据库连接
-	// http://jinzhu.me/gorm/database.html#connecting-to-a-database
-	db, err := gorm.Open(s.dbType, s.dbDSN)
-	if err != nil {
-		log.ErrorErrorf(err, "failed to connect database")
-		return
+func (s *Supervisor) dbUpdateProgram(program *Program) error {
+	if err := s.store.Update(program); err != nil {
+		log.ErrorErrorf(err, "Update program failed: %s", program.String())
+		return &StoreError{Op: "save program " + program.Name, Err: err}
 	}
-	defer db.Close()
-
-	program.Encode()
-	program.Host = s.Host
+	log.Printf("Update program: %s", program.String())
+	s.refreshSnapshot()
+	return nil
+}
 
-	if db.Create(program).RowsAffected == 0 {
-		var oldProgram Program
-		if !db.First(&oldProgram, "host = ? and name = ?", program.Host, program.Name).RecordNotFound() {
-			program.ID = oldProgram.ID
-			db.Save(program).Update()
-		} else {
-			log.Printf("Error insert record: %s", program.String())
-		}
+func (s *Supervisor) dbInsertProgram(program *Program) error {
+	if err := s.store.Insert(program); err != nil {
+		log.ErrorErrorf(err, "Add new program failed: %s", program.String())
+		return &StoreError{Op: "add program " + program.Name, Err: err}
 	}
-
 	log.Printf("Add new program: %s", program.String())
+	s.refreshSnapshot()
+	return nil
 }
 
-func (s *Supervisor) removeProgram(name string) bool {
+// saveDb: 先从store中删除, 失败时不删除
+func (s *Supervisor) removeProgram(name string, saveDb bool) (bool, error) {
 
 	// 删除program
 	if program, ok := s.name2Program[name]; ok {
 		log.Printf("RemoveProgram: %s", name)
 
-		s.dbRemoveProgram(program.Program)
+		if saveDb {
+			if err := s.dbRemoveProgram(program.Program); err != nil {
+				return true, err
+			}
+		}
 		delete(s.name2Program, name)
+		s.scheduler.Remove(name)
 
 		// 关闭所有的Process
 		program.StopAndWaitAll()
+		program.removeCgroup()
 		gEventPub.PostEvent(program.Name + " deleted")
 
-		return true
+		return true, nil
 	} else {
-		return false
+		return false, nil
 	}
 }
 
+// 按照依赖关系的逆序关闭Programs: 先等依赖它的Program停止，再停止自己
 func (s *Supervisor) Close() {
-	for _, program := range s.name2Program {
+	// 不再启动新的定时任务
+	s.scheduler.Close()
+
+	programs := s.sortedPrograms()
+	for i := len(programs) - 1; i >= 0; i-- {
+		program := programs[i]
+		for _, other := range programs[i+1:] {
+			if !containsString(other.DependsOn, program.Name) {
+				continue
+			}
+			timeout := time.Duration(other.StopTimeout)*time.Second + 5*time.Second
+			if !other.WaitStopped(timeout) {
+				log.Warnf("Wait for program %s to stop timeout", other.Name)
+			}
+		}
 		program.StopAll("admin")
 	}
 }
 
+// 按照依赖关系启动Programs: 等依赖的Program运行(健康)之后，再启动自己
+// 等待依赖时不持有namesMu, 以免阻塞Api
 func (s *Supervisor) AutoStartPrograms() {
-	// 自动运行的Program, 直接启动
-	for _, program := range s.name2Program {
-		if program.StartAuto {
-			log.Printf("Auto Start Programs: %s", program.Name)
-			program.StartAll("admin")
+	s.namesMu.Lock()
+	s.autoStarted = true
+	programs := s.sortedPrograms()
+	s.namesMu.Unlock()
+
+	name2Program := make(map[string]*ProgramEx, len(programs))
+	for _, program := range programs {
+		name2Program[program.Name] = program
+	}
+
+	// 自动运行的Program, 直接启动; 定时任务由Scheduler启动
+	for _, program := range programs {
+		if !program.StartAuto || program.IsScheduled() {
+			continue
 		}
+		for _, depName := range program.DependsOn {
+			dep, ok := name2Program[depName]
+			if !ok || !dep.StartAuto || dep.IsScheduled() {
+				log.Warnf("Program %s depends on %s, which will not be started automatically", program.Name, depName)
+				continue
+			}
+			log.Printf("Program %s waiting for dependency: %s", program.Name, depName)
+			if !dep.WaitReady(DependencyWaitTimeout) {
+				log.Warnf("Wait for dependency %s of %s timeout", depName, program.Name)
+			}
+		}
+
+		log.Printf("Auto Start Programs: %s", program.Name)
+		program.StartAll("admin")
 	}
 }
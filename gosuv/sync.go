@@ -0,0 +1,67 @@
+package gosuv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-yaml/yaml"
+	log "github.com/wfxiang08/cyutils/utils/log"
+)
+
+// store中保存的内容的hash(不包括ID, Host, Version等), 用于判断Program是否被修改
+func (p *Program) revision() string {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 保存之后store中的版本, 避免把自己的修改再同步一次
+func (s *Supervisor) storeRevision(name string) string {
+	program, err := s.store.Get(name)
+	if err != nil || program == nil {
+		return ""
+	}
+	return program.revision()
+}
+
+//
+// 同步store中的修改, 需要WLock
+// 和LoadDBWithLock不同, 只有内容变化的Program才会更新(不会影响没有修改的Program):
+// 1. 新的Program: 添加
+// 2. 内容变化: 更新(和在页面上修改一样)
+// 3. 已经不在store中: 删除
+//
+func (s *Supervisor) syncWithLock() error {
+	pgs, err := s.store.List()
+	if err != nil {
+		return &StoreError{Op: "read programs", Err: err}
+	}
+	s.saveSnapshot(pgs)
+
+	visited := map[string]bool{}
+	for _, pg := range pgs {
+		visited[pg.Name] = true
+		if program, ok := s.name2Program[pg.Name]; ok && program.revision == pg.revision() {
+			// 内容相同, 但是可能被删除之后重新添加了
+			program.ID = pg.ID
+			continue
+		}
+
+		if err := s.addOrUpdateProgram(pg, false); err != nil {
+			log.ErrorErrorf(err, "Sync program failed: %s", pg.Name)
+			continue
+		}
+		log.Printf("Sync program: %s, version: %d", pg.Name, pg.Version)
+	}
+
+	for name := range s.name2Program {
+		if visited[name] {
+			continue
+		}
+		log.Printf("Sync program: %s removed from store", name)
+		s.removeProgram(name, false)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package gosuv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test gosuv -v -run "TestSyncPrograms"
+func TestSyncPrograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSupervisor(&Configuration{Host: "host1"}, dir)
+	defer s.scheduler.Close()
+	s.store = NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "worker", Command: "./worker", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "cron", Command: "./cron", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 自己的修改不需要再同步
+	if err := s.addOrUpdateProgram(&Program{Name: "web", Command: "./web -v", ProcessNum: 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	web := s.name2Program["web"]
+	web.Dir = "/not/synced"
+
+	// 其他人修改了store
+	other := NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	other.Update(&Program{Name: "worker", Command: "./worker -n 2", ProcessNum: 2})
+	other.Delete(&Program{Name: "cron"})
+	other.Insert(&Program{Name: "redis", Command: "redis-server", ProcessNum: 1})
+
+	if err := s.syncWithLock(); err != nil {
+		t.Fatal(err)
+	}
+	if s.name2Program["web"] != web || web.Dir != "/not/synced" {
+		t.Errorf("unchanged program should not be updated")
+	}
+	if worker := s.name2Program["worker"]; worker == nil || worker.Command != "./worker -n 2" || worker.ProcessNum != 2 {
+		t.Errorf("expected worker updated, got %v", worker)
+	}
+	if _, ok := s.name2Program["cron"]; ok {
+		t.Errorf("expected cron removed")
+	}
+	if _, ok := s.name2Program["redis"]; !ok {
+		t.Errorf("expected redis added")
+	}
+}
+
+// go test gosuv -v -run "TestLoadInvalidProgram"
+func TestLoadInvalidProgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSupervisor(&Configuration{Host: "host1"}, dir)
+	defer s.scheduler.Close()
+	s.store = NewYamlStore(filepath.Join(dir, "programs.yml"), "host1")
+	s.store.Insert(&Program{Name: "web", Command: "./web", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无效的Program: 新的不加载, 已经加载的保持不变
+	s.store.Update(&Program{Name: "web", ProcessNum: 1})
+	s.store.Insert(&Program{Name: "worker", ProcessNum: 1})
+	if err := s.LoadDBWithLock(); err != nil {
+		t.Fatal(err)
+	}
+	if web := s.name2Program["web"]; web == nil || web.Command != "./web" {
+		t.Errorf("expected web kept, got %v", web)
+	}
+	if _, ok := s.name2Program["worker"]; ok {
+		t.Errorf("expected invalid worker not loaded")
+	}
+}
+
+// go test gosuv -v -run "TestDbDSN"
+func TestDbDSN(t *testing.T) {
+	cfg := &Configuration{}
+	cfg.Db.DbType = StoreMysql
+	cfg.Db.DbDsn = "root:password@tcp(127.0.0.1:3306)/gosuv_db?tls=skip-verify&autocommit=true"
+	dsn, err := dbDSN(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "root:password@tcp(127.0.0.1:3306)/gosuv_db?loc=Local&parseTime=true&tls=skip-verify&autocommit=true"; dsn != expected {
+		t.Errorf("expected %s, got %s", expected, dsn)
+	}
+
+	// 指定的loc保持不变, parseTime=false也会被修改
+	cfg.Db.DbDsn = "root:password@tcp(127.0.0.1:3306)/gosuv_db?parseTime=false&loc=UTC"
+	if dsn, _ := dbDSN(cfg); dsn != "root:password@tcp(127.0.0.1:3306)/gosuv_db?parseTime=true" {
+		t.Errorf("unexpected dsn: %s", dsn)
+	}
+
+	cfg.Db.DbType = StoreSqlite
+	cfg.Db.DbDsn = "/data/gosuv/gosuv.db?_busy_timeout=5000"
+	if dsn, _ := dbDSN(cfg); dsn != cfg.Db.DbDsn {
+		t.Errorf("expected sqlite dsn unchanged, got %s", dsn)
+	}
+}
@@ -0,0 +1,186 @@
+package gosuv
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 没有配置umask
+const UmaskNone = -1
+
+// 切换用户之后的身份和环境变量
+type userCredential struct {
+	Credential *syscall.Credential
+	HomeDir    string
+	Env        []string // HOME, USER, LOGNAME, SHELL
+}
+
+// 解析umask, 例如: 022, 0027; 空字符串表示不修改
+func ParseUmask(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return UmaskNone, nil
+	}
+	umask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("Invalid umask: %s", value)
+	}
+	return int(umask), nil
+}
+
+func (p *Program) checkUser() error {
+	if p.Group != "" && p.User == "" {
+		return fmt.Errorf("Group %s requires user", p.Group)
+	}
+	_, err := ParseUmask(p.Umask)
+	return err
+}
+
+// 从/etc/passwd中读取用户的登录shell(os/user不提供)
+func lookupUserShell(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+//
+// 查找用户的uid, 主组(或者group指定的组), 附加组, 以及home目录
+// 不是root时只能以当前用户运行, 此时不切换用户, 只设置环境变量
+//
+func lookupCredential(userName string, groupName string) (*userCredential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.ParseUint(g.Gid, 10, 32); err != nil {
+			return nil, err
+		}
+	}
+
+	// 附加组
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("lookup groups of %s failed: %v", userName, err)
+	}
+	groups := make([]uint32, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		id, err := strconv.ParseUint(groupId, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(id))
+	}
+
+	// 不是root时不能调用setgroups, 已经是对应的用户, 不需要切换(Credential为nil)
+	var credential *syscall.Credential
+	if IsRoot() {
+		credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	} else if int(uid) != os.Getuid() || int(gid) != os.Getgid() {
+		return nil, fmt.Errorf("not root, can not switch to user %s", userName)
+	}
+
+	return &userCredential{
+		Credential: credential,
+		HomeDir:    u.HomeDir,
+		Env: []string{
+			"HOME=" + u.HomeDir,
+			"USER=" + u.Username,
+			"LOGNAME=" + u.Username,
+			"SHELL=" + lookupUserShell(u.Username),
+		},
+	}, nil
+}
+
+//
+// 以运行用户的权限读取文件(gosuv以root运行时可以读取任何文件):
+// 文件需要可读, 所有上级目录需要可以进入; 只检查权限位, 不考虑ACL
+// cred为nil(没有切换用户)时直接读取
+//
+func readFileAs(path string, cred *syscall.Credential) ([]byte, error) {
+	if cred == nil || cred.Uid == 0 {
+		return ioutil.ReadFile(path)
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !permitted(info, cred, 04) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+	}
+	for dir := filepath.Dir(realPath); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !permitted(info, cred, 01) {
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// 和内核一样: 所有者只看所有者的权限位, 同组只看组的权限位
+func permitted(info os.FileInfo, cred *syscall.Credential, perm os.FileMode) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	mode := info.Mode().Perm()
+	if stat.Uid == cred.Uid {
+		return mode&(perm<<6) != 0
+	}
+	if stat.Gid == cred.Gid {
+		return mode&(perm<<3) != 0
+	}
+	for _, gid := range cred.Groups {
+		if stat.Gid == gid {
+			return mode&(perm<<3) != 0
+		}
+	}
+	return mode&perm != 0
+}
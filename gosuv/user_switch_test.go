@@ -0,0 +1,155 @@
+package gosuv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// go test gosuv -v -run "TestParseUmask"
+func TestParseUmask(t *testing.T) {
+	cases := map[string]int{
+		"":     UmaskNone,
+		"022":  0022,
+		"0027": 0027,
+		"777":  0777,
+	}
+	for value, expected := range cases {
+		umask, err := ParseUmask(value)
+		if err != nil || umask != expected {
+			t.Errorf("%s: expected %o, got %o, %v", value, expected, umask, err)
+		}
+	}
+	for _, value := range []string{"888", "1777", "abc"} {
+		if _, err := ParseUmask(value); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+// go test gosuv -v -run "TestLookupCredential"
+func TestLookupCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	cred, err := lookupCredential(current.Username, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsRoot() && int(cred.Credential.Uid) != os.Getuid() {
+		t.Errorf("unexpected uid: %d", cred.Credential.Uid)
+	}
+	if !IsRoot() && cred.Credential != nil {
+		t.Errorf("expected no credential for the current user, got %v", cred.Credential)
+	}
+	if cred.HomeDir != current.HomeDir {
+		t.Errorf("expected home %s, got %s", current.HomeDir, cred.HomeDir)
+	}
+	if len(cred.Env) != 4 || cred.Env[0] != "HOME="+current.HomeDir || cred.Env[2] != "LOGNAME="+current.Username {
+		t.Errorf("unexpected env: %v", cred.Env)
+	}
+
+	if _, err := lookupCredential("gosuv_no_such_user", ""); err == nil {
+		t.Errorf("unknown user should be rejected")
+	}
+}
+
+// go test gosuv -v -run "TestStartAsUser"
+func TestStartAsUser(t *testing.T) {
+	// root: 切换到nobody; 不是root: 以当前用户运行
+	u, err := user.Current()
+	if IsRoot() {
+		u, err = user.Lookup("nobody")
+	}
+	if err != nil {
+		t.Skip(err)
+	}
+
+	program := &ProgramEx{Program: &Program{Name: "whoami", Command: "id -u", User: u.Username, ProcessNum: 1}}
+	program.InitProgram("", false)
+	cmd, err := program.processAt(0).buildCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if uid := strings.TrimSpace(out.String()); uid != u.Uid {
+		t.Errorf("expected uid %s, got %s", u.Uid, uid)
+	}
+
+	// 工作目录中的~和$HOME是运行用户的home目录
+	home := &ProgramEx{Program: &Program{Name: "home", Command: "pwd", Dir: "~/a:$HOME/b", User: u.Username, ProcessNum: 1}}
+	home.InitProgram("", false)
+	if homeCmd, err := home.processAt(0).buildCommand(); err != nil || homeCmd.Dir != u.HomeDir+"/a:"+u.HomeDir+"/b" {
+		t.Errorf("expected dir in the home of %s, got %v", u.Username, err)
+	}
+
+	// exec健康检查和进程使用相同的用户
+	program.HealthCheck = HealthCheckExec
+	program.HealthCheckTarget = `test "$(id -u)" = ` + u.Uid
+	program.HealthCheckTimeout = 1
+	attrs := program.processAt(0).execAttrs
+	healthCmd, err := execHealthCommand(program.HealthCheckTarget, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsRoot() && (healthCmd.SysProcAttr.Credential == nil || healthCmd.SysProcAttr.Credential.Uid != cmd.SysProcAttr.Credential.Uid) {
+		t.Errorf("expected health check credential of %s, got %+v", u.Username, healthCmd.SysProcAttr.Credential)
+	}
+	if err := program.RunHealthCheck(nil, attrs); err != nil {
+		t.Errorf("health check should run as %s: %v", u.Username, err)
+	}
+}
+
+// go test gosuv -v -run "TestReadFileAs"
+func TestReadFileAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosuv_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	path := filepath.Join(dir, "app.env")
+	ioutil.WriteFile(path, []byte("root:secret:17000::::::\n"), 0600)
+
+	// 其他用户不能读取
+	other := &syscall.Credential{Uid: uint32(os.Getuid()) + 12345, Gid: uint32(os.Getgid()) + 12345}
+	if _, err := readFileAs(path, other); !os.IsPermission(err) {
+		t.Errorf("expected permission denied, got %v", err)
+	}
+	if _, err := readEnvFile(path, "", other); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected env file rejected without its content, got %v", err)
+	}
+
+	// 同组可以读取
+	os.Chmod(path, 0640)
+	other.Groups = []uint32{uint32(os.Getgid())}
+	if data, err := readFileAs(path, other); err != nil || len(data) == 0 {
+		t.Errorf("expected file readable by group, got %v", err)
+	}
+
+	// 上级目录不能进入
+	os.Chmod(path, 0644)
+	os.Chmod(dir, 0700)
+	if _, err := readFileAs(path, &syscall.Credential{Uid: other.Uid, Gid: other.Gid}); !os.IsPermission(err) {
+		t.Errorf("expected permission denied by the directory, got %v", err)
+	}
+
+	// 解析错误不包含行的内容
+	os.Chmod(dir, 0755)
+	if _, err := readEnvFile(path, "", nil); err == nil || strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected parse error with line number only, got %v", err)
+	}
+}
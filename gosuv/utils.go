@@ -13,17 +13,22 @@ import (
 
 var ErrGoTimeout = errors.New("GoTimeoutFunc")
 
+//
+// 将命令行开头的环境变量赋值拆分出来, 例如:
+//   SENTRY_CONF="/etc/sentry" sentry run cron --> sentry run cron, [SENTRY_CONF=/etc/sentry]
+// newCmd保留原始的引号和转义, 交给shell执行
+//
 func PreprocessCommand(cmd string) (newCmd string, kvs []string) {
-	fields := strings.Split(cmd, " ")
-	i := 0
-	for ; i < len(fields); i++ {
-		if len(fields[i]) == 0 {
-			continue
-		}
-		if strings.Contains(fields[i], "=") {
-			kvs = append(kvs, fields[i])
+	words, err := splitShellWords(cmd)
+	if err != nil {
+		// 语法错误交给shell来报告
+		return strings.TrimSpace(cmd), nil
+	}
+	for _, word := range words {
+		if envAssignPattern.MatchString(word.Value) {
+			kvs = append(kvs, word.Value)
 		} else {
-			newCmd = strings.Join(fields[i:], " ")
+			newCmd = cmd[word.Start:]
 			break
 		}
 	}
@@ -6,14 +6,13 @@ import (
 	"github.com/flosch/pongo2"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/jinzhu/gorm"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	"github.com/wfxiang08/cyutils/utils/log"
 	"net/http"
-	"os"
 	"os/user"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 	"github.com/wfxiang08/gosuv/gosuv/gops"
 )
@@ -38,77 +37,99 @@ func NewSupervisorHandler(cfg *Configuration, logDir string) (suv *Supervisor, h
 	suv = &Supervisor{
 		ConfigDir:    DefaultConfigDir,
 		name2Program: make(map[string]*ProgramEx, 0),
-		dbType:       cfg.Db.DbType,
-		dbDSN:        cfg.Db.DbDsn,
 		Host:         cfg.Host,
 		cfg:          cfg,
 		logDir:       logDir,
+		scheduler:    NewScheduler(),
 	}
-
-	if false {
-		// 用于测试Table的创建
-		log.Printf("Before create Table succeed, %s, %s", suv.dbType, suv.dbDSN)
-		var db *gorm.DB
-		db, err = gorm.Open(suv.dbType, suv.dbDSN)
-		if err != nil {
-			log.ErrorErrorf(err, "failed to connect database")
+	// 配置错误直接退出; 数据库连接失败时进入降级模式, 参考: offline.go
+	if err = suv.initSnapshot(); err != nil {
+		return
+	}
+	if cfg.HasDatabase() {
+		if err = checkDBDriver(cfg); err != nil {
 			return
 		}
-		defer db.Close()
-
-		log.Printf("Before create Table succeed: %v, %s, %s", db.HasTable(&Program{}), suv.dbType, suv.dbDSN)
-		db.CreateTable(&Program{})
-		log.Printf("Create Table succeed")
-		os.Exit(1)
+		gRunJournal = NewRunJournal(cfg.Host, suv.DB)
+	} else {
+		log.Warnf("Database not configured, audit records, run history and api tokens are not saved")
+	}
+	if len(cfg.CgroupRoot) > 0 {
+		gCgroupRoot = cfg.CgroupRoot
+	}
+	gSecretsDir = cfg.SecretsDir
+	gSecretEnv = cfg.SecretEnv
+	if len(cfg.SecretKeyFile) > 0 {
+		if gSecretKey, err = ReadSecretKey(cfg.SecretKeyFile); err != nil {
+			// 没有密钥时, 使用sealed密码的进程无法启动
+			log.Warnf("Read secret key failed: %v", err)
+			err = nil
+		}
 	}
 
-	// log.Printf("Db Config: %s ==> %s", suv.dbType, suv.dbDSN)
-
+	// 从store加载, 启动时创建数据库连接池, 并自动创建/升级表结构
 	suv.namesMu.Lock()
-	err = suv.LoadDBWithLock()
+	err = suv.loadProgramsWithLock()
 	suv.namesMu.Unlock()
-	// 从DB加载
 	if err != nil {
 		return
 	}
+	go suv.watchStore()
 
 	// 顶一个各种API
+	// 所有的接口都需要检查权限, 参考: rbac.go
 	r := mux.NewRouter()
 
 	// 静态资源的配置， 参考头部 init 函数
-	r.HandleFunc("/", suv.hIndex)
-	r.HandleFunc("/prefs/{name}", suv.hPref)
-	r.HandleFunc("/prefs/{name}/{index}", suv.hPref)
+	r.HandleFunc("/", suv.requirePerm(PermView, suv.hIndex))
+	r.HandleFunc("/prefs/{name}", suv.requirePerm(PermView, suv.hPref))
+	r.HandleFunc("/prefs/{name}/{index}", suv.requirePerm(PermView, suv.hPref))
 
-	r.HandleFunc("/program/{name}/processes", suv.hProgram)
+	r.HandleFunc("/program/{name}/processes", suv.requirePerm(PermView, suv.hProgram))
 
-	r.HandleFunc("/api/status", suv.hStatus)
-	r.HandleFunc("/api/reload", suv.hReload).Methods("POST")
-	r.HandleFunc("/api/restart", suv.hRestartAll).Methods("POST")
+	r.HandleFunc("/api/status", suv.requirePerm(PermView, suv.hStatus))
+	r.HandleFunc("/api/reload", suv.requirePerm(PermAdmin, suv.hReload)).Methods("POST")
+	r.HandleFunc("/api/restart", suv.requirePerm(PermAdmin, suv.hRestartAll)).Methods("POST")
 
 	// 获取某个程序对应的所有的进程
-	r.HandleFunc("/api/processes/{name}", suv.hProcesslist).Methods("GET")
+	r.HandleFunc("/api/processes/{name}", suv.requirePerm(PermView, suv.hProcesslist)).Methods("GET")
 
 	// 开始结束某个进程
-	r.HandleFunc("/api/processes/{name}/{index}/start", suv.hStartProcess).Methods("POST")
-	r.HandleFunc("/api/processes/{name}/{index}/stop", suv.hStopProcess).Methods("POST")
-
-	r.HandleFunc("/api/programs", suv.hGetProgramList).Methods("GET")
-	r.HandleFunc("/api/programs/{name}", suv.hGetProgram).Methods("GET")
-	r.HandleFunc("/api/programs/{name}", suv.hDelProgram).Methods("DELETE")
-	r.HandleFunc("/api/programs/{name}", suv.hUpdateProgram).Methods("PUT")
-	r.HandleFunc("/api/programs", suv.hAddProgram).Methods("POST")
-	r.HandleFunc("/api/programs/{name}/start", suv.hStartProgram).Methods("POST")
-	r.HandleFunc("/api/programs/{name}/stop", suv.hStopProgram).Methods("POST")
+	r.HandleFunc("/api/processes/{name}/{index}/start", suv.requirePerm(PermManage, suv.hStartProcess)).Methods("POST")
+	r.HandleFunc("/api/processes/{name}/{index}/stop", suv.requirePerm(PermManage, suv.hStopProcess)).Methods("POST")
+	r.HandleFunc("/api/processes/{name}/{index}/signal", suv.requirePerm(PermManage, suv.hSignal)).Methods("POST")
+	r.HandleFunc("/api/processes/{name}/{index}/history", suv.requirePerm(PermView, suv.hProcessHistory)).Methods("GET")
+
+	r.HandleFunc("/api/programs", suv.requirePerm(PermView, suv.hGetProgramList)).Methods("GET")
+	r.HandleFunc("/api/programs/{name}", suv.requirePerm(PermView, suv.hGetProgram)).Methods("GET")
+	r.HandleFunc("/api/programs/{name}", suv.requirePerm(PermManage, suv.hDelProgram)).Methods("DELETE")
+	r.HandleFunc("/api/programs/{name}", suv.requirePerm(PermManage, suv.hUpdateProgram)).Methods("PUT")
+	r.HandleFunc("/api/programs", suv.requirePerm(PermCreate, suv.hAddProgram)).Methods("POST")
+	r.HandleFunc("/api/programs/{name}/start", suv.requirePerm(PermManage, suv.hStartProgram)).Methods("POST")
+	r.HandleFunc("/api/programs/{name}/stop", suv.requirePerm(PermManage, suv.hStopProgram)).Methods("POST")
+	r.HandleFunc("/api/programs/{name}/rolling-restart", suv.requirePerm(PermManage, suv.hRollingRestartProgram)).Methods("POST")
+	r.HandleFunc("/api/programs/{name}/signal", suv.requirePerm(PermManage, suv.hSignal)).Methods("POST")
+	r.HandleFunc("/api/programs/{name}/runs", suv.requirePerm(PermView, suv.hGetProgramRuns)).Methods("GET")
+	r.HandleFunc("/api/secrets/seal", suv.requirePerm(PermCreate, suv.hSealSecret)).Methods("POST")
+
+	// 操作记录
+	r.HandleFunc("/audit", suv.requirePerm(PermView, suv.hAudit))
+	r.HandleFunc("/api/audit", suv.requirePerm(PermView, suv.hGetAudit)).Methods("GET")
+
+	// 自动化脚本使用的Token
+	r.HandleFunc("/tokens", suv.requirePerm(PermTokens, suv.hTokens))
+	r.HandleFunc("/api/tokens", suv.requirePerm(PermTokens, suv.hGetTokens)).Methods("GET")
+	r.HandleFunc("/api/tokens", suv.requirePerm(PermTokens, suv.hCreateToken)).Methods("POST")
+	r.HandleFunc("/api/tokens/{id}", suv.requirePerm(PermTokens, suv.hRevokeToken)).Methods("DELETE")
 
 	// 通知客户端有Events发生
-	r.HandleFunc("/ws/events", suv.wsEvents)
+	r.HandleFunc("/ws/events", suv.requirePerm(PermView, suv.wsEvents))
 
-	r.HandleFunc("/ws/logs/{name}", suv.wsLog)
-	r.HandleFunc("/ws/logs/{name}/{index}", suv.wsLog)
+	r.HandleFunc("/ws/logs/{name}", suv.requirePerm(PermView, suv.wsLog))
+	r.HandleFunc("/ws/logs/{name}/{index}", suv.requirePerm(PermView, suv.wsLog))
 
-	r.HandleFunc("/ws/perfs/{name}", suv.wsPerf)
-	r.HandleFunc("/ws/perfs/{name}/{index}", suv.wsPerf)
+	r.HandleFunc("/ws/perfs/{name}", suv.requirePerm(PermView, suv.wsPerf))
+	r.HandleFunc("/ws/perfs/{name}/{index}", suv.requirePerm(PermView, suv.wsPerf))
 
 	return suv, r, nil
 }
@@ -175,29 +196,87 @@ func (s *Supervisor) hProcesslist(w http.ResponseWriter, r *http.Request) {
 	defer s.namesMu.Unlock()
 
 	program := s.name2Program[programName]
-	processes := program.Processes
+	processes := program.processList()
 	WriteJSON(w, processes)
 }
 
+//
+// 进程最近的运行记录, 最新的在前: 本次gosuv运行期间的记录在内存中, 之前的记录从数据库读取
+//
+func (s *Supervisor) hProcessHistory(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  "invalid process index",
+		})
+		return
+	}
+
+	s.namesMu.Lock()
+	program, ok := s.name2Program[name]
+	s.namesMu.Unlock()
+	if !ok {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  fmt.Sprintf("Program %s not exists", strconv.Quote(name)),
+		})
+		return
+	}
+
+	runs := program.History(index)
+	before := time.Now()
+	if len(runs) > 0 {
+		// 数据库中的时间可能只精确到秒
+		before = runs[len(runs)-1].StartedAt.Truncate(time.Second)
+	}
+	dbRuns, err := gRunJournal.History(name, index, before, MaxProcessRuns-len(runs))
+	if err != nil {
+		log.Warnf("Read run history of %s failed: %v", name, err)
+	}
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  append(runs, dbRuns...),
+	})
+}
+
 // 当前服务的状态: 活着
+//
+// degraded: 数据库不可用, Program从本地快照加载(不能修改), 参考: offline.go
+//
 func (s *Supervisor) hStatus(w http.ResponseWriter, r *http.Request) {
-	WriteJSON(w, map[string]interface{}{
-		"status": 0,
-		"value":  "server is running",
-	})
+	data := map[string]interface{}{
+		"status":   0,
+		"value":    "server is running",
+		"degraded": false,
+	}
+	if offline := s.offlineState(); offline != nil {
+		data["degraded"] = true
+		data["degraded_since"] = offline.Since
+		data["degraded_error"] = offline.Err.Error()
+	}
+	WriteJSON(w, data)
 }
 
 //
 // 重新加载配置文件
+// dry_run=1或者hash=xxx时, 先返回计划, 确认之后再执行, 参考: hReloadPlan
 //
 func (s *Supervisor) hReload(w http.ResponseWriter, r *http.Request) {
 	s.namesMu.Lock()
 	defer s.namesMu.Unlock()
 
+	if dryRun, hash := formBoolValue(r, "dry_run"), r.FormValue("hash"); dryRun || len(hash) > 0 {
+		s.hReloadPlan(w, r, dryRun, hash)
+		return
+	}
+
 	err := s.LoadDBWithLock()
 
 	ldapUser := r.Header.Get(LdapUserKey)
 	log.Printf("操作: %s Reload config file", ldapUser)
+	s.audit(r, &AuditRecord{Action: AuditReload}, err)
 
 	if err == nil {
 		WriteJSON(w, JSONResponse{
@@ -205,18 +284,18 @@ func (s *Supervisor) hReload(w http.ResponseWriter, r *http.Request) {
 			Value:  "load config success",
 		})
 	} else {
-		WriteJSON(w, JSONResponse{
+		WriteJSONStatus(w, errorHTTPStatus(err), JSONResponse{
 			Status: 1,
 			Value:  err.Error(),
 		})
 	}
 }
 
-func (s *Supervisor) RestartAll() {
-	log.Println("操作: Restart All Program")
+func (s *Supervisor) RestartAll(opUser string) {
+	log.Printf("操作: %s Restart All Program", opUser)
 	for name, program := range s.name2Program {
 		log.Printf("操作: Restart program: %s", name)
-		program.RestartAll()
+		program.RestartAll(opUser)
 	}
 }
 
@@ -227,7 +306,8 @@ func (s *Supervisor) hRestartAll(w http.ResponseWriter, r *http.Request) {
 	s.namesMu.Lock()
 	defer s.namesMu.Unlock()
 
-	s.RestartAll()
+	s.RestartAll(r.Header.Get(LdapUserKey))
+	s.audit(r, &AuditRecord{Action: AuditRestartAll}, nil)
 	WriteJSON(w, JSONResponse{
 		Status: 0,
 		Value:  "Restart All Success",
@@ -257,13 +337,55 @@ func (s *Supervisor) hGetProgram(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	} else {
+		// 每个进程最近一次启动时实际使用的环境变量(隐藏密码)
+		processes := proc.processList()
+		environ := make(map[string][]string, len(processes))
+		for _, process := range processes {
+			if process != nil {
+				environ[process.ProcessName] = process.EffectiveEnviron()
+			}
+		}
 		WriteJSON(w, JSONResponse{
 			Status: 0,
-			Value:  proc,
+			Value: struct {
+				*ProgramEx
+				EffectiveEnviron map[string][]string `json:"effective_environ"`
+			}{proc, environ},
 		})
 	}
 }
 
+// 定时任务最近的运行记录
+func (s *Supervisor) hGetProgramRuns(w http.ResponseWriter, r *http.Request) {
+	s.namesMu.Lock()
+	defer s.namesMu.Unlock()
+
+	name := mux.Vars(r)["name"]
+	program, ok := s.name2Program[name]
+	if !ok {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  "program not exists",
+		})
+		return
+	}
+
+	var nextRun *time.Time
+	if program.IsScheduled() && program.StartAuto {
+		if next, err := program.NextScheduleTime(time.Now()); err == nil {
+			nextRun = &next
+		}
+	}
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value: map[string]interface{}{
+			"schedule": program.Schedule,
+			"next_run": nextRun,
+			"runs":     program.Runs(),
+		},
+	})
+}
+
 func (s *Supervisor) normalizeUser(userName string, r *http.Request) string {
 	// 只有Root账号启动的supervisor才有选择账号的权利
 	if IsRoot() {
@@ -316,21 +438,152 @@ func (s *Supervisor) hAddProgram(w http.ResponseWriter, r *http.Request) {
 		stopTimeout = 5
 	}
 
+	// 重启策略(可选参数)
+	restartDelay, err := formIntValue(r, "restart_delay", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	restartMaxDelay, err := formIntValue(r, "restart_max_delay", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	restartResetSeconds, err := formIntValue(r, "restart_reset_seconds", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	restartBackoff, err := formFloatValue(r, "restart_backoff", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	exitCodes, err := formIntListValue(r, "exit_codes")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	basePort, err := formIntValue(r, "base_port", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	priority, err := formIntValue(r, "priority", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 定时任务(可选参数)
+	scheduleJitter, err := formIntValue(r, "schedule_jitter", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 资源限制(可选参数)
+	limits, err := ParseLimits(r.FormValue("limits"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cpuQuota, err := formIntValue(r, "cpu_quota", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pidsMax, err := formIntValue(r, "pids_max", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 健康检查(可选参数)
+	healthCheckInterval, err := formIntValue(r, "health_check_interval", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	healthCheckTimeout, err := formIntValue(r, "health_check_timeout", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	healthCheckThreshold, err := formIntValue(r, "health_check_threshold", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 是否通过shell运行, 没有设置时使用默认值
+	var shell *bool
+	switch r.FormValue("shell") {
+	case "true", "on", "1":
+		value := true
+		shell = &value
+	case "false", "off", "0":
+		value := false
+		shell = &value
+	}
+
 	pg := &Program{
 		Name:         r.FormValue("name"),
 		Command:      r.FormValue("command"),
+		Args:         formLinesValue(r, "args"),
+		Shell:        shell,
 		Dir:          r.FormValue("dir"),
 		User:         r.FormValue("user"),
+		Group:        strings.TrimSpace(r.FormValue("group")),
+		Umask:        strings.TrimSpace(r.FormValue("umask")),
 		Author:       r.FormValue("author"),
+		Owners:       formStringListValue(r, "owners"),
+		OwnerGroups:  formStringListValue(r, "owner_groups"),
 		StopTimeout:  stopTimeout,
+		StopSignal:   r.FormValue("stop_signal"),
+		StopSequence: r.FormValue("stop_sequence"),
 		ProcessNum:   processNum, // 进程数字
+		BasePort:     basePort,
+
+		Schedule:          strings.TrimSpace(r.FormValue("schedule")),
+		ScheduleTimezone:  strings.TrimSpace(r.FormValue("schedule_timezone")),
+		ScheduleJitter:    scheduleJitter,
+		ConcurrencyPolicy: r.FormValue("concurrency_policy"),
+
+		MemoryMax:    strings.TrimSpace(r.FormValue("memory_max")),
+		CpuQuota:     cpuQuota,
+		PidsMax:      pidsMax,
+		Limits:       limits,
+		EnvFiles:     formStringListValue(r, "env_files"),
+		CleanEnv:     r.FormValue("clean_env") == "on",
+		PassEnv:      formStringListValue(r, "pass_env"),
 		StartAuto:    r.FormValue("autostart") == "on",
 		StartRetries: retries,
+
+		DependsOn:           formStringListValue(r, "depends_on"),
+		Priority:            priority,
+		ExitCodes:           exitCodes,
+		RestartPolicy:       r.FormValue("restart_policy"),
+		RestartMode:         r.FormValue("restart_mode"),
+		RestartDelay:        restartDelay,
+		RestartMaxDelay:     restartMaxDelay,
+		RestartBackoff:      restartBackoff,
+		RestartResetSeconds: restartResetSeconds,
+
+		HealthCheck:          r.FormValue("health_check"),
+		HealthCheckTarget:    r.FormValue("health_check_target"),
+		HealthCheckInterval:  healthCheckInterval,
+		HealthCheckTimeout:   healthCheckTimeout,
+		HealthCheckThreshold: healthCheckThreshold,
 	}
 	if pg.Dir == "" {
 		pg.Dir = "/"
 	}
+	auditRecord := &AuditRecord{Action: AuditAddProgram, Program: pg.Name, After: auditJSON(pg)}
 	if err := pg.Check(); err != nil {
+		s.audit(r, auditRecord, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -341,9 +594,11 @@ func (s *Supervisor) hAddProgram(w http.ResponseWriter, r *http.Request) {
 	if len(userName) == 0 {
 		// 无效的用户名
 		// 无效的用户名
+		err := fmt.Errorf("Invalid user: %s, contact system admin", pg.User)
+		s.audit(r, auditRecord, err)
 		WriteJSON(w, map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Invalid user: %s, contact system admin", pg.User),
+			"error":  err.Error(),
 		})
 		return
 	}
@@ -353,9 +608,11 @@ func (s *Supervisor) hAddProgram(w http.ResponseWriter, r *http.Request) {
 	defer s.namesMu.Unlock()
 
 	if _, ok := s.name2Program[pg.Name]; ok {
+		err := fmt.Errorf("Program %s already exists", strconv.Quote(pg.Name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Program %s already exists", strconv.Quote(pg.Name)),
+			"error":  err.Error(),
 		}
 	} else {
 		// 记录当前用户
@@ -366,12 +623,12 @@ func (s *Supervisor) hAddProgram(w http.ResponseWriter, r *http.Request) {
 		ldapUser := r.Header.Get(LdapUserKey)
 		log.Printf("操作: %s add program: %s, Cmd: %s", ldapUser, pg.Name, pg.Command)
 
-		if err := s.addOrUpdateProgram(pg, true); err != nil {
-
-			data = map[string]interface{}{
-				"status": 1,
-				"error":  err.Error(),
-			}
+		err := s.addOrUpdateProgram(pg, true)
+		auditRecord.After = auditJSON(pg)
+		s.audit(r, auditRecord, err)
+		if err != nil {
+			writeProgramError(w, 1, err)
+			return
 		} else {
 			data = map[string]interface{}{
 				"status": 0,
@@ -381,6 +638,69 @@ func (s *Supervisor) hAddProgram(w http.ResponseWriter, r *http.Request) {
 	WriteJSON(w, data)
 }
 
+// 返回错误: {"status": status, "error": "..."}, 读写store失败时http状态为500
+func writeProgramError(w http.ResponseWriter, status int, err error) {
+	WriteJSONStatus(w, errorHTTPStatus(err), map[string]interface{}{
+		"status": status,
+		"error":  err.Error(),
+	})
+}
+
+// 读取可选的整数参数, 没有设置时返回默认值
+func formIntValue(r *http.Request, key string, defValue int) (int, error) {
+	value := r.FormValue(key)
+	if len(value) == 0 {
+		return defValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// 读取可选的浮点数参数, 没有设置时返回默认值
+func formFloatValue(r *http.Request, key string, defValue float64) (float64, error) {
+	value := r.FormValue(key)
+	if len(value) == 0 {
+		return defValue, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// 读取逗号分隔的字符串列表, 例如: depends_on=redis,mysql
+func formStringListValue(r *http.Request, key string) []string {
+	var result []string
+	for _, field := range strings.Split(r.FormValue(key), ",") {
+		field = strings.TrimSpace(field)
+		if len(field) > 0 {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// 读取多行文本, 每行一个元素(忽略空行)
+func formLinesValue(r *http.Request, key string) []string {
+	var result []string
+	for _, line := range strings.Split(r.FormValue(key), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(strings.TrimSpace(line)) > 0 {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// 读取逗号分隔的整数列表, 例如: exit_codes=0,2
+func formIntListValue(r *http.Request, key string) ([]int, error) {
+	var result []int
+	for _, field := range formStringListValue(r, key) {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
 func (s *Supervisor) hUpdateProgram(w http.ResponseWriter, r *http.Request) {
 	pg := Program{}
 	err := json.NewDecoder(r.Body).Decode(&pg)
@@ -392,17 +712,27 @@ func (s *Supervisor) hUpdateProgram(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 权限是按照路由中的name检查的, 不能修改其他的Program
+	if name := mux.Vars(r)["name"]; pg.Name != name {
+		writeForbidden(w, fmt.Errorf("Program name mismatch: %s != %s", strconv.Quote(pg.Name), strconv.Quote(name)))
+		return
+	}
+
 	// 可以更新数据
 	if pg.StopTimeout < 5 {
 		pg.StopTimeout = 5
 	}
 
+	auditRecord := &AuditRecord{Action: AuditUpdateProgram, Program: pg.Name}
 	userName := s.normalizeUser(pg.User, r)
 	if len(userName) == 0 {
 		// 无效的用户名
+		err := fmt.Errorf("Invalid user: %s, contact system admin", pg.User)
+		auditRecord.After = auditJSON(pg)
+		s.audit(r, auditRecord, err)
 		WriteJSON(w, map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Invalid user: %s, contact system admin", pg.User),
+			"error":  err.Error(),
 		})
 		return
 	}
@@ -413,16 +743,24 @@ func (s *Supervisor) hUpdateProgram(w http.ResponseWriter, r *http.Request) {
 		pg.Author = r.Header.Get(LdapUserKey)
 	}
 	pg.Host = s.Host // 所有的操作都和本机的host相关
+
+	// 记录修改前后的Program(更新时会直接修改原来的Program)
+	if program, ok := s.name2Program[pg.Name]; ok {
+		auditRecord.Before = auditJSON(program.Program)
+	}
 	err = s.addOrUpdateProgram(&pg, true)
+	if program, ok := s.name2Program[pg.Name]; ok && err == nil {
+		auditRecord.After = auditJSON(program.Program)
+	} else {
+		auditRecord.After = auditJSON(pg)
+	}
 	s.namesMu.Unlock()
+	s.audit(r, auditRecord, err)
 
 	ldapUser := r.Header.Get(LdapUserKey)
 	log.Printf("操作: %s update program: %s, Cmd: %s", ldapUser, pg.Name, pg.Command)
 	if err != nil {
-		WriteJSON(w, map[string]interface{}{
-			"status": 2,
-			"error":  err.Error(),
-		})
+		writeProgramError(w, 2, err)
 		return
 	} else {
 		WriteJSON(w, map[string]interface{}{
@@ -443,16 +781,25 @@ func (s *Supervisor) hDelProgram(w http.ResponseWriter, r *http.Request) {
 	s.namesMu.Lock()
 	defer s.namesMu.Unlock()
 
+	auditRecord := &AuditRecord{Action: AuditDeleteProgram, Program: name}
 	if _, ok := s.name2Program[name]; !ok {
+		err := fmt.Errorf("Program %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Program %s not exists", strconv.Quote(name)),
+			"error":  err.Error(),
 		}
 	} else {
 		ldapUser := r.Header.Get(LdapUserKey)
 		log.Printf("操作: %s delete program: %s, Cmd: %s", ldapUser, name, s.name2Program[name].Command)
 
-		s.removeProgram(name)
+		auditRecord.Before = auditJSON(s.name2Program[name].Program)
+		_, err := s.removeProgram(name, true)
+		s.audit(r, auditRecord, err)
+		if err != nil {
+			writeProgramError(w, 1, err)
+			return
+		}
 
 		data = map[string]interface{}{
 			"status": 0,
@@ -468,25 +815,33 @@ func (s *Supervisor) hStartProgram(w http.ResponseWriter, r *http.Request) {
 	program, ok := s.name2Program[name]
 
 	var data map[string]interface{}
+	auditRecord := &AuditRecord{Action: AuditStartProgram, Program: name}
 	if !ok {
+		err := fmt.Errorf("Process %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Process %s not exists", strconv.Quote(name)),
+			"error":  err.Error(),
 		}
 	} else {
 		ldapUser := r.Header.Get(LdapUserKey)
 		program.StartAll(ldapUser)
+		gEventPub.PostEvent(fmt.Sprintf("Program %s Started", name))
 
-		// 记住之前的状态
+		// 记住之前的状态; 保存失败时进程的状态已经修改, 只是gosuv重启之后不会保持
 		program.StartAuto = true
-		s.dbUpdateProgram(program.Program)
+		err := s.dbUpdateProgram(program.Program)
+		s.audit(r, auditRecord, err)
+		if err != nil {
+			writeProgramError(w, 1, err)
+			return
+		}
 
 		data = map[string]interface{}{
 			"status": 0,
 			"name":   name,
 		}
 	}
-	gEventPub.PostEvent(fmt.Sprintf("Program %s Started", program.Name))
 	WriteJSON(w, data)
 }
 
@@ -497,28 +852,180 @@ func (s *Supervisor) hStopProgram(w http.ResponseWriter, r *http.Request) {
 	program, ok := s.name2Program[name]
 
 	var data map[string]interface{}
+	auditRecord := &AuditRecord{Action: AuditStopProgram, Program: name}
 	if !ok {
+		err := fmt.Errorf("Process %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Process %s not exists", strconv.Quote(name)),
+			"error":  err.Error(),
 		}
 	} else {
 		ldapUser := r.Header.Get(LdapUserKey)
 		program.StopAll(ldapUser)
+		gEventPub.PostEvent(fmt.Sprintf("Program %s Stopped", name))
 
-		// 记住之前的状态
+		// 记住之前的状态; 保存失败时进程的状态已经修改, 只是gosuv重启之后不会保持
 		program.StartAuto = false
-		s.dbUpdateProgram(program.Program)
+		err := s.dbUpdateProgram(program.Program)
+		s.audit(r, auditRecord, err)
+		if err != nil {
+			writeProgramError(w, 1, err)
+			return
+		}
 
 		data = map[string]interface{}{
 			"status": 0,
 			"name":   name,
 		}
 	}
-	gEventPub.PostEvent(fmt.Sprintf("Program %s Stopped", program.Name))
 	WriteJSON(w, data)
 }
 
+//
+// 滚动重启Program的所有进程
+// 参数: batch_size 每批重启的进程数(默认为1), pause 两批之间的间隔(单位:s)
+//
+func (s *Supervisor) hRollingRestartProgram(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	batchSize, err := formIntValue(r, "batch_size", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pause, err := formIntValue(r, "pause", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 滚动重启比较耗时，不能一直持有Lock
+	s.namesMu.Lock()
+	program, ok := s.name2Program[name]
+	s.namesMu.Unlock()
+
+	auditRecord := &AuditRecord{
+		Action:  AuditRollingRestart,
+		Program: name,
+		Params:  auditParams("batch_size", strconv.Itoa(batchSize), "pause", strconv.Itoa(pause)),
+	}
+	if !ok {
+		err := fmt.Errorf("Program %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	// 滚动重启可能需要很长时间(多批, pause, 等待健康检查), 在后台执行, 结束之后再写入操作记录
+	ldapUser := r.Header.Get(LdapUserKey)
+	err = program.StartRollingRestart(ldapUser, batchSize, time.Duration(pause)*time.Second, func(err error) {
+		s.audit(r, auditRecord, err)
+	})
+	if err != nil {
+		s.audit(r, auditRecord, err)
+		WriteJSONStatus(w, http.StatusConflict, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+	} else {
+		WriteJSON(w, JSONResponse{
+			Status: 0,
+			Value:  fmt.Sprintf("Program %s rolling restart started", name),
+		})
+	}
+}
+
+//
+// 给Program的所有进程(或者指定index的进程)发送信号
+// 参数: signal 例如: HUP, SIGUSR1, 10
+//
+func (s *Supervisor) hSignal(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	sig, err := ParseSignal(r.FormValue("signal"))
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	s.namesMu.Lock()
+	defer s.namesMu.Unlock()
+	program, ok := s.name2Program[name]
+
+	indexStr := mux.Vars(r)["index"]
+	auditRecord := &AuditRecord{
+		Action:  AuditSignal,
+		Program: name,
+		Process: indexStr,
+		Params:  auditParams("signal", r.FormValue("signal")),
+	}
+	if !ok {
+		err := fmt.Errorf("Program %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+
+	ldapUser := r.Header.Get(LdapUserKey)
+	if len(indexStr) > 0 {
+		index, _ := strconv.ParseInt(indexStr, 10, 64)
+		err = program.SignalOne(ldapUser, int(index), sig)
+	} else {
+		err = program.SignalAll(ldapUser, sig)
+	}
+	s.audit(r, auditRecord, err)
+
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+	} else {
+		WriteJSON(w, JSONResponse{
+			Status: 0,
+			Value:  fmt.Sprintf("Send %v to %s success", sig, name),
+		})
+	}
+}
+
+// 使用supervisor的密钥加密密码, 返回可以放在environ中的引用
+func (s *Supervisor) hSealSecret(w http.ResponseWriter, r *http.Request) {
+	value := r.FormValue("value")
+	if len(value) == 0 {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  "secret value empty",
+		})
+		return
+	}
+
+	// 不记录密码本身
+	ref, err := SealSecret(value)
+	s.audit(r, &AuditRecord{Action: AuditSealSecret}, err)
+	if err != nil {
+		WriteJSON(w, JSONResponse{
+			Status: 1,
+			Value:  err.Error(),
+		})
+		return
+	}
+	log.Printf("操作: %s seal secret", r.Header.Get(LdapUserKey))
+	WriteJSON(w, JSONResponse{
+		Status: 0,
+		Value:  ref,
+	})
+}
+
 func (s *Supervisor) hStartProcess(w http.ResponseWriter, r *http.Request) {
 
 	name := mux.Vars(r)["name"]
@@ -531,16 +1038,20 @@ func (s *Supervisor) hStartProcess(w http.ResponseWriter, r *http.Request) {
 	index, _ := strconv.ParseInt(indexStr, 10, 64)
 
 	var data map[string]interface{}
+	auditRecord := &AuditRecord{Action: AuditStartProcess, Program: name, Process: indexStr}
 	if !ok {
+		err := fmt.Errorf("Process %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Process %s not exists", strconv.Quote(name)),
+			"error":  err.Error(),
 		}
 	} else {
 		ldapUser := r.Header.Get(LdapUserKey)
 		log.Printf("操作: %s start process: %s, index: %d", ldapUser, program.Name, index)
+		s.audit(r, auditRecord, nil)
 		program.Merger.WriteStrLine(fmt.Sprintf("操作: %s start process: %s, index: %d\n", ldapUser, program.Name, index))
-		program.StartOne(int(index))
+		program.StartOne(ldapUser, int(index))
 
 		data = map[string]interface{}{
 			"status": 0, // 开始成功
@@ -562,17 +1073,21 @@ func (s *Supervisor) hStopProcess(w http.ResponseWriter, r *http.Request) {
 	index, _ := strconv.ParseInt(indexStr, 10, 64)
 
 	var data map[string]interface{}
+	auditRecord := &AuditRecord{Action: AuditStopProcess, Program: name, Process: indexStr}
 	if !ok {
+		err := fmt.Errorf("Process %s not exists", strconv.Quote(name))
+		s.audit(r, auditRecord, err)
 		data = map[string]interface{}{
 			"status": 1,
-			"error":  fmt.Sprintf("Process %s not exists", strconv.Quote(name)),
+			"error":  err.Error(),
 		}
 	} else {
 		ldapUser := r.Header.Get(LdapUserKey)
 		log.Printf("操作: %s stop process: %s, index: %d", ldapUser, program.Name, index)
+		s.audit(r, auditRecord, nil)
 		program.Merger.WriteStrLine(fmt.Sprintf("操作: %s stop process: %s, index: %d\n", ldapUser, program.Name, index))
 
-		program.StopOne(int(index))
+		program.StopOne(ldapUser, int(index))
 		data = map[string]interface{}{
 			"status": 0,
 			"name":   name,
@@ -688,7 +1203,10 @@ func (s *Supervisor) wsLog(w http.ResponseWriter, r *http.Request) {
 
 	var output *QuickLossBroadcastWriter
 	if index >= 0 {
-		process := program.Processes[index]
+		process := program.processAt(int(index))
+		if process == nil {
+			return
+		}
 		output = process.Output
 	} else {
 		output = program.Output
@@ -722,11 +1240,11 @@ func (s *Supervisor) wsPerf(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		var processes []*Process
 		if index >= 0 {
-			processes = []*Process{
-				program.Processes[index],
+			if process := program.processAt(int(index)); process != nil {
+				processes = []*Process{process}
 			}
 		} else {
-			processes = program.Processes
+			processes = program.processList()
 		}
 
 		for {
@@ -5,6 +5,7 @@ import (
 	"github.com/flosch/pongo2"
 	"net/http"
 	"os/user"
+	"strings"
 )
 
 type JSONResponse struct {
@@ -16,6 +17,11 @@ type JSONResponse struct {
 // 将result以JSON格式返回
 //
 func WriteJSON(w http.ResponseWriter, result interface{}) {
+	WriteJSONStatus(w, http.StatusOK, result)
+}
+
+// 返回JSON, 并指定http状态, 例如: 403, 500
+func WriteJSONStatus(w http.ResponseWriter, code int, result interface{}) {
 	data, err := json.Marshal(result)
 
 	if err != nil {
@@ -23,18 +29,20 @@ func WriteJSON(w http.ResponseWriter, result interface{}) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
 	w.Write(data)
 }
 
 // 添加ldap账号信息
 // https://stackoverflow.com/questions/28384343/golang-accessing-a-map-using-its-reference
 func (s *Supervisor) injectUserInfo(r *http.Request, data pongo2.Context) {
-	ldapUser := r.Header.Get(LdapUserKey)
-	isAdmin := containsString(s.cfg.Admins, ldapUser)
-	// log.Printf("Ldap User: %s, is_admin: %v, admins: %s", ldapUser, isAdmin, strings.Join(s.cfg.Admins, ", "))
-	// 管理员可以控制其他所有的脚本
-	data["LdapUser"] = ldapUser
-	data["IsAdmin"] = isAdmin
+	user := s.requestUser(r)
+	// log.Printf("Ldap User: %s, role: %s, groups: %s", user.Name, user.Role, strings.Join(user.Groups, ", "))
+	// 管理员可以控制其他所有的脚本; 页面上只是隐藏按钮, 权限以服务端的检查为准
+	data["LdapUser"] = user.Name
+	data["LdapGroups"] = strings.Join(user.Groups, ",")
+	data["Role"] = user.Role
+	data["IsAdmin"] = user.Role == RoleAdmin
 }
 
 //
@@ -55,6 +63,9 @@ func (s *Supervisor) renderHTML(w http.ResponseWriter, r *http.Request, filePath
 		}
 	}
 	s.injectUserInfo(r, data)
+	if offline := s.offlineState(); offline != nil {
+		data["Degraded"] = offline.Err.Error()
+	}
 
 	// 默认是text/html格式
 	w.Header().Set("Content-Type", "text/html")
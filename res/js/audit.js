@@ -0,0 +1,69 @@
+/* audit.js */
+var PAGE_SIZE = 100;
+
+var vm = new Vue({
+    el: "#app",
+    data: {
+        filter: {
+            user: '',
+            program: filterProgram,
+            since: '',
+            until: ''
+        },
+        records: [],
+        hasMore: false,
+        detail: 0,
+        host: host
+    },
+    methods: {
+        search: function () {
+            this.records = [];
+            this.load(0);
+        },
+        loadMore: function () {
+            this.load(this.records.length);
+        },
+        load: function (offset) {
+            var that = this;
+            var params = $.extend({limit: PAGE_SIZE, offset: offset}, this.filter);
+            $.ajax({
+                url: "/" + vm.host + "/api/audit",
+                data: params,
+                success: function (data) {
+                    if (data.status === 0) {
+                        that.records = that.records.concat(data.value);
+                        that.hasMore = data.value.length === PAGE_SIZE;
+                    } else {
+                        alertify.error(data.value);
+                    }
+                }
+            });
+        },
+        toggleDetail: function (record) {
+            this.detail = this.detail === record.id ? 0 : record.id;
+        },
+        // 修改前后不同的字段
+        diffProgram: function (record) {
+            var before = record.before ? JSON.parse(record.before) : {};
+            var after = record.after ? JSON.parse(record.after) : {};
+            var keys = _.union(Object.keys(before), Object.keys(after)).sort();
+            var changes = [];
+            for (var i = 0; i < keys.length; i++) {
+                var b = JSON.stringify(before[keys[i]]);
+                var a = JSON.stringify(after[keys[i]]);
+                if (b !== a) {
+                    changes.push({key: keys[i], before: b || "", after: a || ""});
+                }
+            }
+            return changes;
+        }
+    }
+});
+
+Vue.filter('formatTime', function (value) {
+    return value ? moment(value).format("YYYY-MM-DD HH:mm:ss") : "-";
+});
+
+$(function () {
+    vm.search();
+});
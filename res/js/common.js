@@ -13,6 +13,15 @@ function getQueryString(name) {
     return null;
 }
 
+// ajax请求失败(例如: 403, 500)时的错误信息: {"error": ...} 或者 {"value": ...}
+function ajaxErrorMessage(err) {
+    var data = err.responseJSON;
+    if (data && (data.error || data.value)) {
+        return data.error || data.value;
+    }
+    return err.responseText || err.statusText;
+}
+
 // 如何使用websocket通信呢?
 function newWebsocket(pathname, opts) {
 
@@ -45,6 +54,83 @@ function formatBytes(value) {
     else return (bytes / 1073741824).toFixed(1) + " GB";
 }
 
+// 将 "a, b" 或 ["a", "b"] 转换成字符串数组
+function parseStringList(value) {
+    if (value === null || value === undefined) {
+        return [];
+    }
+    if (typeof value !== "string") {
+        value = value.join(",");
+    }
+    return value.split(",").map(function (v) {
+        return v.trim();
+    }).filter(function (v) {
+        return v.length > 0;
+    });
+}
+
+// 当前用户能否操作Program(启停, 编辑, 删除), 只用于隐藏按钮, 权限以服务端的检查为准
+function canManageProgram(p, user, groups, role) {
+    if (role === "admin") {
+        return true;
+    }
+    if (role !== "operator" || !user) {
+        return false;
+    }
+    if (parseStringList(p.author).indexOf(user) != -1 || parseStringList(p.owners).indexOf(user) != -1) {
+        return true;
+    }
+    var ownerGroups = parseStringList(p.owner_groups);
+    return parseStringList(groups).some(function (g) {
+        return ownerGroups.indexOf(g) != -1;
+    });
+}
+
+// 将多行文本 或 ["a", "b"] 转换成字符串数组(每行一个元素)
+function parseLines(value) {
+    if (value === null || value === undefined) {
+        return [];
+    }
+    if (typeof value !== "string") {
+        return value;
+    }
+    return value.split("\n").filter(function (v) {
+        return v.trim().length > 0;
+    });
+}
+
+// 将 {nofile: "65535"} 转换成 "nofile=65535"
+function formatLimits(value) {
+    if (value === null || value === undefined || typeof value === "string") {
+        return value || "";
+    }
+    return Object.keys(value).sort().map(function (k) {
+        return k + "=" + value[k];
+    }).join(", ");
+}
+
+// 将 "nofile=65535, core=unlimited" 转换成 {nofile: "65535", core: "unlimited"}
+function parseLimits(value) {
+    if (value !== null && typeof value === "object") {
+        return value;
+    }
+    var limits = {};
+    parseStringList(value).forEach(function (item) {
+        var i = item.indexOf("=");
+        if (i > 0) {
+            limits[item.substr(0, i).trim()] = item.substr(i + 1).trim();
+        }
+    });
+    return limits;
+}
+
+// 将 "0,2" 或 [0, 2] 转换成exit code的数组
+function parseExitCodes(value) {
+    return parseStringList(value).map(function (v) {
+        return parseInt(v);
+    });
+}
+
 // 如何处理tooltip
 $(function () {
     $(".tooltip-wraper").tooltip();
@@ -32,9 +32,17 @@ var vm = new Vue({
         },
         host: host,
         current_user: current_user,
+        current_groups: current_groups,
+        user_role: user_role,
         is_admin: is_admin
     },
     methods: {
+        canManage: function (p) {
+            return canManageProgram(p, this.current_user, this.current_groups, this.user_role);
+        },
+        canCreate: function () {
+            return this.user_role === "admin" || this.user_role === "operator";
+        },
         addNewProgram: function () {
             console.log("Add");
             var form = $("#form_new_program");
@@ -49,6 +57,9 @@ var vm = new Vue({
             // 参数从哪儿来? 直接是一个javascript对象?
             //
             this.edit.program = Object.assign({}, p);
+            this.edit.program.args = parseLines(this.edit.program.args).join("\n");
+            this.edit.program.shell = String(this.edit.program.shell !== false);
+            this.edit.program.limits = formatLimits(this.edit.program.limits);
             $("#program_edit").modal('show');
 
         },
@@ -59,6 +70,27 @@ var vm = new Vue({
             p.start_retries = parseInt(p.start_retries);
             p.process_num = parseInt(p.process_num);
             p.stop_timeout = parseInt(p.stop_timeout);
+            p.restart_delay = parseInt(p.restart_delay);
+            p.restart_max_delay = parseInt(p.restart_max_delay);
+            p.restart_backoff = parseFloat(p.restart_backoff);
+            p.restart_reset_seconds = parseInt(p.restart_reset_seconds);
+            p.exit_codes = parseExitCodes(p.exit_codes);
+            p.depends_on = parseStringList(p.depends_on);
+            p.owners = parseStringList(p.owners);
+            p.owner_groups = parseStringList(p.owner_groups);
+            p.args = parseLines(p.args);
+            p.shell = String(p.shell) !== "false";
+            p.priority = parseInt(p.priority) || 0;
+            p.schedule_jitter = parseInt(p.schedule_jitter) || 0;
+            p.base_port = parseInt(p.base_port) || 0;
+            p.cpu_quota = parseInt(p.cpu_quota) || 0;
+            p.pids_max = parseInt(p.pids_max) || 0;
+            p.limits = parseLimits(p.limits);
+            p.env_files = parseStringList(p.env_files);
+            p.pass_env = parseStringList(p.pass_env);
+            p.health_check_interval = parseInt(p.health_check_interval);
+            p.health_check_timeout = parseInt(p.health_check_timeout);
+            p.health_check_threshold = parseInt(p.health_check_threshold);
 
             $.ajax({
                 url: "/" + vm.host + "/api/programs/" + p.name,
@@ -73,7 +105,7 @@ var vm = new Vue({
                     }
                 },
                 error: function (err) {
-                    alertify.error(err.responseText);
+                    alertify.error(ajaxErrorMessage(err));
                     console.log(err.responseText);
                 }
             });
@@ -96,6 +128,9 @@ var vm = new Vue({
                     } else {
                         alert(data.value);
                     }
+                },
+                error: function (err) {
+                    alert(ajaxErrorMessage(err));
                 }
             });
         }
@@ -111,6 +146,9 @@ var vm = new Vue({
                 method: 'post',
                 success: function (data) {
                     console.log(data);
+                },
+                error: function (err) {
+                    alertify.error(ajaxErrorMessage(err));
                 }
             })
         }
@@ -121,6 +159,9 @@ var vm = new Vue({
                 method: 'post',
                 success: function (data) {
                     console.log(data);
+                },
+                error: function (err) {
+                    alertify.error(ajaxErrorMessage(err));
                 }
             })
         }
@@ -161,6 +202,12 @@ var vm = new Vue({
                 method: 'delete',
                 success: function (data) {
                     console.log(data);
+                    if (data.status !== 0) {
+                        alertify.error(data.error);
+                    }
+                },
+                error: function (err) {
+                    alertify.error(ajaxErrorMessage(err));
                 }
             })
         }
@@ -169,6 +216,7 @@ var vm = new Vue({
             switch (status) {
                 case "running":
                 case "retry wait":
+                case "unhealthy":
                     return true;
             }
         }
@@ -301,11 +349,34 @@ Vue.filter('colorStatus', function (value) {
             return makeColorText(running + " " + value.status, "green");
         case "fatal":
             return makeColorText(value.process_num + " " + value.status, "red");
+        case "exited":
+            return makeColorText(value.process_num + " " + value.status, "#337ab7");
+        case "unhealthy":
+            return makeColorText(value.process_num + " " + value.status, "#ff9900");
         default:
             return makeColorText(value.process_num + " " + value.status, "gray");
     }
 });
 
+//
+// 使用场合: p.health | colorHealth
+//
+Vue.filter('colorHealth', function (value) {
+    var makeColorText = function (text, color) {
+        return "<span class='status' style='background-color:" + color + "'>" + text + "</span>";
+    };
+    switch (value) {
+        case "healthy":
+            return makeColorText(value, "green");
+        case "unhealthy":
+            return makeColorText(value, "#ff9900");
+        case "starting":
+            return makeColorText(value, "gray");
+        default:
+            return "";
+    }
+});
+
 Vue.directive('disable', function (value) {
     // 直接修改 model 的状态
     this.el.disabled = !!value
@@ -332,7 +403,7 @@ $(function () {
                 }
             },
             error: function (err) {
-                alertify.error(err.responseText);
+                alertify.error(ajaxErrorMessage(err));
                 console.log(err.responseText);
             }
         });
@@ -374,6 +445,9 @@ $(function () {
                 // 收到消息之后，就更新状态
                 if (evt.data == heartbeat_msg) {
                     missed_heartbeats = 0;
+                } else if (evt.data == "Database recovered" && $(".degraded-alert").length > 0) {
+                    // 退出降级模式, 重新加载页面
+                    location.reload();
                 } else {
                     console.log("response:" + evt.data);
                     vm.refresh();
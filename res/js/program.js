@@ -27,13 +27,28 @@ var vm = new Vue({
         edit: {
             program: null
         },
+        history: {
+            process: '',
+            runs: []
+        },
         host: host,
         current_user: current_user,
+        current_groups: current_groups,
+        user_role: user_role,
         is_admin: is_admin
     },
     methods: {
+        canManage: function (p) {
+            return canManageProgram(p, this.current_user, this.current_groups, this.user_role);
+        },
+        canCreate: function () {
+            return this.user_role === "admin" || this.user_role === "operator";
+        },
         showEditProgram: function () {
             this.edit.program = Object.assign({}, this.program);
+            this.edit.program.args = parseLines(this.edit.program.args).join("\n");
+            this.edit.program.shell = String(this.edit.program.shell !== false);
+            this.edit.program.limits = formatLimits(this.edit.program.limits);
             $("#program_edit").modal('show');
         },
         editProgram: function () {
@@ -44,6 +59,27 @@ var vm = new Vue({
             p.start_retries = parseInt(p.start_retries);
             p.process_num = parseInt(p.process_num);
             p.stop_timeout = parseInt(p.stop_timeout);
+            p.restart_delay = parseInt(p.restart_delay);
+            p.restart_max_delay = parseInt(p.restart_max_delay);
+            p.restart_backoff = parseFloat(p.restart_backoff);
+            p.restart_reset_seconds = parseInt(p.restart_reset_seconds);
+            p.exit_codes = parseExitCodes(p.exit_codes);
+            p.depends_on = parseStringList(p.depends_on);
+            p.owners = parseStringList(p.owners);
+            p.owner_groups = parseStringList(p.owner_groups);
+            p.args = parseLines(p.args);
+            p.shell = String(p.shell) !== "false";
+            p.priority = parseInt(p.priority) || 0;
+            p.schedule_jitter = parseInt(p.schedule_jitter) || 0;
+            p.base_port = parseInt(p.base_port) || 0;
+            p.cpu_quota = parseInt(p.cpu_quota) || 0;
+            p.pids_max = parseInt(p.pids_max) || 0;
+            p.limits = parseLimits(p.limits);
+            p.env_files = parseStringList(p.env_files);
+            p.pass_env = parseStringList(p.pass_env);
+            p.health_check_interval = parseInt(p.health_check_interval);
+            p.health_check_timeout = parseInt(p.health_check_timeout);
+            p.health_check_threshold = parseInt(p.health_check_threshold);
 
             $.ajax({
                 url: "/" + vm.host + "/api/programs/" + p.name,
@@ -58,7 +94,7 @@ var vm = new Vue({
                     }
                 },
                 error: function (err) {
-                    alertify.error(err.responseText);
+                    alertify.error(ajaxErrorMessage(err));
                     console.log(err.responseText);
                 }
             });
@@ -162,10 +198,27 @@ var vm = new Vue({
                 keyboard: true
             })
         },
+        cmdHistory: function (process) {
+            var that = this;
+            that.history.process = process.process_name;
+            that.history.runs = [];
+            $.ajax({
+                url: "/" + vm.host + "/api/processes/" + process.program.name + "/" + process.index + "/history",
+                success: function (data) {
+                    if (data.status === 0) {
+                        that.history.runs = data.value;
+                    } else {
+                        alertify.error(data.value);
+                    }
+                }
+            });
+            $("#modal_history").modal('show');
+        },
         canStop: function (status) {
             switch (status) {
                 case "running":
                 case "retry wait":
+                case "unhealthy":
                     return true;
             }
         }
@@ -276,6 +329,17 @@ Vue.filter('fromNow', function (value) {
     return moment(value).fromNow();
 });
 
+Vue.filter('formatTime', function (value) {
+    return value ? moment(value).format("YYYY-MM-DD HH:mm:ss") : "-";
+});
+
+Vue.filter('formatDuration', function (value) {
+    var seconds = Math.round(parseFloat(value) || 0);
+    if (seconds < 60) return seconds + "s";
+    else if (seconds < 3600) return Math.floor(seconds / 60) + "m" + seconds % 60 + "s";
+    else return Math.floor(seconds / 3600) + "h" + Math.floor(seconds % 3600 / 60) + "m";
+});
+
 Vue.filter('formatBytes', function (value) {
     var bytes = parseFloat(value);
     if (bytes < 0) return "-";
@@ -299,11 +363,34 @@ Vue.filter('colorStatus', function (value) {
             return makeColorText(value, "green");
         case "fatal":
             return makeColorText(value, "red");
+        case "exited":
+            return makeColorText(value, "#337ab7");
+        case "unhealthy":
+            return makeColorText(value, "#ff9900");
         default:
             return makeColorText(value, "gray");
     }
 });
 
+//
+// 使用场合: p.health | colorHealth
+//
+Vue.filter('colorHealth', function (value) {
+    var makeColorText = function (text, color) {
+        return "<span class='status' style='background-color:" + color + "'>" + text + "</span>";
+    };
+    switch (value) {
+        case "healthy":
+            return makeColorText(value, "green");
+        case "unhealthy":
+            return makeColorText(value, "#ff9900");
+        case "starting":
+            return makeColorText(value, "gray");
+        default:
+            return "";
+    }
+});
+
 Vue.directive('disable', function (value) {
     // 直接修改 model 的状态
     this.el.disabled = !!value
@@ -347,6 +434,11 @@ $(function () {
             onmessage: function (evt) {
                 // 收到消息之后，就更新状态
                 console.log("response:" + evt.data);
+                if (evt.data == "Database recovered" && $(".degraded-alert").length > 0) {
+                    // 退出降级模式, 重新加载页面
+                    location.reload();
+                    return;
+                }
                 vm.refresh();
             },
             onclose: function (evt) {
@@ -0,0 +1,81 @@
+/* token.js */
+var vm = new Vue({
+    el: "#app",
+    data: {
+        form: {
+            name: '',
+            scope: 'read',
+            programs: '',
+            expires_at: ''
+        },
+        tokens: [],
+        created: '',
+        host: host,
+        current_user: current_user,
+        user_role: user_role
+    },
+    methods: {
+        load: function () {
+            var that = this;
+            $.ajax({
+                url: "/" + vm.host + "/api/tokens",
+                success: function (data) {
+                    if (data.status === 0) {
+                        that.tokens = data.value;
+                    } else {
+                        alertify.error(data.value);
+                    }
+                }
+            });
+        },
+        create: function () {
+            var that = this;
+            $.ajax({
+                url: "/" + vm.host + "/api/tokens",
+                method: "POST",
+                data: this.form,
+                success: function (data) {
+                    if (data.status === 0) {
+                        that.created = data.value.token;
+                        that.form.name = '';
+                        that.load();
+                    } else {
+                        alertify.error(data.value);
+                    }
+                },
+                error: function (err) {
+                    alertify.error(err.responseText);
+                }
+            });
+        },
+        revoke: function (token) {
+            if (!confirm("确定撤销Token: " + token.name + " " + token.prefix + "?")) {
+                return;
+            }
+            var that = this;
+            $.ajax({
+                url: "/" + vm.host + "/api/tokens/" + token.id,
+                method: "DELETE",
+                success: function (data) {
+                    if (data.status === 0) {
+                        alertify.success(data.value);
+                        that.load();
+                    } else {
+                        alertify.error(data.value);
+                    }
+                },
+                error: function (err) {
+                    alertify.error(err.responseText);
+                }
+            });
+        }
+    }
+});
+
+Vue.filter('formatTime', function (value) {
+    return value ? moment(value).format("YYYY-MM-DD HH:mm:ss") : "-";
+});
+
+$(function () {
+    vm.load();
+});